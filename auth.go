@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OperationRead  = "read"
+	OperationWrite = "write"
+	OperationLock  = "lock"
+	OperationAdmin = "admin"
+)
+
+const principalContextKey = "principal"
+const operationContextKey = "operation"
+
+var ErrUnauthenticated = errors.New("Valid basic auth credentials or bearer token required")
+
+/*
+Operations a client may perform on the states under some prefixes.
+Empty prefixes cover all the states and empty operations cover all the operations.
+*/
+type Permission struct {
+	Prefixes   []string `json:"prefixes"`
+	Operations []string `json:"operations"`
+}
+
+func validatePermission(permission Permission) error {
+	for _, operation := range permission.Operations {
+		if operation != OperationRead && operation != OperationWrite && operation != OperationLock && operation != OperationAdmin {
+			return errors.New(fmt.Sprintf("Operation %s is not one of read, write, lock or admin", operation))
+		}
+	}
+
+	return nil
+}
+
+/*
+Whether the permission covers an operation on a state, or on all the states under a prefix if isPrefix is set.
+Prefixes of permissions are matched on segment boundaries, so that /team-a covers /team-a/network but not /team-ab.
+A prefix of states is only covered if it is under a prefix of the permission, as /team-a would also list /team-ab.
+*/
+func (p Permission) Allows(operation string, key string, isPrefix bool) bool {
+	operationOk := len(p.Operations) == 0
+	for _, allowed := range p.Operations {
+		if allowed == operation {
+			operationOk = true
+		}
+	}
+	if !operationOk {
+		return false
+	}
+
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, allowed := range p.Prefixes {
+		if isPrefix && strings.HasPrefix(key, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
+		if !isPrefix && hasSegmentPrefix(key, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Client authenticated by a request. Clients authenticated with the basic auth accounts file are unrestricted.
+*/
+type Principal struct {
+	Name         string
+	Unrestricted bool
+	Permissions  []Permission
+}
+
+func (p *Principal) Allows(operation string, key string, isPrefix bool) bool {
+	if p.Unrestricted {
+		return true
+	}
+
+	for _, permission := range p.Permissions {
+		if permission.Allows(operation, key, isPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Whether the client holds all the operations of a permission on all its prefixes, so that it can hand it out to an api token
+*/
+func (p *Principal) Grants(permission Permission) bool {
+	if p.Unrestricted {
+		return true
+	}
+
+	operations := permission.Operations
+	if len(operations) == 0 {
+		operations = []string{OperationRead, OperationWrite, OperationLock, OperationAdmin}
+	}
+	prefixes := permission.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	for _, operation := range operations {
+		for _, prefix := range prefixes {
+			if !p.Allows(operation, prefix, false) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/*
+Authenticates a request with basic auth credentials from the accounts file, an api token or a jwt.
+Tokens can be passed as a bearer token or as the basic auth password, which is what terraform's http backend sends.
+*/
+func authenticate(req *http.Request, accounts gin.Accounts, verifier *JwtVerifier, tokens *TokenStore) (*Principal, error) {
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return authenticateToken(strings.TrimPrefix(header, "Bearer "), verifier, tokens)
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	if expected, exists := accounts[username]; exists && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+		return &Principal{Name: username, Unrestricted: true}, nil
+	}
+
+	return authenticateToken(password, verifier, tokens)
+}
+
+func authenticateToken(token string, verifier *JwtVerifier, tokens *TokenStore) (*Principal, error) {
+	if isApiToken(token) && tokens != nil {
+		return tokens.Authenticate(token)
+	}
+
+	if strings.Count(token, ".") == 2 && verifier != nil {
+		return verifier.Authenticate(token)
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+/*
+Middleware rejecting unauthenticated requests and storing the authenticated client for the authorization checks
+*/
+func getAuthMiddleware(accounts gin.Accounts, verifier *JwtVerifier, tokens *TokenStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, authErr := authenticate(c.Request, accounts, verifier, tokens)
+		if authErr != nil {
+			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"status": "unauthorized",
+				"error":  authErr.Error(),
+			})
+			return
+		}
+
+		c.Set(principalContextKey, principal)
+		c.Next()
+	}
+}
+
+/*
+Returns the name of the authenticated client, or an empty string if no authentication is configured
+*/
+func getPrincipalName(c *gin.Context) string {
+	value, exists := c.Get(principalContextKey)
+	if !exists {
+		return ""
+	}
+
+	return value.(*Principal).Name
+}
+
+/*
+Checks that the client is allowed to perform the operation of the handler on a state or prefix of states,
+responding with a 403 status code if it isn't. Requests are not restricted when no authentication is configured.
+*/
+func checkAuthorization(c *gin.Context, key string, isPrefix bool) bool {
+	value, exists := c.Get(principalContextKey)
+	if !exists {
+		return true
+	}
+
+	operation := c.GetString(operationContextKey)
+	if !value.(*Principal).Allows(operation, key, isPrefix) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "forbidden",
+			"error":  fmt.Sprintf("Not allowed to perform %s operations on %s", operation, key),
+		})
+		return false
+	}
+
+	return true
+}
+
+/*
+Checks that the client holds the permissions it hands out, responding with a 403 status code if it doesn't.
+Requests are not restricted when no authentication is configured.
+*/
+func checkGrants(c *gin.Context, permissions []Permission) bool {
+	value, exists := c.Get(principalContextKey)
+	if !exists {
+		return true
+	}
+
+	for _, permission := range permissions {
+		if !value.(*Principal).Grants(permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "forbidden",
+				"error":  fmt.Sprintf("Not allowed to grant %s operations on %s", strings.Join(permission.Operations, ","), strings.Join(permission.Prefixes, ",")),
+			})
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Wraps a handler so that the states it accesses are checked against the permissions of the client for an operation.
+Admin operations apply to the whole namespace and are checked before the handler is called.
+*/
+func authorize(operation string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(operationContextKey, operation)
+		if operation == OperationAdmin {
+			namespace, _ := resolveStatePrefix("")
+			if !checkAuthorization(c, namespace, true) {
+				return
+			}
+		}
+
+		handler(c)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/klauspost/compress/zstd"
+)
+
+const backupManifestFile = "manifest.json"
+
+type BackupManifestEntry struct {
+	State   string `json:"state"`
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	Version int64  `json:"version"`
+	Sha256  string `json:"sha256"`
+}
+
+/*
+Manifest describing the states contained in a backup archive.
+It is the last file of the archive.
+*/
+type BackupManifest struct {
+	CreatedAt time.Time             `json:"created_at"`
+	Prefix    string                `json:"prefix"`
+	States    []BackupManifestEntry `json:"states"`
+}
+
+type RestoreOptions struct {
+	ToPrefix  string
+	Overwrite bool
+}
+
+type RestoreReport struct {
+	Restored []string
+	Skipped  []string
+}
+
+type archiveWriter struct {
+	*tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *archiveWriter) Close() error {
+	tarErr := w.Writer.Close()
+	if tarErr != nil {
+		return tarErr
+	}
+
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+
+	return nil
+}
+
+func newArchiveWriter(path string, dest io.Writer) (*archiveWriter, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.zst"):
+		compressor, err := zstd.NewWriter(dest)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveWriter{tar.NewWriter(compressor), compressor}, nil
+	case strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz"):
+		compressor := gzip.NewWriter(dest)
+		return &archiveWriter{tar.NewWriter(compressor), compressor}, nil
+	case strings.HasSuffix(path, ".tar"):
+		return &archiveWriter{tar.NewWriter(dest), nil}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unsupported archive extension for %s. It should be one of: .tar, .tar.gz, .tgz, .tar.zst", path))
+}
+
+func newArchiveReader(path string, src io.Reader) (*tar.Reader, func(), error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.zst"):
+		decompressor, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(decompressor), decompressor.Close, nil
+	case strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz"):
+		decompressor, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(decompressor), func() { decompressor.Close() }, nil
+	case strings.HasSuffix(path, ".tar"):
+		return tar.NewReader(src), func() {}, nil
+	}
+
+	return nil, nil, errors.New(fmt.Sprintf("Unsupported archive extension for %s. It should be one of: .tar, .tar.gz, .tgz, .tar.zst", path))
+}
+
+/*
+Returns the states found under a prefix, detected by the presence of their chunked key metadata
+*/
+func listStates(cli *client.EtcdClient, prefix string) ([]string, error) {
+	keys, keysErr := listKeys(cli, prefix)
+	if keysErr != nil {
+		return nil, keysErr
+	}
+
+	states := []string{}
+	for _, key := range keys {
+		if state, isInfo := getStateInfoState(key); isInfo {
+			states = append(states, state)
+		}
+	}
+
+	return states, nil
+}
+
+/*
+Reads a whole state in memory, returning nil if it doesn't exist
+*/
+func readState(cli *client.EtcdClient, state string) ([]byte, *client.ChunkedKeyInfo, error) {
+	payload, getErr := cli.GetChunkedKey(getStateKey(state))
+	if getErr != nil || payload == nil {
+		return nil, nil, getErr
+	}
+	defer payload.Close()
+
+	//The reader holds the metadata of the version that is being read
+	reader, isChunksReader := payload.Value.(*client.ChunksReader)
+	if !isChunksReader {
+		return nil, nil, errors.New(fmt.Sprintf("Unexpected reader type %T for the chunks of state %s", payload.Value, state))
+	}
+	info := reader.Snapshot.Info
+
+	var buf bytes.Buffer
+	_, readErr := buf.ReadFrom(payload)
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+
+	return buf.Bytes(), &info, nil
+}
+
+func writeArchiveFile(archive *archiveWriter, name string, content []byte, modTime time.Time) error {
+	headerErr := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	})
+	if headerErr != nil {
+		return headerErr
+	}
+
+	_, writeErr := archive.Write(content)
+	return writeErr
+}
+
+/*
+Writes all the states under a prefix to an archive, followed by a manifest with their checksums.
+States are read one at a time in memory.
+*/
+func backupStates(cli *client.EtcdClient, prefix string, archive *archiveWriter) (BackupManifest, error) {
+	manifest := BackupManifest{
+		CreatedAt: time.Now(),
+		Prefix:    prefix,
+		States:    []BackupManifestEntry{},
+	}
+
+	states, statesErr := listStates(cli, prefix)
+	if statesErr != nil {
+		return manifest, statesErr
+	}
+
+	for _, state := range states {
+		content, info, readErr := readState(cli, state)
+		if readErr != nil {
+			return manifest, errors.New(fmt.Sprintf("Error reading state %s: %s", state, readErr.Error()))
+		}
+		//State deleted since it was listed
+		if info == nil {
+			continue
+		}
+
+		file := fmt.Sprintf("states/%d.tfstate", len(manifest.States))
+		writeErr := writeArchiveFile(archive, file, content, manifest.CreatedAt)
+		if writeErr != nil {
+			return manifest, writeErr
+		}
+
+		checksum := sha256.Sum256(content)
+		manifest.States = append(manifest.States, BackupManifestEntry{
+			State:   state,
+			File:    file,
+			Size:    int64(len(content)),
+			Version: info.Version,
+			Sha256:  hex.EncodeToString(checksum[:]),
+		})
+	}
+
+	output, _ := json.MarshalIndent(manifest, "", "  ")
+	return manifest, writeArchiveFile(archive, backupManifestFile, output, manifest.CreatedAt)
+}
+
+func backupStatesToFile(cli *client.EtcdClient, prefix string, path string) (BackupManifest, error) {
+	//The archive is written to a temporary file that replaces the destination once complete, so that a failed
+	//backup doesn't leave a truncated archive behind or overwrite a previous one
+	f, createErr := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.tmp-*", filepath.Base(path)))
+	if createErr != nil {
+		return BackupManifest{}, errors.New(fmt.Sprintf("Error creating the backup archive: %s", createErr.Error()))
+	}
+	completed := false
+	defer func() {
+		f.Close()
+		if !completed {
+			os.Remove(f.Name())
+		}
+	}()
+
+	archive, archiveErr := newArchiveWriter(path, f)
+	if archiveErr != nil {
+		return BackupManifest{}, archiveErr
+	}
+
+	manifest, backupErr := backupStates(cli, prefix, archive)
+	if backupErr != nil {
+		return manifest, backupErr
+	}
+
+	closeErr := archive.Close()
+	if closeErr != nil {
+		return manifest, closeErr
+	}
+
+	syncErr := f.Sync()
+	if syncErr != nil {
+		return manifest, syncErr
+	}
+
+	closeErr = f.Close()
+	if closeErr != nil {
+		return manifest, closeErr
+	}
+
+	renameErr := os.Rename(f.Name(), path)
+	if renameErr != nil {
+		return manifest, errors.New(fmt.Sprintf("Error moving the backup archive in place: %s", renameErr.Error()))
+	}
+	completed = true
+
+	return manifest, nil
+}
+
+func readBackupManifest(path string) (BackupManifest, error) {
+	var manifest BackupManifest
+
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return manifest, errors.New(fmt.Sprintf("Error opening the backup archive: %s", openErr.Error()))
+	}
+	defer f.Close()
+
+	archive, closeArchive, archiveErr := newArchiveReader(path, f)
+	if archiveErr != nil {
+		return manifest, archiveErr
+	}
+	defer closeArchive()
+
+	for {
+		header, nextErr := archive.Next()
+		if nextErr == io.EOF {
+			return manifest, errors.New("Backup archive doesn't have a manifest")
+		}
+		if nextErr != nil {
+			return manifest, nextErr
+		}
+
+		if header.Name == backupManifestFile {
+			decodeErr := json.NewDecoder(archive).Decode(&manifest)
+			if decodeErr != nil {
+				return manifest, errors.New(fmt.Sprintf("Error parsing the backup manifest: %s", decodeErr.Error()))
+			}
+			return manifest, nil
+		}
+	}
+}
+
+func getRestoredState(state string, manifest BackupManifest, opts RestoreOptions) string {
+	if opts.ToPrefix == "" {
+		return state
+	}
+
+	return opts.ToPrefix + strings.TrimPrefix(state, manifest.Prefix)
+}
+
+/*
+Writes a state back in etcd unless it exists and overwriting it was not requested, or it is locked
+*/
+func restoreState(cli *client.EtcdClient, state string, content []byte, opts RestoreOptions) (bool, error) {
+	_, lockErr := readLock(cli, state)
+	if lockErr == nil {
+		return false, nil
+	}
+	if lockErr != ErrLockNotFound {
+		return false, lockErr
+	}
+
+	if !opts.Overwrite {
+		info, _, infoErr := getStateInfo(cli, state)
+		if infoErr != nil {
+			return false, infoErr
+		}
+		if info != nil {
+			return false, nil
+		}
+	}
+
+	putErr := cli.PutChunkedKey(&client.ChunkedKeyPayload{
+		Key:   getStateKey(state),
+		Value: io.NopCloser(bytes.NewReader(content)),
+		Size:  int64(len(content)),
+	})
+	return putErr == nil, putErr
+}
+
+/*
+Restores the states of a backup archive.
+The archive is read twice: once to get the manifest at its end and once to restore the states,
+each of which is verified against its checksum in the manifest before it is written.
+*/
+func restoreStatesFromFile(cli *client.EtcdClient, path string, opts RestoreOptions) (RestoreReport, error) {
+	report := RestoreReport{Restored: []string{}, Skipped: []string{}}
+
+	manifest, manifestErr := readBackupManifest(path)
+	if manifestErr != nil {
+		return report, manifestErr
+	}
+
+	entries := map[string]BackupManifestEntry{}
+	for _, entry := range manifest.States {
+		entries[entry.File] = entry
+	}
+
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return report, errors.New(fmt.Sprintf("Error opening the backup archive: %s", openErr.Error()))
+	}
+	defer f.Close()
+
+	archive, closeArchive, archiveErr := newArchiveReader(path, f)
+	if archiveErr != nil {
+		return report, archiveErr
+	}
+	defer closeArchive()
+
+	for {
+		header, nextErr := archive.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			return report, nextErr
+		}
+
+		entry, ok := entries[header.Name]
+		if !ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		_, readErr := buf.ReadFrom(archive)
+		if readErr != nil {
+			return report, readErr
+		}
+
+		checksum := sha256.Sum256(buf.Bytes())
+		if hex.EncodeToString(checksum[:]) != entry.Sha256 || int64(buf.Len()) != entry.Size {
+			return report, errors.New(fmt.Sprintf("Checksum of state %s in the archive doesn't match the manifest", entry.State))
+		}
+
+		state := getRestoredState(entry.State, manifest, opts)
+		restored, restoreErr := restoreState(cli, state, buf.Bytes(), opts)
+		if restoreErr != nil {
+			return report, errors.New(fmt.Sprintf("Error restoring state %s: %s", state, restoreErr.Error()))
+		}
+
+		if restored {
+			report.Restored = append(report.Restored, state)
+		} else {
+			report.Skipped = append(report.Skipped, state)
+		}
+	}
+
+	return report, nil
+}
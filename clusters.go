@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+)
+
+const defaultClusterName = "default"
+
+type Cluster struct {
+	Name     string
+	Prefixes []string
+	Client   *client.EtcdClient
+}
+
+/*
+Etcd clusters the states are stored in.
+States are routed to the cluster with the longest prefix matching them and to the default cluster,
+configured by etcd_client, if no prefix matches.
+*/
+type ClusterSet struct {
+	Default  *Cluster
+	Clusters []*Cluster
+}
+
+func ConnectClusters(ctx context.Context, config Config) (*ClusterSet, error) {
+	defaultCli, defaultErr := connectEtcd(ctx, config.EtcdClient)
+	if defaultErr != nil {
+		return nil, defaultErr
+	}
+
+	set := &ClusterSet{Default: &Cluster{Name: defaultClusterName, Client: defaultCli}}
+	set.Clusters = []*Cluster{set.Default}
+
+	for _, conf := range config.EtcdClusters {
+		cli, cliErr := connectEtcd(ctx, conf.EtcdClient)
+		if cliErr != nil {
+			set.Close()
+			return nil, errors.New(fmt.Sprintf("Error connecting to etcd cluster %s: %s", conf.Name, cliErr.Error()))
+		}
+
+		set.Clusters = append(set.Clusters, &Cluster{Name: conf.Name, Prefixes: conf.Prefixes, Client: cli})
+	}
+
+	return set, nil
+}
+
+/*
+Returns the cluster with the longest prefix covering a state, or the default cluster.
+Prefixes are matched on segment boundaries, so that a cluster for /prod doesn't get the states of /production.
+*/
+func (s *ClusterSet) GetCluster(state string) *Cluster {
+	match := s.Default
+	matchLen := -1
+	for _, cluster := range s.Clusters {
+		for _, prefix := range cluster.Prefixes {
+			if hasSegmentPrefix(state, prefix) && len(prefix) > matchLen {
+				match = cluster
+				matchLen = len(prefix)
+			}
+		}
+	}
+
+	return match
+}
+
+/*
+Returns the client of the cluster a state or a prefix of states is routed to
+*/
+func (s *ClusterSet) Get(state string) *client.EtcdClient {
+	cluster := s.GetCluster(state)
+	clusterRequestsMetric.WithLabelValues(cluster.Name).Inc()
+	return cluster.Client
+}
+
+/*
+Returns the clusters the states under a prefix can be routed to: the cluster the prefix itself is routed to
+and the clusters with a routing prefix under it. As the last segment of a listed prefix can be partial (/prod lists
+/production states), routing prefixes are matched as plain string prefixes here.
+*/
+func (s *ClusterSet) GetOverlapping(prefix string) []*Cluster {
+	overlapping := []*Cluster{s.GetCluster(prefix)}
+	//States sharing the partial last segment of the prefix are routed like the parent of the prefix
+	parent := s.GetCluster(prefix[:strings.LastIndex(prefix, "/")+1])
+	if parent != overlapping[0] {
+		overlapping = append(overlapping, parent)
+	}
+
+	for _, cluster := range s.Clusters {
+		if cluster == overlapping[0] || cluster == parent {
+			continue
+		}
+
+		for _, clusterPrefix := range cluster.Prefixes {
+			if strings.HasPrefix(clusterPrefix, prefix) {
+				overlapping = append(overlapping, cluster)
+				break
+			}
+		}
+	}
+
+	for _, cluster := range overlapping {
+		clusterRequestsMetric.WithLabelValues(cluster.Name).Inc()
+	}
+	return overlapping
+}
+
+/*
+Whether a state is routed to a cluster. Keys listed in a cluster that belong to states routed to another cluster
+are leftovers that the backend doesn't otherwise expose.
+*/
+func (s *ClusterSet) Routes(state string, cluster *Cluster) bool {
+	return s.GetCluster(state) == cluster
+}
+
+/*
+Checks that each cluster is reachable, returning the error of each unreachable cluster by name
+*/
+func (s *ClusterSet) CheckHealth() map[string]error {
+	errs := map[string]error{}
+	for _, cluster := range s.Clusters {
+		_, err := cluster.Client.GetMembers(false)
+		if err != nil {
+			errs[cluster.Name] = err
+			clusterUpMetric.WithLabelValues(cluster.Name).Set(0)
+			continue
+		}
+		clusterUpMetric.WithLabelValues(cluster.Name).Set(1)
+	}
+
+	return errs
+}
+
+func (s *ClusterSet) Close() {
+	for _, cluster := range s.Clusters {
+		cluster.Client.Close()
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+)
+
+type Command func(config Config, cli *client.EtcdClient, args []string) error
+
+var commands = map[string]Command{
+	"backup":         backupCommand,
+	"restore":        restoreCommand,
+	"migrate-legacy": migrateLegacyCommand,
+	"import":         importCommand,
+	"export":         exportCommand,
+	"gc":             gcCommand,
+	"fsck":           fsckCommand,
+	"create-token":   createTokenCommand,
+}
+
+func getCommandNames() []string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Returns the configuration of the etcd cluster commands run against: the cluster named by the ETCD_BACKEND_CLUSTER
+environment variable or the default cluster
+*/
+func getCommandEtcdClientConfig(config Config) (ConfigEtcdClient, error) {
+	name := os.Getenv("ETCD_BACKEND_CLUSTER")
+	if name == "" || name == defaultClusterName {
+		return config.EtcdClient, nil
+	}
+
+	for _, cluster := range config.EtcdClusters {
+		if cluster.Name == name {
+			return cluster.EtcdClient, nil
+		}
+	}
+
+	return ConfigEtcdClient{}, errors.New(fmt.Sprintf("Unknown etcd cluster %s", name))
+}
+
+/*
+Runs a maintenance command against the configured etcd cluster instead of serving the api
+*/
+func RunCommand(config Config, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown command %s. Available commands are: %s", name, strings.Join(getCommandNames(), ", ")))
+	}
+
+	setKeyLayout(config)
+
+	etcdConf, etcdConfErr := getCommandEtcdClientConfig(config)
+	if etcdConfErr != nil {
+		return etcdConfErr
+	}
+
+	cli, cliErr := connectEtcd(context.Background(), etcdConf)
+	if cliErr != nil {
+		return cliErr
+	}
+	defer cli.Close()
+
+	return cmd(config, cli, args)
+}
+
+func backupCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "Etcd prefix of the states to back up")
+	out := flags.String("out", "", "Path of the archive to create. The compression is inferred from the extension: .tar, .tar.gz or .tar.zst")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	if *out == "" {
+		return errors.New("The out flag is required")
+	}
+
+	manifest, backupErr := backupStatesToFile(cli, *prefix, *out)
+	if backupErr != nil {
+		return backupErr
+	}
+
+	fmt.Printf("Backed up %d states under prefix '%s' to %s\n", len(manifest.States), *prefix, *out)
+	return nil
+}
+
+func restoreCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := flags.String("in", "", "Path of the archive to restore")
+	toPrefix := flags.String("to-prefix", "", "If set, the states are restored under this prefix instead of the prefix they were backed up from")
+	overwrite := flags.Bool("overwrite", false, "Whether to overwrite states that already exist")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	if *in == "" {
+		return errors.New("The in flag is required")
+	}
+
+	report, restoreErr := restoreStatesFromFile(cli, *in, RestoreOptions{
+		ToPrefix:  *toPrefix,
+		Overwrite: *overwrite,
+	})
+	for _, state := range report.Skipped {
+		fmt.Printf("Skipped state %s\n", state)
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+
+	fmt.Printf("Restored %d states from %s\n", len(report.Restored), *in)
+	return nil
+}
+
+func migrateLegacyCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("migrate-legacy", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "Etcd prefix that was configured in the legacy etcdv3 backend")
+	addSlash := flags.Bool("add-slash", config.LegacySupport.AddSlash, "Whether the legacy prefix is the state prefix followed by a slash. Defaults to the add_slash legacy support option")
+	separator := flags.String("separator", "/", "Separator between the state prefix and the workspace name for the states of non-default workspaces")
+	overwrite := flags.Bool("overwrite", false, "Whether to overwrite states that already exist in the chunked format")
+	deleteLegacy := flags.Bool("delete", false, "Whether to delete the legacy states once their migration is verified")
+	dryRun := flags.Bool("dry-run", false, "Only report the legacy states that would be migrated")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	if *prefix == "" {
+		return errors.New("The prefix flag is required")
+	}
+
+	results, migrateErr := migrateLegacyStates(cli, LegacyMigrationOptions{
+		Prefix:    *prefix,
+		AddSlash:  *addSlash,
+		Separator: *separator,
+		Overwrite: *overwrite,
+		Delete:    *deleteLegacy,
+		DryRun:    *dryRun,
+	})
+	for _, result := range results {
+		deleted := ""
+		if result.Deleted {
+			deleted = " (legacy state deleted)"
+		}
+		fmt.Printf("%s -> %s: %s%s\n", result.LegacyKey, result.State, result.Status, deleted)
+	}
+
+	return migrateErr
+}
+
+func importCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("file", "", "Path of a single state file to import. Requires the state flag")
+	state := flags.String("state", "", "Etcd prefix of the state to import a single state file in")
+	dir := flags.String("dir", "", "Directory tree of .tfstate files to import. Requires the prefix flag")
+	prefix := flags.String("prefix", "", "Etcd prefix to import the states of a directory tree under")
+	mapping := flags.String("mapping", "", "Path of a yaml file mapping state files to the etcd prefix of their state")
+	consul := flags.String("consul", "", "Path of a consul kv export of the keys of terraform's consul backend. Requires the prefix flag")
+	force := flags.Bool("force", false, "Whether to skip the lineage and serial checks against existing states")
+	dryRun := flags.Bool("dry-run", false, "Only report the states that would be imported")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	var entries []ImportEntry
+	var entriesErr error
+	switch {
+	case *file != "" && *state != "":
+		entries = []ImportEntry{{File: *file, State: *state}}
+	case *dir != "" && *prefix != "":
+		entries, entriesErr = getDirectoryImportEntries(*dir, *prefix)
+	case *consul != "" && *prefix != "":
+		entries, entriesErr = getConsulImportEntries(*consul, *prefix)
+	case *mapping != "":
+		entries, entriesErr = getMappingImportEntries(*mapping)
+	default:
+		return errors.New("Either the file and state flags, the dir and prefix flags, the consul and prefix flags or the mapping flag are required")
+	}
+	if entriesErr != nil {
+		return entriesErr
+	}
+
+	failures := 0
+	for _, result := range importStates(cli, config, entries, ImportOptions{Force: *force, DryRun: *dryRun}) {
+		if result.Error != nil {
+			failures += 1
+			fmt.Printf("%s -> %s: error: %s\n", result.File, result.State, result.Error.Error())
+			continue
+		}
+		fmt.Printf("%s -> %s: %s\n", result.File, result.State, result.Status)
+	}
+
+	if failures > 0 {
+		return errors.New(fmt.Sprintf("%d states out of %d could not be imported", failures, len(entries)))
+	}
+	return nil
+}
+
+func exportCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "Etcd prefix of the states to export")
+	dir := flags.String("dir", "", "Directory to export the states in")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+	if *dir == "" {
+		return errors.New("The dir flag is required")
+	}
+
+	exported, exportErr := exportStates(cli, *prefix, *dir)
+	for _, entry := range exported {
+		fmt.Printf("%s -> %s\n", entry.State, entry.File)
+	}
+	if exportErr != nil {
+		return exportErr
+	}
+
+	fmt.Printf("Exported %d states under prefix '%s' to %s\n", len(exported), *prefix, *dir)
+	return nil
+}
+
+func gcCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	prefix := flags.String("prefix", config.Gc.Prefix, "Etcd prefix to collect garbage under. Defaults to the prefix of the gc configuration")
+	grace := flags.Duration("grace", config.Gc.Grace, "Period to wait for before removing the chunks found, so that chunks of writes in progress are not removed. Defaults to the grace of the gc configuration")
+	lockMaxAge := flags.Duration("lock-max-age", config.Gc.LockMaxAge, "Age after which the locks of states that don't exist are removed. Defaults to the lock_max_age of the gc configuration")
+	dryRun := flags.Bool("dry-run", false, "Only report the chunks and locks that would be removed")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	safeRevision, revisionErr := getEtcdRevision(cli)
+	if revisionErr != nil {
+		return revisionErr
+	}
+
+	//The chunks found may belong to writes in progress. Those are only removed if they were not modified after the
+	//grace period, by which time the writes either completed or failed, as the background collection does.
+	opts := GcOptions{
+		Prefix:       *prefix,
+		SafeRevision: safeRevision,
+		LockMaxAge:   *lockMaxAge,
+		DryRun:       true,
+	}
+	report, gcErr := collectGarbage(cli, opts)
+	if gcErr == nil && !*dryRun {
+		if len(report.ChunkVersions) > 0 && *grace > 0 {
+			fmt.Printf("Waiting %s for writes in progress before removing %d chunk versions\n", grace.String(), len(report.ChunkVersions))
+			time.Sleep(*grace)
+		}
+
+		opts.DryRun = false
+		report, gcErr = collectGarbage(cli, opts)
+	}
+	for _, version := range report.ChunkVersions {
+		fmt.Printf("%s: version %d (%d chunks, %d bytes)\n", version.State, version.Version, version.Chunks, version.Bytes)
+	}
+	for _, lock := range report.Locks {
+		fmt.Printf("%s: abandoned lock\n", lock)
+	}
+	if gcErr != nil {
+		return gcErr
+	}
+
+	action := "Removed"
+	if *dryRun {
+		action = "Would remove"
+	}
+	fmt.Printf("%s %d orphaned chunk versions (%d bytes) and %d abandoned locks under prefix '%s'\n", action, len(report.ChunkVersions), report.ReclaimedBytes, len(report.Locks), *prefix)
+	return nil
+}
+
+func fsckCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "Etcd prefix of the states to check")
+	repair := flags.Bool("repair", false, "Whether to roll back inconsistent states to their last consistent orphaned version or backup")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	opts := FsckOptions{Repair: *repair}
+	if *repair {
+		store, storeErr := newBackupStore(config.Backups)
+		if storeErr != nil {
+			return storeErr
+		}
+		opts.Backups = store
+	}
+
+	report, checkErr := checkStates(cli, *prefix, opts)
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+	if checkErr != nil {
+		return checkErr
+	}
+
+	if report.Inconsistent > report.Repaired {
+		return errors.New(fmt.Sprintf("%d inconsistent states were found", report.Inconsistent-report.Repaired))
+	}
+	return nil
+}
+
+func createTokenCommand(config Config, cli *client.EtcdClient, args []string) error {
+	flags := flag.NewFlagSet("create-token", flag.ContinueOnError)
+	name := flags.String("name", "", "Name describing the usage of the token")
+	prefixes := flags.String("prefixes", "", "Comma-separated etcd prefixes of the states the token can access. All states if omitted")
+	operations := flags.String("operations", "", "Comma-separated operations the token allows among read, write, lock and admin. All operations if omitted")
+	expiresIn := flags.Duration("expires-in", 0, "Duration after which the token expires. The token doesn't expire if omitted")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	permission := Permission{Prefixes: []string{}, Operations: []string{}}
+	if *prefixes != "" {
+		permission.Prefixes = strings.Split(*prefixes, ",")
+	}
+	if *operations != "" {
+		permission.Operations = strings.Split(*operations, ",")
+	}
+
+	//The server reads tokens from the default cluster, so the command is only useful when run against it
+	store := &TokenStore{cli: cli, prefix: config.Tokens.Prefix, maxExpiry: config.Tokens.MaxExpiry}
+	secret, token, createErr := store.Create(ApiTokenOptions{
+		Name:        *name,
+		Permissions: []Permission{permission},
+		ExpiresIn:   *expiresIn,
+		CreatedBy:   "create-token command",
+	})
+	if createErr != nil {
+		return createErr
+	}
+
+	fmt.Printf("Created token %s: %s\n", token.Id, secret)
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"strings"
 	"time"
 	yaml "gopkg.in/yaml.v2"
 	"github.com/gin-gonic/gin"
@@ -33,9 +35,37 @@ type ConfigEtcdClient struct {
 	Auth              ConfigEtcdAuth
 }
 
+/*
+Additional etcd cluster storing the states under its prefixes instead of the cluster of the etcd_client configuration
+*/
+type ConfigEtcdCluster struct {
+	Name       string
+	Prefixes   []string
+	EtcdClient ConfigEtcdClient `yaml:"etcd_client"`
+}
+
+type ConfigKeys struct {
+	Namespace      string
+	LockSuffix     string `yaml:"lock_suffix"`
+	StateSuffix    string `yaml:"state_suffix"`
+	LockInfoSuffix string `yaml:"lock_info_suffix"`
+}
+
+type ConfigLockPolicy struct {
+	Prefix        string
+	DefaultTtl    time.Duration `yaml:"default_ttl"`
+	MinTtl        time.Duration `yaml:"min_ttl"`
+	MaxTtl        time.Duration `yaml:"max_ttl"`
+	AllowOverride bool          `yaml:"allow_override"`
+}
+
 type ConfigLock struct {
-	Timeout       time.Duration
-	RetryInterval time.Duration `yaml:"retry_interval"`
+	Timeout         time.Duration
+	RetryInterval   time.Duration      `yaml:"retry_interval"`
+	MaxTtl          time.Duration      `yaml:"max_ttl"`
+	MaxWait         time.Duration      `yaml:"max_wait"`
+	UploadKeepAlive bool               `yaml:"upload_keep_alive"`
+	Policies        []ConfigLockPolicy
 }
 
 type ConfigServerTls struct {
@@ -43,12 +73,55 @@ type ConfigServerTls struct {
 	Key         string
 }
 
+type ConfigUpload struct {
+	MaxBufferedSize int64  `yaml:"max_buffered_size"`
+	SpoolDirectory  string `yaml:"spool_directory"`
+}
+
+type ConfigJwtPermission struct {
+	Claim      string
+	Values     []string
+	Permission `yaml:",inline"`
+}
+
+type ConfigJwt struct {
+	JwksFile            string                `yaml:"jwks_file"`
+	JwksUrl             string                `yaml:"jwks_url"`
+	JwksRefreshInterval time.Duration         `yaml:"jwks_refresh_interval"`
+	Issuer              string
+	Audience            string
+	Permissions         []ConfigJwtPermission
+}
+
+type ConfigRate struct {
+	Rate  float64
+	Burst int64
+}
+
+type ConfigRateLimits struct {
+	PerIp                ConfigRate    `yaml:"per_ip"`
+	PerUser              ConfigRate    `yaml:"per_user"`
+	MaxConcurrentUploads int64         `yaml:"max_concurrent_uploads"`
+	UploadRetryAfter     time.Duration `yaml:"upload_retry_after"`
+}
+
+type ConfigShutdown struct {
+	DrainTimeout   time.Duration `yaml:"drain_timeout"`
+	ReadinessDelay time.Duration `yaml:"readiness_delay"`
+}
+
 type ConfigServer struct {
 	Port      int64
 	Address   string
 	BasicAuth string          `yaml:"basic_auth"`
 	Tls       ConfigServerTls
 	DebugMode bool            `yaml:"debug_mode"`
+	Upload         ConfigUpload
+	WatchKeepAlive time.Duration   `yaml:"watch_keep_alive"`
+	Jwt            ConfigJwt
+	RateLimits     ConfigRateLimits `yaml:"rate_limits"`
+	TrustedProxies []string         `yaml:"trusted_proxies"`
+	Shutdown       ConfigShutdown
 }
 
 type ConfigLegacySupport struct {
@@ -57,12 +130,104 @@ type ConfigLegacySupport struct {
 	AddSlash bool `yaml:"add_slash"`
 }
 
+type ConfigWebhook struct {
+	Name       string
+	Url        string
+	SecretFile string   `yaml:"secret_file"`
+	Secret     string   `yaml:"-"`
+	Prefixes   []string
+	Events     []string
+}
+
+type ConfigWebhooks struct {
+	Endpoints         []ConfigWebhook
+	OutboxPrefix      string        `yaml:"outbox_prefix"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+	RequestTimeout    time.Duration `yaml:"request_timeout"`
+	Retries           uint64
+	RetryInterval     time.Duration `yaml:"retry_interval"`
+	MaxRetryInterval  time.Duration `yaml:"max_retry_interval"`
+	LockHeldThreshold time.Duration `yaml:"lock_held_threshold"`
+}
+
+type ConfigBackupS3 struct {
+	Endpoint        string
+	Bucket          string
+	Path            string
+	Region          string
+	Insecure        bool
+	CaCert          string        `yaml:"ca_cert"`
+	CredentialsFile string        `yaml:"credentials_file"`
+	AccessKey       string        `yaml:"-"`
+	SecretKey       string        `yaml:"-"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+}
+
+type ConfigBackups struct {
+	Interval  time.Duration
+	Schedule  string
+	Retention int
+	Prefix    string
+	Directory string
+	S3        ConfigBackupS3
+	LockKey   string `yaml:"lock_key"`
+}
+
+type ConfigGc struct {
+	Interval   time.Duration
+	Prefix     string
+	Grace      time.Duration
+	LockMaxAge time.Duration `yaml:"lock_max_age"`
+	LockKey    string        `yaml:"lock_key"`
+}
+
+type ConfigMaintenance struct {
+	Enabled    bool
+	Message    string
+	RetryAfter time.Duration `yaml:"retry_after"`
+	Key        string
+}
+
+type ConfigReplication struct {
+	Prefix           string
+	Secondary        ConfigEtcdClient
+	CheckpointKey    string        `yaml:"checkpoint_key"`
+	LockKey          string        `yaml:"lock_key"`
+	ProgressInterval time.Duration `yaml:"progress_interval"`
+	RetryInterval    time.Duration `yaml:"retry_interval"`
+}
+
+type ConfigTokens struct {
+	Enabled   bool
+	Prefix    string
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+}
+
+type ConfigTermination struct {
+	TokenFile string `yaml:"token_file"`
+	Address   string
+}
+
+type S3Credentials struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
 type Config struct {
 	EtcdClient         ConfigEtcdClient    `yaml:"etcd_client"`
+	EtcdClusters       []ConfigEtcdCluster `yaml:"etcd_clusters"`
+	Keys               ConfigKeys
 	Lock    	       ConfigLock
 	Server             ConfigServer
 	LegacySupport      ConfigLegacySupport `yaml:"legacy_support"`
-	RemoteTerminiation bool                `yaml:"remote_termination"`
+	RemoteTermination  bool                `yaml:"remote_termination"`
+	Termination        ConfigTermination
+	Webhooks           ConfigWebhooks
+	Backups            ConfigBackups
+	Gc                 ConfigGc
+	Maintenance        ConfigMaintenance
+	Replication        ConfigReplication
+	Tokens             ConfigTokens
 }
 
 func getConfigFilePath() string {
@@ -89,6 +254,56 @@ func getPasswordAuth(path string) (EtcdPasswordAuth, error) {
 	return a, nil
 }
 
+func getS3Credentials(path string) (S3Credentials, error) {
+	var c S3Credentials
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, errors.New(fmt.Sprintf("Error reading the s3 credentials file: %s", err.Error()))
+	}
+
+	err = yaml.Unmarshal(b, &c)
+	if err != nil {
+		return c, errors.New(fmt.Sprintf("Error parsing the s3 credentials file: %s", err.Error()))
+	}
+
+	return c, nil
+}
+
+func getWebhookSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error reading the webhook secret file: %s", err.Error()))
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func getEtcdClientConfig(conf ConfigEtcdClient) (ConfigEtcdClient, error) {
+	if conf.Auth.PasswordAuth != "" {
+		pAuth, pAuthErr := getPasswordAuth(conf.Auth.PasswordAuth)
+		if pAuthErr != nil {
+			return conf, pAuthErr
+		}
+		conf.Auth.Username = pAuth.Username
+		conf.Auth.Password = pAuth.Password
+	}
+
+	if len(conf.Endpoints) == 0 {
+		return conf, errors.New("No etcd endpoint specified in the configuration")
+	}
+
+	if int64(conf.ConnectionTimeout) == 0 {
+		conf.ConnectionTimeout = 2 * time.Minute
+	}
+
+	if int64(conf.RequestTimeout) == 0 {
+		conf.RequestTimeout = 2 * time.Minute
+	}
+
+	return conf, nil
+}
+
 func getConfig() (Config, error) {
 	var c Config
 
@@ -101,25 +316,52 @@ func getConfig() (Config, error) {
 		return c, errors.New(fmt.Sprintf("Error parsing the configuration file: %s", err.Error()))
 	}
 
-	if c.EtcdClient.Auth.PasswordAuth != "" {
-		pAuth, pAuthErr := getPasswordAuth(c.EtcdClient.Auth.PasswordAuth)
-		if pAuthErr != nil {
-			return c, pAuthErr
+	c.EtcdClient, err = getEtcdClientConfig(c.EtcdClient)
+	if err != nil {
+		return c, err
+	}
+
+	clusterNames := map[string]bool{defaultClusterName: true}
+	for idx, cluster := range c.EtcdClusters {
+		if cluster.Name == "" || len(cluster.Prefixes) == 0 {
+			return c, errors.New("Etcd clusters need to have a name and at least one prefix")
+		}
+		if clusterNames[cluster.Name] {
+			return c, errors.New(fmt.Sprintf("Etcd cluster name %s is not unique or is reserved", cluster.Name))
 		}
-		c.EtcdClient.Auth.Username = pAuth.Username
-		c.EtcdClient.Auth.Password = pAuth.Password
+		clusterNames[cluster.Name] = true
+
+		c.EtcdClusters[idx].EtcdClient, err = getEtcdClientConfig(cluster.EtcdClient)
+		if err != nil {
+			return c, errors.New(fmt.Sprintf("Error in the configuration of etcd cluster %s: %s", cluster.Name, err.Error()))
+		}
+	}
+
+	if c.Keys.Namespace != "" && (!strings.HasPrefix(c.Keys.Namespace, "/") || validateKeySegments(c.Keys.Namespace, true) != nil) {
+		return c, errors.New("The keys namespace needs to be an absolute etcd prefix without empty, '.' or '..' segments")
 	}
 
-	if len(c.EtcdClient.Endpoints) == 0 {
-		return c, errors.New("No etcd endpoint specified in the configuration")
+	if c.Keys.LockSuffix == "" {
+		c.Keys.LockSuffix = "/lock"
 	}
 
-	if int64(c.EtcdClient.ConnectionTimeout) == 0 {
-		c.EtcdClient.ConnectionTimeout = 2 * time.Minute
+	if c.Keys.StateSuffix == "" {
+		c.Keys.StateSuffix = "/state"
 	}
 
-	if int64(c.EtcdClient.RequestTimeout) == 0 {
-		c.EtcdClient.RequestTimeout = 2 * time.Minute
+	if c.Keys.LockInfoSuffix == "" {
+		c.Keys.LockInfoSuffix = "/lock-info"
+	}
+
+	suffixes := map[string]bool{"/lock-queue": true}
+	for _, suffix := range []string{c.Keys.LockSuffix, c.Keys.StateSuffix, c.Keys.LockInfoSuffix} {
+		if !strings.HasPrefix(suffix, "/") || strings.Count(suffix, "/") != 1 || len(suffix) == 1 || suffix == "/." || suffix == "/.." {
+			return c, errors.New(fmt.Sprintf("Key suffix %s needs to be a single segment starting with a slash", suffix))
+		}
+		if suffixes[suffix] || suffix == "/info" || strings.HasPrefix(suffix, "/chunks") {
+			return c, errors.New(fmt.Sprintf("Key suffix %s is used more than once or is reserved", suffix))
+		}
+		suffixes[suffix] = true
 	}
 
 	if int64(c.Lock.Timeout) == 0 {
@@ -130,6 +372,165 @@ func getConfig() (Config, error) {
 		c.Lock.RetryInterval = 500 * time.Millisecond
 	}
 
+	policyPrefixes := map[string]bool{}
+	for idx, policy := range c.Lock.Policies {
+		if policyPrefixes[policy.Prefix] {
+			return c, errors.New(fmt.Sprintf("Lock policy prefix %s is not unique", policy.Prefix))
+		}
+		policyPrefixes[policy.Prefix] = true
+
+		if int64(policy.DefaultTtl) == 0 {
+			c.Lock.Policies[idx].DefaultTtl = 600 * time.Second
+			policy.DefaultTtl = c.Lock.Policies[idx].DefaultTtl
+		}
+
+		if policy.DefaultTtl < time.Second || policy.MinTtl < 0 || policy.MaxTtl < 0 {
+			return c, errors.New(fmt.Sprintf("Ttls of lock policy %s cannot be negative or shorter than a second", policy.Prefix))
+		}
+		if policy.DefaultTtl < policy.MinTtl || (int64(policy.MaxTtl) > 0 && (policy.DefaultTtl > policy.MaxTtl || policy.MinTtl > policy.MaxTtl)) {
+			return c, errors.New(fmt.Sprintf("Default ttl of lock policy %s needs to be within its minimum and maximum ttls", policy.Prefix))
+		}
+		if int64(c.Lock.MaxTtl) > 0 && (policy.DefaultTtl > c.Lock.MaxTtl || policy.MinTtl > c.Lock.MaxTtl) {
+			return c, errors.New(fmt.Sprintf("Default and minimum ttls of lock policy %s cannot exceed the maximum ttl of the lock configuration", policy.Prefix))
+		}
+	}
+
+	webhookNames := map[string]bool{}
+	for idx, webhook := range c.Webhooks.Endpoints {
+		if webhook.Name == "" || webhook.Url == "" {
+			return c, errors.New("Webhooks need to have a name and an url")
+		}
+		if webhookNames[webhook.Name] {
+			return c, errors.New(fmt.Sprintf("Webhook name %s is not unique", webhook.Name))
+		}
+		webhookNames[webhook.Name] = true
+
+		if webhook.SecretFile != "" {
+			secret, secretErr := getWebhookSecret(webhook.SecretFile)
+			if secretErr != nil {
+				return c, secretErr
+			}
+			c.Webhooks.Endpoints[idx].Secret = secret
+		}
+	}
+
+	if c.Webhooks.OutboxPrefix == "" {
+		c.Webhooks.OutboxPrefix = "/terraform-backend-etcd/webhooks"
+	}
+
+	if int64(c.Webhooks.PollInterval) == 0 {
+		c.Webhooks.PollInterval = 5 * time.Second
+	}
+
+	if int64(c.Webhooks.RequestTimeout) == 0 {
+		c.Webhooks.RequestTimeout = 10 * time.Second
+	}
+
+	if c.Webhooks.Retries == 0 {
+		c.Webhooks.Retries = 10
+	}
+
+	if int64(c.Webhooks.RetryInterval) == 0 {
+		c.Webhooks.RetryInterval = 5 * time.Second
+	}
+
+	if int64(c.Webhooks.MaxRetryInterval) == 0 {
+		c.Webhooks.MaxRetryInterval = 10 * time.Minute
+	}
+
+	if int64(c.Backups.Interval) > 0 && c.Backups.Schedule != "" {
+		return c, errors.New("Scheduled backups can have either an interval or a schedule, not both")
+	}
+
+	if c.Backups.Schedule != "" {
+		_, scheduleErr := parseCronSchedule(c.Backups.Schedule)
+		if scheduleErr != nil {
+			return c, scheduleErr
+		}
+	}
+
+	if int64(c.Backups.Interval) > 0 || c.Backups.Schedule != "" {
+		if c.Backups.Directory == "" && c.Backups.S3.Endpoint == "" {
+			return c, errors.New("Scheduled backups need either a directory or an s3 endpoint")
+		}
+
+		if c.Backups.S3.Endpoint != "" && c.Backups.S3.Bucket == "" {
+			return c, errors.New("Scheduled backups to s3 need a bucket")
+		}
+	}
+
+	if c.Backups.S3.CredentialsFile != "" {
+		s3Creds, s3CredsErr := getS3Credentials(c.Backups.S3.CredentialsFile)
+		if s3CredsErr != nil {
+			return c, s3CredsErr
+		}
+		c.Backups.S3.AccessKey = s3Creds.AccessKey
+		c.Backups.S3.SecretKey = s3Creds.SecretKey
+	}
+
+	if int64(c.Backups.S3.RequestTimeout) == 0 {
+		c.Backups.S3.RequestTimeout = time.Minute
+	}
+
+	if c.Backups.LockKey == "" {
+		c.Backups.LockKey = "/terraform-backend-etcd/backups/lock"
+	}
+
+	if int64(c.Gc.Grace) == 0 {
+		c.Gc.Grace = time.Hour
+	}
+
+	if int64(c.Gc.LockMaxAge) == 0 {
+		c.Gc.LockMaxAge = 24 * time.Hour
+	}
+
+	if c.Gc.LockKey == "" {
+		c.Gc.LockKey = "/terraform-backend-etcd/gc/lock"
+	}
+
+	if c.Gc.Prefix == "" && c.Keys.Namespace != "" {
+		c.Gc.Prefix = strings.TrimSuffix(c.Keys.Namespace, "/") + "/"
+	}
+
+	if len(c.Replication.Secondary.Endpoints) > 0 {
+		c.Replication.Secondary, err = getEtcdClientConfig(c.Replication.Secondary)
+		if err != nil {
+			return c, errors.New(fmt.Sprintf("Error in the configuration of the secondary etcd cluster: %s", err.Error()))
+		}
+	}
+
+	if c.Replication.CheckpointKey == "" {
+		c.Replication.CheckpointKey = "/terraform-backend-etcd/replication/checkpoint"
+	}
+
+	if c.Replication.LockKey == "" {
+		c.Replication.LockKey = "/terraform-backend-etcd/replication/lock"
+	}
+
+	if int64(c.Replication.ProgressInterval) == 0 {
+		c.Replication.ProgressInterval = 5 * time.Second
+	}
+
+	if int64(c.Replication.RetryInterval) == 0 {
+		c.Replication.RetryInterval = 10 * time.Second
+	}
+
+	if c.Tokens.Prefix == "" {
+		c.Tokens.Prefix = "/terraform-backend-etcd/tokens"
+	}
+
+	if c.Maintenance.Message == "" {
+		c.Maintenance.Message = "The backend is in maintenance mode"
+	}
+
+	if int64(c.Maintenance.RetryAfter) == 0 {
+		c.Maintenance.RetryAfter = time.Minute
+	}
+
+	if c.Maintenance.Key == "" {
+		c.Maintenance.Key = "/terraform-backend-etcd/maintenance"
+	}
+
 	if c.Server.Port == 0 {
 		c.Server.Port = 14443
 	}
@@ -138,6 +539,49 @@ func getConfig() (Config, error) {
 		c.Server.Address = "0.0.0.0"
 	}
 
+	if int64(c.Server.WatchKeepAlive) == 0 {
+		c.Server.WatchKeepAlive = 15 * time.Second
+	}
+
+	for _, rate := range []*ConfigRate{&c.Server.RateLimits.PerIp, &c.Server.RateLimits.PerUser} {
+		if rate.Rate < 0 || rate.Burst < 0 {
+			return c, errors.New("Rate limits cannot be negative")
+		}
+		if rate.Burst == 0 {
+			rate.Burst = int64(math.Max(1, math.Ceil(rate.Rate)))
+		}
+	}
+
+	if int64(c.Server.Shutdown.DrainTimeout) == 0 {
+		c.Server.Shutdown.DrainTimeout = defaultDrainTimeout
+	}
+
+	if int64(c.Server.RateLimits.UploadRetryAfter) == 0 {
+		c.Server.RateLimits.UploadRetryAfter = 5 * time.Second
+	}
+
+	if c.Server.Jwt.JwksFile != "" && c.Server.Jwt.JwksUrl != "" {
+		return c, errors.New("The jwks can be read from a file or an url, but not both")
+	}
+
+	if int64(c.Server.Jwt.JwksRefreshInterval) == 0 {
+		c.Server.Jwt.JwksRefreshInterval = time.Hour
+	}
+
+	for _, permission := range c.Server.Jwt.Permissions {
+		if permission.Claim == "" || len(permission.Values) == 0 {
+			return c, errors.New("Jwt permissions need to have a claim and at least one value")
+		}
+		permissionErr := validatePermission(permission.Permission)
+		if permissionErr != nil {
+			return c, permissionErr
+		}
+	}
+
+	if c.Server.Upload.MaxBufferedSize == 0 {
+		c.Server.Upload.MaxBufferedSize = 100 * 1024 * 1024
+	}
+
 	return c, nil
 }
 
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 6},
+}
+
+/*
+Schedule in the cron format of 5 space separated fields: minute, hour, day of month, month and day of week (0 being
+sunday), evaluated in UTC. Each field can be *, a value, a range (1-5), a list (1,15) or a step over * or a range
+(0-30/10 for every 10 minutes of the first half hour).
+As in cron, a time matches if either the day of month or the day of week match when both are restricted.
+*/
+type CronSchedule struct {
+	minutes          map[int]bool
+	hours            map[int]bool
+	days             map[int]bool
+	months           map[int]bool
+	weekdays         map[int]bool
+	restrictDays     bool
+	restrictWeekdays bool
+}
+
+func parseCronField(expr string, field cronField) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var stepErr error
+			step, stepErr = strconv.Atoi(stepExpr)
+			if stepErr != nil || step <= 0 {
+				return nil, errors.New(fmt.Sprintf("Step %s of the %s field needs to be a positive integer", stepExpr, field.name))
+			}
+		}
+
+		start, end := field.min, field.max
+		if rangeExpr != "*" {
+			startExpr, endExpr, isRange := strings.Cut(rangeExpr, "-")
+			var startErr, endErr error
+			start, startErr = strconv.Atoi(startExpr)
+			end = start
+			if isRange {
+				end, endErr = strconv.Atoi(endExpr)
+			} else if hasStep {
+				end = field.max
+			}
+			if startErr != nil || endErr != nil || start < field.min || end > field.max || start > end {
+				return nil, errors.New(fmt.Sprintf("Value %s of the %s field needs to be * or between %d and %d", rangeExpr, field.name, field.min, field.max))
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+func parseCronSchedule(expr string) (*CronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, errors.New(fmt.Sprintf("Schedule %s needs to have 5 fields: minute, hour, day of month, month and day of week", expr))
+	}
+
+	fields := []map[int]bool{}
+	for idx, part := range parts {
+		values, parseErr := parseCronField(part, cronFields[idx])
+		if parseErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing schedule %s: %s", expr, parseErr.Error()))
+		}
+		fields = append(fields, values)
+	}
+
+	schedule := &CronSchedule{
+		minutes:          fields[0],
+		hours:            fields[1],
+		days:             fields[2],
+		months:           fields[3],
+		weekdays:         fields[4],
+		restrictDays:     !strings.HasPrefix(parts[2], "*"),
+		restrictWeekdays: !strings.HasPrefix(parts[4], "*"),
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, errors.New(fmt.Sprintf("Schedule %s never matches", expr))
+	}
+
+	return schedule, nil
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dayOk := s.days[t.Day()]
+	weekdayOk := s.weekdays[int(t.Weekday())]
+	if s.restrictDays && s.restrictWeekdays {
+		return dayOk || weekdayOk
+	}
+
+	return dayOk && weekdayOk
+}
+
+/*
+Returns the first time matching the schedule strictly after the given time
+*/
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	//A matching time exists within a few years for any valid schedule, except days that don't exist like the 31st of february
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
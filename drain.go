@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Tracks the draining of this instance of the backend on shutdown.
+Once draining, the instance reports itself as not ready and closes watch streams, while uploads in progress
+can finish until they are aborted.
+*/
+type Drainer struct {
+	draining     chan struct{}
+	drainOnce    sync.Once
+	uploadsCtx   context.Context
+	abortUploads context.CancelFunc
+	uploads      int64
+}
+
+func NewDrainer() *Drainer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Drainer{
+		draining:     make(chan struct{}),
+		uploadsCtx:   ctx,
+		abortUploads: cancel,
+	}
+}
+
+func (d *Drainer) StartDrain() {
+	d.drainOnce.Do(func() {
+		close(d.draining)
+	})
+}
+
+/*
+Returns a channel that is closed when the instance starts draining
+*/
+func (d *Drainer) Draining() <-chan struct{} {
+	return d.draining
+}
+
+func (d *Drainer) IsDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Returns the context of uploads, which is cancelled when uploads in progress are aborted
+*/
+func (d *Drainer) UploadContext() context.Context {
+	return d.uploadsCtx
+}
+
+func (d *Drainer) Uploads() int64 {
+	return atomic.LoadInt64(&d.uploads)
+}
+
+/*
+Wraps a handler uploading states so that the uploads in progress are counted
+*/
+func (d *Drainer) TrackUpload(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		atomic.AddInt64(&d.uploads, 1)
+		defer atomic.AddInt64(&d.uploads, -1)
+
+		handler(c)
+	}
+}
+
+/*
+Aborts the uploads in progress and waits for up to the timeout for their handlers to return.
+Returns whether all uploads returned.
+*/
+func (d *Drainer) AbortUploads(timeout time.Duration) bool {
+	d.abortUploads()
+
+	deadline := time.Now().Add(timeout)
+	for d.Uploads() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return true
+}
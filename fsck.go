@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+)
+
+/*
+Size of the chunks written by the etcd sdk
+*/
+const stateChunkSize = 1024 * 1024
+
+type FsckStateReport struct {
+	State            string   `json:"state"`
+	Version          int64    `json:"version"`
+	Size             int64    `json:"size"`
+	Count            int64    `json:"count"`
+	Consistent       bool     `json:"consistent"`
+	Errors           []string `json:"errors"`
+	OrphanedVersions []int64  `json:"orphaned_versions"`
+	Repaired         bool     `json:"repaired"`
+	RepairedFrom     string   `json:"repaired_from,omitempty"`
+}
+
+type FsckReport struct {
+	States       []FsckStateReport `json:"states"`
+	Inconsistent int               `json:"inconsistent"`
+	Repaired     int               `json:"repaired"`
+}
+
+type FsckOptions struct {
+	Repair bool
+	//Store of the scheduled backups to roll back to when no orphaned version of a state is consistent. Can be nil
+	Backups BackupStore
+}
+
+type fsckRepairCandidate struct {
+	version int64
+	backup  string
+}
+
+/*
+Returns the indexes of the chunks of each version of a state that are present in etcd
+*/
+func getStateChunkIndexes(cli *client.EtcdClient, state string) (map[int64][]int64, error) {
+	keys, keysErr := listKeys(cli, fmt.Sprintf("%s/chunks/", getStateKey(state)))
+	if keysErr != nil {
+		return nil, keysErr
+	}
+
+	versions := map[int64][]int64{}
+	for _, key := range keys {
+		chunkState, version, idx, isChunk := parseStateChunkKey(key)
+		if !isChunk || chunkState != state {
+			continue
+		}
+
+		versions[version] = append(versions[version], idx)
+	}
+
+	for version := range versions {
+		sort.Slice(versions[version], func(i, j int) bool { return versions[version][i] < versions[version][j] })
+	}
+
+	return versions, nil
+}
+
+/*
+Reassembles the chunks of a version of a state, checking them against the expected count and size.
+A count or size lower than 0 is inferred from the chunks that are present.
+The content is returned along with the inconsistencies that were found.
+*/
+func checkStateChunks(cli *client.EtcdClient, state string, version int64, indexes []int64, count int64, size int64) ([]byte, []string, error) {
+	problems := []string{}
+
+	present := map[int64]bool{}
+	for _, idx := range indexes {
+		present[idx] = true
+		if count >= 0 && idx >= count {
+			problems = append(problems, fmt.Sprintf("Extra chunk %d", idx))
+		}
+	}
+	if count < 0 {
+		count = int64(len(indexes))
+	}
+
+	var buf bytes.Buffer
+	for idx := int64(0); idx < count; idx++ {
+		if !present[idx] {
+			problems = append(problems, fmt.Sprintf("Missing chunk %d", idx))
+			continue
+		}
+
+		chunk, chunkErr := cli.GetKey(fmt.Sprintf("%s%d", getStateChunkPrefix(state, version), idx), client.GetKeyOptions{})
+		if chunkErr != nil {
+			return nil, problems, chunkErr
+		}
+		if !chunk.Found() {
+			problems = append(problems, fmt.Sprintf("Missing chunk %d", idx))
+			continue
+		}
+
+		if idx < count-1 && len(chunk.Value) != stateChunkSize {
+			problems = append(problems, fmt.Sprintf("Chunk %d has a size of %d bytes instead of %d", idx, len(chunk.Value), stateChunkSize))
+		}
+		buf.WriteString(chunk.Value)
+	}
+
+	if size >= 0 && int64(buf.Len()) != size {
+		problems = append(problems, fmt.Sprintf("Chunks have a total size of %d bytes instead of %d", buf.Len(), size))
+	}
+
+	if len(problems) == 0 && !isTerraformState(buf.Bytes()) {
+		problems = append(problems, "Reassembled content is not a valid terraform state")
+	}
+
+	return buf.Bytes(), problems, nil
+}
+
+/*
+Returns the versions an inconsistent state can be rolled back to, from the most recent to the oldest.
+These are the orphaned versions older than the current one, whose chunks are left until they are garbage collected,
+and the versions exported by the scheduled backups. At equal versions, the chunks in etcd are tried first.
+*/
+func getFsckRepairCandidates(report *FsckStateReport, opts FsckOptions) ([]fsckRepairCandidate, error) {
+	candidates := []fsckRepairCandidate{}
+	for _, version := range report.OrphanedVersions {
+		if version < report.Version {
+			candidates = append(candidates, fsckRepairCandidate{version: version})
+		}
+	}
+
+	if opts.Backups != nil {
+		names, listErr := opts.Backups.List(getBackupStatePrefix(report.State))
+		if listErr != nil {
+			return nil, listErr
+		}
+		sort.Strings(names)
+		for idx := len(names) - 1; idx >= 0; idx-- {
+			candidates = append(candidates, fsckRepairCandidate{version: getBackupVersion(names[idx]), backup: names[idx]})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].version != candidates[j].version {
+			return candidates[i].version > candidates[j].version
+		}
+		return candidates[i].backup == "" && candidates[j].backup != ""
+	})
+
+	return candidates, nil
+}
+
+/*
+Replaces an inconsistent state with the most recent version of it that is consistent, taken from its orphaned
+versions or its backups. The content of that version is written as a new version so that versions keep increasing.
+*/
+func repairState(cli *client.EtcdClient, report *FsckStateReport, versions map[int64][]int64, opts FsckOptions) error {
+	candidates, candidatesErr := getFsckRepairCandidates(report, opts)
+	if candidatesErr != nil {
+		return candidatesErr
+	}
+
+	for _, candidate := range candidates {
+		var content []byte
+		if candidate.backup == "" {
+			chunksContent, problems, checkErr := checkStateChunks(cli, report.State, candidate.version, versions[candidate.version], -1, -1)
+			if checkErr != nil {
+				return checkErr
+			}
+			if len(problems) > 0 {
+				continue
+			}
+			content = chunksContent
+		} else {
+			backupContent, getErr := opts.Backups.Get(candidate.backup)
+			if getErr != nil {
+				return getErr
+			}
+			if !isTerraformState(backupContent) {
+				continue
+			}
+			content = backupContent
+		}
+
+		restored, restoreErr := restoreState(cli, report.State, content, RestoreOptions{Overwrite: true})
+		if restoreErr != nil {
+			return restoreErr
+		}
+		if !restored {
+			return errors.New("State is locked")
+		}
+
+		report.Repaired = true
+		if candidate.backup == "" {
+			report.RepairedFrom = fmt.Sprintf("version %d", candidate.version)
+			return cli.DeletePrefix(getStateChunkPrefix(report.State, candidate.version))
+		}
+		report.RepairedFrom = fmt.Sprintf("backup %s", candidate.backup)
+		return nil
+	}
+
+	return errors.New("No consistent orphaned version or backup was found to roll back to")
+}
+
+func checkState(cli *client.EtcdClient, state string, opts FsckOptions) (FsckStateReport, error) {
+	report := FsckStateReport{
+		State:            state,
+		Errors:           []string{},
+		OrphanedVersions: []int64{},
+	}
+
+	info, _, infoErr := getStateInfo(cli, state)
+	if infoErr != nil {
+		return report, infoErr
+	}
+	//State deleted since it was listed
+	if info == nil {
+		report.Consistent = true
+		return report, nil
+	}
+	report.Version = info.Version
+	report.Size = info.Size
+	report.Count = info.Count
+
+	versions, versionsErr := getStateChunkIndexes(cli, state)
+	if versionsErr != nil {
+		return report, versionsErr
+	}
+	for version := range versions {
+		if version != info.Version {
+			report.OrphanedVersions = append(report.OrphanedVersions, version)
+		}
+	}
+	sort.Slice(report.OrphanedVersions, func(i, j int) bool { return report.OrphanedVersions[i] < report.OrphanedVersions[j] })
+
+	_, problems, checkErr := checkStateChunks(cli, state, info.Version, versions[info.Version], info.Count, info.Size)
+	if checkErr != nil {
+		return report, checkErr
+	}
+	report.Errors = problems
+	report.Consistent = len(problems) == 0
+
+	if opts.Repair && !report.Consistent {
+		repairErr := repairState(cli, &report, versions, opts)
+		if repairErr != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Could not repair: %s", repairErr.Error()))
+		}
+	}
+
+	return report, nil
+}
+
+/*
+Verifies the chunks of all the states under a prefix against their metadata and checks that they reassemble
+into a valid terraform state. If requested, inconsistent states are rolled back to their last consistent version.
+*/
+func checkStates(cli *client.EtcdClient, prefix string, opts FsckOptions) (FsckReport, error) {
+	report := FsckReport{States: []FsckStateReport{}}
+
+	states, statesErr := listStates(cli, prefix)
+	if statesErr != nil {
+		return report, statesErr
+	}
+
+	for _, state := range states {
+		stateReport, checkErr := checkState(cli, state, opts)
+		if checkErr != nil {
+			return report, errors.New(fmt.Sprintf("Error checking state %s: %s", state, checkErr.Error()))
+		}
+
+		if !stateReport.Consistent {
+			report.Inconsistent += 1
+		}
+		if stateReport.Repaired {
+			report.Repaired += 1
+		}
+		report.States = append(report.States, stateReport)
+	}
+
+	return report, nil
+}
+
+/*
+Checks the states under a prefix in all the clusters they can be routed to
+*/
+func checkClusterStates(clusters *ClusterSet, prefix string, opts FsckOptions) (FsckReport, error) {
+	report := FsckReport{States: []FsckStateReport{}}
+	for _, cluster := range clusters.GetOverlapping(prefix) {
+		clusterReport, checkErr := checkStates(cluster.Client, prefix, opts)
+		if checkErr != nil {
+			return report, errors.New(fmt.Sprintf("Error checking the states of etcd cluster %s: %s", cluster.Name, checkErr.Error()))
+		}
+
+		for _, stateReport := range clusterReport.States {
+			if !clusters.Routes(stateReport.State, cluster) {
+				continue
+			}
+
+			if !stateReport.Consistent {
+				report.Inconsistent += 1
+			}
+			if stateReport.Repaired {
+				report.Repaired += 1
+			}
+			report.States = append(report.States, stateReport)
+		}
+	}
+	sort.Slice(report.States, func(i, j int) bool { return report.States[i].State < report.States[j].State })
+
+	return report, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type GcOptions struct {
+	Prefix string
+	//Only chunks that were not modified after this etcd revision are collected, to leave in-flight writes alone
+	SafeRevision int64
+	LockMaxAge   time.Duration
+	DryRun       bool
+}
+
+type GcChunkVersion struct {
+	State   string `json:"state"`
+	Version int64  `json:"version"`
+	Chunks  int    `json:"chunks"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type GcReport struct {
+	ChunkVersions  []GcChunkVersion `json:"chunk_versions"`
+	Locks          []string         `json:"locks"`
+	ReclaimedBytes int64            `json:"reclaimed_bytes"`
+}
+
+type gcChunkKeys struct {
+	keys           []string
+	maxModRevision int64
+}
+
+type gcState struct {
+	infoRevision int64
+	version      int64
+	lock         bool
+	chunks       map[int64]*gcChunkKeys
+}
+
+/*
+Returns the current revision of the etcd cluster
+*/
+func getEtcdRevision(cli *client.EtcdClient) (int64, error) {
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	res, err := cli.Client.Get(ctx, "\x00", clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Header.Revision, nil
+}
+
+func scanGcStates(cli *client.EtcdClient, prefix string) (map[string]*gcState, error) {
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	res, err := cli.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]*gcState{}
+	getGcState := func(state string) *gcState {
+		if _, ok := states[state]; !ok {
+			states[state] = &gcState{chunks: map[int64]*gcChunkKeys{}}
+		}
+		return states[state]
+	}
+
+	for _, kv := range res.Kvs {
+		key := string(kv.Key)
+		if isInternalKey(key) {
+			continue
+		}
+
+		if state, isInfo := getStateInfoState(key); isInfo {
+			getGcState(state).infoRevision = kv.ModRevision
+			continue
+		}
+
+		if state, isLock := getLockState(key); isLock {
+			getGcState(state).lock = true
+			continue
+		}
+
+		if state, version, _, isChunk := parseStateChunkKey(key); isChunk {
+			chunks := getGcState(state).chunks
+			if _, ok := chunks[version]; !ok {
+				chunks[version] = &gcChunkKeys{keys: []string{}}
+			}
+			chunks[version].keys = append(chunks[version].keys, key)
+			if kv.ModRevision > chunks[version].maxModRevision {
+				chunks[version].maxModRevision = kv.ModRevision
+			}
+		}
+	}
+
+	return states, nil
+}
+
+/*
+Removes the lock of a state that doesn't exist if it is older than the maximum age.
+The lease of the lock is revoked, which also removes the lock information stored with it.
+Keys with the lock suffix whose value is not a lock of the backend, as other software sharing the etcd cluster
+may write, are left alone.
+*/
+func collectAbandonedLock(cli *client.EtcdClient, state string, opts GcOptions) (bool, error) {
+	lock, lockErr := readLock(cli, state)
+	if lockErr == ErrLockNotFound || lockErr == ErrInvalidLock || (lockErr == nil && lock.Lease == 0) {
+		return false, nil
+	}
+	if lockErr != nil {
+		return false, lockErr
+	}
+
+	if time.Since(lock.Timestamp) < opts.LockMaxAge {
+		return false, nil
+	}
+
+	info, _, infoErr := getStateInfo(cli, state)
+	if infoErr != nil || info != nil {
+		return false, infoErr
+	}
+
+	if opts.DryRun {
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	_, revokeErr := cli.Client.Revoke(ctx, lock.Lease)
+	if revokeErr != nil && revokeErr != rpctypes.ErrLeaseNotFound {
+		return false, revokeErr
+	}
+
+	return true, nil
+}
+
+/*
+Deletes the chunks of a version that is not referenced by the metadata of its state.
+The deletion is done in a transaction that fails if the state's metadata changed, the state got locked or
+the chunks were modified since they were scanned, in which case the chunks are left alone.
+*/
+func collectChunkVersion(cli *client.EtcdClient, state string, infoRevision int64, version int64, chunks *gcChunkKeys, opts GcOptions) (int64, bool, error) {
+	var size int64
+	for _, key := range chunks.keys {
+		chunk, chunkErr := cli.GetKey(key, client.GetKeyOptions{})
+		if chunkErr != nil {
+			return 0, false, chunkErr
+		}
+		size += int64(len(chunk.Value))
+	}
+
+	if opts.DryRun {
+		return size, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	chunksPrefix := getStateChunkPrefix(state, version)
+	res, txErr := cli.Client.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(getStateInfoKey(state)), "=", infoRevision),
+		clientv3.Compare(clientv3.CreateRevision(getLockKey(state)), "=", 0),
+		clientv3.Compare(clientv3.ModRevision(chunksPrefix), "<", chunks.maxModRevision+1).WithPrefix(),
+	).Then(
+		clientv3.OpDelete(chunksPrefix, clientv3.WithPrefix()),
+	).Commit()
+	if txErr != nil {
+		return 0, false, txErr
+	}
+
+	return size, res.Succeeded, nil
+}
+
+/*
+Removes the chunk versions under a prefix that are not referenced by the metadata of their state,
+which are left behind by failed writes and deleted states, as well as the abandoned locks of states that don't exist.
+*/
+func collectGarbage(cli *client.EtcdClient, opts GcOptions) (GcReport, error) {
+	report := GcReport{
+		ChunkVersions: []GcChunkVersion{},
+		Locks:         []string{},
+	}
+
+	states, scanErr := scanGcStates(cli, opts.Prefix)
+	if scanErr != nil {
+		return report, scanErr
+	}
+
+	names := []string{}
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		state := states[name]
+
+		if state.lock && state.infoRevision == 0 && int64(opts.LockMaxAge) > 0 {
+			removed, lockErr := collectAbandonedLock(cli, name, opts)
+			if lockErr != nil {
+				return report, errors.New(fmt.Sprintf("Error removing the abandoned lock of state %s: %s", name, lockErr.Error()))
+			}
+			if !removed {
+				continue
+			}
+			report.Locks = append(report.Locks, name)
+			state.lock = false
+		}
+
+		//Locked states may have a write in progress
+		if state.lock || len(state.chunks) == 0 {
+			continue
+		}
+
+		if state.infoRevision != 0 {
+			info, infoRevision, infoErr := getStateInfo(cli, name)
+			if infoErr != nil {
+				return report, infoErr
+			}
+			if info == nil || infoRevision != state.infoRevision {
+				continue
+			}
+			state.version = info.Version
+		}
+
+		versions := []int64{}
+		for version := range state.chunks {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+		for _, version := range versions {
+			chunks := state.chunks[version]
+			if version == state.version || chunks.maxModRevision > opts.SafeRevision {
+				continue
+			}
+
+			size, collected, collectErr := collectChunkVersion(cli, name, state.infoRevision, version, chunks, opts)
+			if collectErr != nil {
+				return report, errors.New(fmt.Sprintf("Error removing version %d of state %s: %s", version, name, collectErr.Error()))
+			}
+			if !collected {
+				continue
+			}
+
+			report.ChunkVersions = append(report.ChunkVersions, GcChunkVersion{
+				State:   name,
+				Version: version,
+				Chunks:  len(chunks.keys),
+				Bytes:   size,
+			})
+			report.ReclaimedBytes += size
+		}
+	}
+
+	return report, nil
+}
+
+type gcRevisionSample struct {
+	time     time.Time
+	revision int64
+}
+
+/*
+Periodically collects garbage in the background.
+The revision of the cluster is sampled on each run so that only chunks older than the grace period are collected.
+*/
+type GarbageCollector struct {
+	config      Config
+	cli         *client.EtcdClient
+	maintenance *Maintenance
+	samples     []gcRevisionSample
+}
+
+func NewGarbageCollector(config Config, cli *client.EtcdClient, maintenance *Maintenance) *GarbageCollector {
+	if int64(config.Gc.Interval) == 0 {
+		return nil
+	}
+
+	return &GarbageCollector{
+		config:      config,
+		cli:         cli,
+		maintenance: maintenance,
+		samples:     []gcRevisionSample{},
+	}
+}
+
+/*
+Returns the most recent sampled revision that is older than the grace period, or 0 if there is none yet
+*/
+func (g *GarbageCollector) getSafeRevision() int64 {
+	safeRevision := int64(0)
+	for len(g.samples) > 0 && time.Since(g.samples[0].time) >= g.config.Gc.Grace {
+		safeRevision = g.samples[0].revision
+		g.samples = g.samples[1:]
+	}
+
+	//Keep the safe revision for the next run in case no new sample is old enough by then
+	if safeRevision != 0 {
+		g.samples = append([]gcRevisionSample{{time: time.Now().Add(-g.config.Gc.Grace), revision: safeRevision}}, g.samples...)
+	}
+
+	return safeRevision
+}
+
+func (g *GarbageCollector) runOnce() error {
+	revision, revisionErr := getEtcdRevision(g.cli)
+	if revisionErr != nil {
+		return revisionErr
+	}
+	g.samples = append(g.samples, gcRevisionSample{time: time.Now(), revision: revision})
+
+	safeRevision := g.getSafeRevision()
+	if safeRevision == 0 {
+		return nil
+	}
+
+	report, gcErr := collectGarbage(g.cli, GcOptions{
+		Prefix:       g.config.Gc.Prefix,
+		SafeRevision: safeRevision,
+		LockMaxAge:   g.config.Gc.LockMaxAge,
+	})
+	gcReclaimedBytesMetric.Add(float64(report.ReclaimedBytes))
+	gcRemovedLocksMetric.Add(float64(len(report.Locks)))
+	if gcErr != nil {
+		return gcErr
+	}
+
+	if len(report.ChunkVersions) > 0 || len(report.Locks) > 0 {
+		fmt.Printf("Garbage collection removed %d chunk versions (%d bytes) and %d abandoned locks\n", len(report.ChunkVersions), report.ReclaimedBytes, len(report.Locks))
+	}
+	return nil
+}
+
+/*
+Runs the garbage collection until the context is cancelled, skipping the runs that happen in maintenance mode.
+Like scheduled backups, a lock in etcd ensures that a single instance of the backend collects garbage at a time.
+*/
+func (g *GarbageCollector) Run(ctx context.Context) {
+	if g == nil {
+		return
+	}
+
+	ticker := time.NewTicker(g.config.Gc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if g.maintenance.Enabled() {
+				continue
+			}
+
+			_, alreadyLocked, lockErr := g.cli.AcquireLock(client.AcquireLockOptions{
+				Key:     g.config.Gc.LockKey,
+				Ttl:     int64(g.config.Gc.Interval/time.Second) + 60,
+				Timeout: time.Second,
+			})
+			if alreadyLocked {
+				continue
+			}
+			if lockErr != nil {
+				fmt.Printf("Could not acquire garbage collection lock: %s\n", lockErr.Error())
+				gcRunsMetric.WithLabelValues("failure").Inc()
+				continue
+			}
+
+			runErr := g.runOnce()
+			if runErr != nil {
+				fmt.Printf("Garbage collection failed: %s\n", runErr.Error())
+				gcRunsMetric.WithLabelValues("failure").Inc()
+			} else {
+				gcRunsMetric.WithLabelValues("success").Inc()
+			}
+
+			releaseErr := g.cli.ReleaseLock(g.config.Gc.LockKey)
+			if releaseErr != nil {
+				fmt.Printf("Could not release garbage collection lock: %s\n", releaseErr.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Tolerated difference between the clocks of the token issuer and the backend when checking the validity of a jwt
+*/
+const jwtClockSkew = time.Minute
+
+/*
+Minimum interval between two reloads of the keys triggered by tokens signed with an unknown key
+*/
+const jwksMinReloadInterval = time.Minute
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwtKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+func decodeJwtSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func decodeJwkInt(value string) (*big.Int, error) {
+	b, err := decodeJwtSegment(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("Invalid integer in key")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseJwk(key jwk) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, nErr := decodeJwkInt(key.N)
+		if nErr != nil {
+			return nil, nErr
+		}
+		e, eErr := decodeJwkInt(key.E)
+		if eErr != nil || !e.IsInt64() {
+			return nil, errors.New("Invalid exponent in key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported curve %s", key.Crv))
+		}
+		x, xErr := decodeJwkInt(key.X)
+		if xErr != nil {
+			return nil, xErr
+		}
+		y, yErr := decodeJwkInt(key.Y)
+		if yErr != nil {
+			return nil, yErr
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Point of key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unsupported key type %s", key.Kty))
+}
+
+/*
+Parses a json web key set, keeping the signature keys of supported types
+*/
+func parseJwks(b []byte) (map[string]jwtKey, error) {
+	var set jwks
+	err := json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing the jwks: %s", err.Error()))
+	}
+
+	keys := map[string]jwtKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		pub, pubErr := parseJwk(key)
+		if pubErr != nil {
+			fmt.Printf("Ignoring key %s of the jwks: %s\n", key.Kid, pubErr.Error())
+			continue
+		}
+		keys[key.Kid] = jwtKey{alg: key.Alg, key: pub}
+	}
+
+	return keys, nil
+}
+
+func getJwtHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "ES512":
+		return crypto.SHA512, nil
+	}
+
+	return 0, errors.New(fmt.Sprintf("Unsupported signing algorithm %s", alg))
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, hashErr := getJwtHash(alg)
+	if hashErr != nil {
+		return hashErr
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New(fmt.Sprintf("Algorithm %s cannot be used with an rsa key", alg))
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New(fmt.Sprintf("Algorithm %s cannot be used with an ec key", alg))
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("Invalid signature size")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("Invalid signature")
+		}
+		return nil
+	}
+
+	return errors.New("Unsupported key type")
+}
+
+/*
+Returns the values of a string or string array claim
+*/
+func getJwtClaimValues(claims map[string]interface{}, claim string) []string {
+	switch value := claims[claim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+
+	return []string{}
+}
+
+func getJwtTimeClaim(claims map[string]interface{}, claim string) (time.Time, bool) {
+	value, ok := claims[claim].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(value), 0), true
+}
+
+/*
+Validates jwts against the keys of a json web key set, read from a file or fetched from an url,
+and maps their claims to permissions on states.
+The keys are reloaded periodically and when a token is signed with an unknown key.
+*/
+type JwtVerifier struct {
+	conf     ConfigJwt
+	client   *http.Client
+	lock     sync.Mutex
+	keys     map[string]jwtKey
+	loadedAt time.Time
+	loading  bool
+}
+
+func NewJwtVerifier(conf ConfigJwt) (*JwtVerifier, error) {
+	if conf.JwksFile == "" && conf.JwksUrl == "" {
+		return nil, nil
+	}
+
+	v := &JwtVerifier{
+		conf:     conf,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     map[string]jwtKey{},
+		loadedAt: time.Now(),
+	}
+
+	keys, loadErr := v.loadKeys()
+	if loadErr == nil {
+		v.keys = keys
+	} else {
+		//Keys served by an url can be fetched later if it is temporarily unavailable
+		if conf.JwksFile != "" {
+			return nil, loadErr
+		}
+		fmt.Printf("Could not fetch the jwks: %s\n", loadErr.Error())
+	}
+
+	return v, nil
+}
+
+func (v *JwtVerifier) readJwks() ([]byte, error) {
+	if v.conf.JwksFile != "" {
+		b, err := ioutil.ReadFile(v.conf.JwksFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading the jwks file: %s", err.Error()))
+		}
+		return b, nil
+	}
+
+	res, err := v.client.Get(v.conf.JwksUrl)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error fetching the jwks: %s", err.Error()))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Error fetching the jwks: status code %d", res.StatusCode))
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+}
+
+func (v *JwtVerifier) loadKeys() (map[string]jwtKey, error) {
+	b, readErr := v.readJwks()
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	return parseJwks(b)
+}
+
+/*
+Returns a key by id, reloading the keys first if they are stale or if the key is unknown and the keys were not
+reloaded recently. The keys are loaded without holding the lock, so that a slow jwks url doesn't block the
+requests signed with known keys, and a single reload happens at a time.
+*/
+func (v *JwtVerifier) getKey(kid string) (jwtKey, error) {
+	v.lock.Lock()
+	key, found := v.keys[kid]
+	stale := time.Since(v.loadedAt) >= v.conf.JwksRefreshInterval
+	reload := !v.loading && (stale || (!found && time.Since(v.loadedAt) >= jwksMinReloadInterval))
+	if reload {
+		v.loading = true
+		v.loadedAt = time.Now()
+	}
+	v.lock.Unlock()
+
+	if reload {
+		keys, loadErr := v.loadKeys()
+
+		v.lock.Lock()
+		v.loading = false
+		if loadErr != nil {
+			fmt.Printf("Could not reload the jwks: %s\n", loadErr.Error())
+		} else {
+			v.keys = keys
+		}
+		key, found = v.keys[kid]
+		v.lock.Unlock()
+	}
+
+	if !found {
+		return key, errors.New(fmt.Sprintf("Token is signed with unknown key %s", kid))
+	}
+
+	return key, nil
+}
+
+/*
+Validates the signature, validity period, issuer and audience of a jwt, returning its claims
+*/
+func (v *JwtVerifier) Verify(token string) (map[string]interface{}, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("Token is not a jwt")
+	}
+
+	headerBytes, headerErr := decodeJwtSegment(segments[0])
+	if headerErr != nil {
+		return nil, errors.New("Token header is not valid base64")
+	}
+	var header jwtHeader
+	if json.Unmarshal(headerBytes, &header) != nil {
+		return nil, errors.New("Token header is not valid json")
+	}
+
+	key, keyErr := v.getKey(header.Kid)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, errors.New(fmt.Sprintf("Token is signed with algorithm %s instead of %s", header.Alg, key.alg))
+	}
+
+	signature, signatureErr := decodeJwtSegment(segments[2])
+	if signatureErr != nil {
+		return nil, errors.New("Token signature is not valid base64")
+	}
+	verifyErr := verifyJwtSignature(header.Alg, key.key, []byte(segments[0]+"."+segments[1]), signature)
+	if verifyErr != nil {
+		return nil, errors.New(fmt.Sprintf("Token signature is invalid: %s", verifyErr.Error()))
+	}
+
+	payload, payloadErr := decodeJwtSegment(segments[1])
+	if payloadErr != nil {
+		return nil, errors.New("Token payload is not valid base64")
+	}
+	claims := map[string]interface{}{}
+	if json.Unmarshal(payload, &claims) != nil {
+		return nil, errors.New("Token payload is not valid json")
+	}
+
+	now := time.Now()
+	exp, hasExp := getJwtTimeClaim(claims, "exp")
+	if !hasExp {
+		return nil, errors.New("Token has no expiry")
+	}
+	if now.After(exp.Add(jwtClockSkew)) {
+		return nil, errors.New("Token is expired")
+	}
+	if nbf, hasNbf := getJwtTimeClaim(claims, "nbf"); hasNbf && now.Add(jwtClockSkew).Before(nbf) {
+		return nil, errors.New("Token is not valid yet")
+	}
+
+	if v.conf.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.conf.Issuer {
+			return nil, errors.New("Token has an unexpected issuer")
+		}
+	}
+
+	if v.conf.Audience != "" {
+		audienceOk := false
+		for _, aud := range getJwtClaimValues(claims, "aud") {
+			if aud == v.conf.Audience {
+				audienceOk = true
+			}
+		}
+		if !audienceOk {
+			return nil, errors.New("Token has an unexpected audience")
+		}
+	}
+
+	return claims, nil
+}
+
+/*
+Verifies a jwt and returns a client with the permissions its claims are mapped to
+*/
+func (v *JwtVerifier) Authenticate(token string) (*Principal, error) {
+	claims, verifyErr := v.Verify(token)
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+
+	sub, _ := claims["sub"].(string)
+	principal := &Principal{Name: sub, Permissions: []Permission{}}
+	for _, mapping := range v.conf.Permissions {
+		matched := false
+		for _, value := range getJwtClaimValues(claims, mapping.Claim) {
+			for _, expected := range mapping.Values {
+				if value == expected {
+					matched = true
+				}
+			}
+		}
+
+		if matched {
+			principal.Permissions = append(principal.Permissions, mapping.Permission)
+		}
+	}
+
+	return principal, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+/*
+Layout of the etcd keys of states, set from the configuration at startup.
+The metadata key of a state is always the state key followed by /info, as imposed by the etcd sdk.
+*/
+type KeyLayout struct {
+	Namespace       string
+	LockSuffix      string
+	StateSuffix     string
+	LockInfoSuffix  string
+	LockQueueSuffix string
+	//Keys and prefixes the backend stores its own data under, like the locks of its background tasks
+	InternalKeys []string
+}
+
+var keyLayout = KeyLayout{
+	Namespace:       "",
+	LockSuffix:      "/lock",
+	StateSuffix:     "/state",
+	LockInfoSuffix:  "/lock-info",
+	LockQueueSuffix: "/lock-queue",
+}
+
+var ErrInvalidStateName = errors.New("State names cannot contain empty segments, '.' or '..' segments, or segments reserved for the keys of states")
+var ErrInternalStateName = errors.New("State names cannot overlap the keys the backend stores for itself, like its api tokens or maintenance mode")
+
+/*
+Sets the key layout from the configuration, keeping the default of any suffix that isn't set
+*/
+func setKeyLayout(config Config) {
+	conf := config.Keys
+	keyLayout.Namespace = conf.Namespace
+	if conf.LockSuffix != "" {
+		keyLayout.LockSuffix = conf.LockSuffix
+	}
+	if conf.StateSuffix != "" {
+		keyLayout.StateSuffix = conf.StateSuffix
+	}
+	if conf.LockInfoSuffix != "" {
+		keyLayout.LockInfoSuffix = conf.LockInfoSuffix
+	}
+
+	keyLayout.InternalKeys = []string{}
+	for _, key := range []string{
+		config.Backups.LockKey,
+		config.Gc.LockKey,
+		config.Replication.LockKey,
+		config.Replication.CheckpointKey,
+		config.Webhooks.OutboxPrefix,
+		config.Tokens.Prefix,
+		config.Maintenance.Key,
+	} {
+		if key != "" {
+			keyLayout.InternalKeys = append(keyLayout.InternalKeys, key)
+		}
+	}
+}
+
+/*
+Returns whether the keys of a state would be mixed with the keys the backend stores for itself, either because the
+state is under one of them or because one of them is under the state
+*/
+func isInternalState(state string) bool {
+	for _, internalKey := range keyLayout.InternalKeys {
+		if hasSegmentPrefix(state, internalKey) || hasSegmentPrefix(internalKey, state) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns whether a key belongs to the data the backend stores for itself rather than to a state
+*/
+func isInternalKey(key string) bool {
+	for _, internalKey := range keyLayout.InternalKeys {
+		if hasSegmentPrefix(key, internalKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns whether a name is used as the last segment of the keys of states, which would make the keys of
+a state named after it collide with the keys of its parent state
+*/
+func isReservedKeySegment(segment string) bool {
+	for _, suffix := range []string{keyLayout.LockSuffix, keyLayout.StateSuffix, keyLayout.LockInfoSuffix, keyLayout.LockQueueSuffix} {
+		if "/"+segment == suffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateKeySegments(name string, allowTrailingEmpty bool) error {
+	segments := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for idx, segment := range segments {
+		if segment == "" && allowTrailingEmpty && idx == len(segments)-1 {
+			continue
+		}
+		if segment == "" || segment == "." || segment == ".." || isReservedKeySegment(segment) {
+			return ErrInvalidStateName
+		}
+	}
+
+	return nil
+}
+
+/*
+Returns the etcd prefix of a state named by a client, which is the state name inside the namespace
+*/
+func resolveState(name string) (string, error) {
+	validationErr := validateKeySegments(name, false)
+	if validationErr != nil {
+		return "", validationErr
+	}
+
+	state := joinNamespace(name)
+	if isInternalState(state) {
+		return "", ErrInternalStateName
+	}
+
+	return state, nil
+}
+
+/*
+Returns the etcd prefix matching a prefix of state names passed by a client.
+An empty prefix matches all the states in the namespace and the last segment can be partial.
+The namespace always ends with a slash so that it doesn't match sibling namespaces sharing its name as a prefix.
+*/
+func resolveStatePrefix(prefix string) (string, error) {
+	if prefix == "" {
+		if keyLayout.Namespace == "" {
+			return "", nil
+		}
+		return strings.TrimSuffix(keyLayout.Namespace, "/") + "/", nil
+	}
+
+	validationErr := validateKeySegments(prefix, true)
+	if validationErr != nil {
+		return "", validationErr
+	}
+
+	resolved := joinNamespace(prefix)
+	if isInternalKey(resolved) {
+		return "", ErrInternalStateName
+	}
+
+	return resolved, nil
+}
+
+/*
+Returns whether a key or prefix is under another prefix on a segment boundary, so that /prod covers /prod and
+/prod/network but not /production. A prefix ending with a slash only covers the keys under it.
+*/
+func hasSegmentPrefix(key string, prefix string) bool {
+	if prefix == "" || key == prefix {
+		return true
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(key, prefix)
+	}
+
+	return strings.HasPrefix(key, prefix+"/")
+}
+
+func joinNamespace(name string) string {
+	if keyLayout.Namespace == "" {
+		return name
+	}
+
+	return strings.TrimSuffix(keyLayout.Namespace, "/") + "/" + strings.TrimPrefix(name, "/")
+}
+
+func getLockKey(state string) string {
+	return fmt.Sprintf("%s%s", state, keyLayout.LockSuffix)
+}
+
+func getLockHolderKey(state string) string {
+	return fmt.Sprintf("%s%s", state, keyLayout.LockInfoSuffix)
+}
+
+func getLockQueuePrefix(state string) string {
+	return fmt.Sprintf("%s%s/", state, keyLayout.LockQueueSuffix)
+}
+
+func getStateKey(state string) string {
+	return fmt.Sprintf("%s%s", state, keyLayout.StateSuffix)
+}
+
+func getStateChunkPrefix(state string, version int64) string {
+	return fmt.Sprintf("%s/chunks/v%d/", getStateKey(state), version)
+}
+
+/*
+Returns the state a lock key belongs to, if the key is a lock key.
+The locks of the backend's background tasks also end with /lock but are internal keys rather than locks of states.
+*/
+func getLockState(key string) (string, bool) {
+	if !strings.HasSuffix(key, keyLayout.LockSuffix) || isInternalKey(key) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(key, keyLayout.LockSuffix), true
+}
+
+/*
+Returns the state a state metadata key belongs to, if the key is a state metadata key
+*/
+func getStateInfoState(key string) (string, bool) {
+	infoSuffix := fmt.Sprintf("%s/info", keyLayout.StateSuffix)
+	if !strings.HasSuffix(key, infoSuffix) || isInternalKey(key) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(key, infoSuffix), true
+}
+
+/*
+Returns the state, version and index of a state chunk key, if the key is a state chunk key
+*/
+func parseStateChunkKey(key string) (string, int64, int64, bool) {
+	chunksSegment := fmt.Sprintf("%s/chunks/v", keyLayout.StateSuffix)
+	pos := strings.LastIndex(key, chunksSegment)
+	if pos < 0 {
+		return "", 0, 0, false
+	}
+
+	parts := strings.Split(key[pos+len(chunksSegment):], "/")
+	if len(parts) != 2 {
+		return "", 0, 0, false
+	}
+
+	version, versionErr := strconv.ParseInt(parts[0], 10, 64)
+	idx, idxErr := strconv.ParseInt(parts[1], 10, 64)
+	if versionErr != nil || idxErr != nil {
+		return "", 0, 0, false
+	}
+
+	return key[:pos], version, idx, true
+}
+
+/*
+Lists the keys under a prefix without retrieving their values, which can be large for state chunks
+*/
+func listKeys(cli *client.EtcdClient, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	res, err := cli.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(res.Kvs))
+	for idx, kv := range res.Kvs {
+		keys[idx] = string(kv.Key)
+	}
+
+	return keys, nil
+}
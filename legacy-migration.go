@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+)
+
+const (
+	MigrationMigrated        = "migrated"
+	MigrationAlreadyMigrated = "already migrated"
+	MigrationWouldMigrate    = "would migrate"
+	MigrationSkippedExists   = "skipped: target state already exists"
+	MigrationSkippedLocked   = "skipped: legacy or target state is locked"
+	MigrationSkippedName     = "skipped: workspace name is reserved by this backend"
+)
+
+type LegacyMigrationOptions struct {
+	Prefix    string
+	AddSlash  bool
+	Separator string
+	Overwrite bool
+	Delete    bool
+	DryRun    bool
+}
+
+type LegacyMigrationResult struct {
+	Workspace string
+	LegacyKey string
+	State     string
+	Status    string
+	Deleted   bool
+}
+
+/*
+The legacy etcdv3 backend stored the state of each workspace in a single key made of the prefix followed by the
+workspace name. The default workspace maps to the state whose legacy location getLegacyStatePath points to and other
+workspaces map to a state with the workspace name appended.
+*/
+func getMigratedState(workspace string, opts LegacyMigrationOptions) string {
+	state := opts.Prefix
+	if opts.AddSlash {
+		state = strings.TrimSuffix(opts.Prefix, "/")
+	}
+
+	if workspace == "default" {
+		return state
+	}
+
+	return fmt.Sprintf("%s%s%s", state, opts.Separator, workspace)
+}
+
+/*
+Returns the workspaces with a legacy state under the prefix.
+Workspace names cannot contain slashes and the keys of the legacy locks have a suffix, so legacy states are the keys
+directly under the prefix, without suffix, whose value is a terraform state.
+*/
+func listLegacyWorkspaces(cli *client.EtcdClient, prefix string) ([]string, error) {
+	keys, keysErr := listKeys(cli, prefix)
+	if keysErr != nil {
+		return nil, keysErr
+	}
+
+	workspaces := []string{}
+	for _, key := range keys {
+		workspace := strings.TrimPrefix(key, prefix)
+		if workspace == "" || strings.Contains(workspace, "/") || strings.HasSuffix(workspace, ".lockinfo") {
+			continue
+		}
+
+		keyInfo, keyErr := cli.GetKey(key, client.GetKeyOptions{})
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		if keyInfo.Found() && isTerraformState([]byte(keyInfo.Value)) {
+			workspaces = append(workspaces, workspace)
+		}
+	}
+
+	return workspaces, nil
+}
+
+/*
+The legacy backend locked a workspace with an etcd mutex on the workspace's key and stored the lock information
+in a separate key with a suffix
+*/
+func isLegacyStateLocked(cli *client.EtcdClient, legacyKey string) (bool, error) {
+	infoKey, infoErr := cli.GetKey(fmt.Sprintf("%s.lockinfo", legacyKey), client.GetKeyOptions{})
+	if infoErr != nil {
+		return false, infoErr
+	}
+	if infoKey.Found() {
+		return true, nil
+	}
+
+	mutexKeys, mutexErr := listKeys(cli, fmt.Sprintf("%s/", legacyKey))
+	if mutexErr != nil {
+		return false, mutexErr
+	}
+	for _, key := range mutexKeys {
+		if !strings.Contains(strings.TrimPrefix(key, fmt.Sprintf("%s/", legacyKey)), "/") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func migrateLegacyWorkspace(cli *client.EtcdClient, workspace string, opts LegacyMigrationOptions) (LegacyMigrationResult, error) {
+	legacyKey := fmt.Sprintf("%s%s", opts.Prefix, workspace)
+	result := LegacyMigrationResult{
+		Workspace: workspace,
+		LegacyKey: legacyKey,
+		State:     getMigratedState(workspace, opts),
+	}
+
+	if opts.Separator == "/" && isReservedKeySegment(workspace) {
+		result.Status = MigrationSkippedName
+		return result, nil
+	}
+
+	locked, lockedErr := isLegacyStateLocked(cli, legacyKey)
+	if lockedErr != nil {
+		return result, lockedErr
+	}
+	if locked {
+		result.Status = MigrationSkippedLocked
+		return result, nil
+	}
+
+	legacyState, legacyErr := cli.GetKey(legacyKey, client.GetKeyOptions{})
+	if legacyErr != nil {
+		return result, legacyErr
+	}
+
+	if opts.DryRun {
+		result.Status = MigrationWouldMigrate
+		return result, nil
+	}
+
+	restored, restoreErr := restoreState(cli, result.State, []byte(legacyState.Value), RestoreOptions{Overwrite: opts.Overwrite})
+	if restoreErr != nil {
+		return result, restoreErr
+	}
+	if !restored {
+		_, lockErr := readLock(cli, result.State)
+		if lockErr == nil {
+			result.Status = MigrationSkippedLocked
+			return result, nil
+		}
+	}
+
+	migrated, _, readErr := readState(cli, result.State)
+	if readErr != nil {
+		return result, readErr
+	}
+	matches := bytes.Equal(migrated, []byte(legacyState.Value))
+
+	switch {
+	case restored && !matches:
+		return result, errors.New(fmt.Sprintf("Migrated state %s doesn't match legacy state %s", result.State, legacyKey))
+	case restored:
+		result.Status = MigrationMigrated
+	case matches:
+		result.Status = MigrationAlreadyMigrated
+	default:
+		result.Status = MigrationSkippedExists
+		return result, nil
+	}
+
+	if opts.Delete {
+		deleteErr := cli.DeleteKey(legacyKey)
+		if deleteErr != nil {
+			return result, deleteErr
+		}
+		result.Deleted = true
+	}
+
+	return result, nil
+}
+
+/*
+Copies all the legacy states under a prefix in the chunked format, verifying that each copy is identical to the original.
+Originals are deleted only if requested and their copy was verified.
+*/
+func migrateLegacyStates(cli *client.EtcdClient, opts LegacyMigrationOptions) ([]LegacyMigrationResult, error) {
+	results := []LegacyMigrationResult{}
+
+	workspaces, workspacesErr := listLegacyWorkspaces(cli, opts.Prefix)
+	if workspacesErr != nil {
+		return results, workspacesErr
+	}
+
+	for _, workspace := range workspaces {
+		result, migrateErr := migrateLegacyWorkspace(cli, workspace, opts)
+		if migrateErr != nil {
+			return results, errors.New(fmt.Sprintf("Error migrating legacy workspace %s: %s", workspace, migrateErr.Error()))
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var ErrLockNotFound = errors.New("Lock not found")
+var ErrInvalidLock = errors.New("Lock key doesn't contain a lock of the backend")
+var ErrLockMismatch = errors.New("Lock is held with a different ID")
+
+/*
+Lock information as sent by terraform's http backend in the body of lock requests.
+Only the ID is interpreted, the rest is kept as is to be returned to clients.
+*/
+type LockHolder struct {
+	ID string
+}
+
+/*
+Returns the lock policy of the configuration with the longest prefix matching a state on a segment boundary.
+States not matched by any policy get a default ttl of 600 seconds which clients may override.
+*/
+func getLockPolicy(state string, config Config) ConfigLockPolicy {
+	policy := ConfigLockPolicy{
+		DefaultTtl:    600 * time.Second,
+		AllowOverride: true,
+	}
+	matchLen := -1
+	for _, candidate := range config.Lock.Policies {
+		if hasSegmentPrefix(state, candidate.Prefix) && len(candidate.Prefix) > matchLen {
+			policy = candidate
+			matchLen = len(candidate.Prefix)
+		}
+	}
+
+	return policy
+}
+
+/*
+Returns the lease ttl of a lock on a state, in seconds.
+The ttl requested by the client, if any, is validated against the lock policy of the state and the maximum ttl.
+Otherwise, the default ttl of the policy is used, capped by the maximum ttl.
+*/
+func getLockTtl(state string, ttlStr string, config Config) (int64, error) {
+	policy := getLockPolicy(state, config)
+	ttl := int64(policy.DefaultTtl / time.Second)
+	if ttlStr == "" {
+		if int64(config.Lock.MaxTtl) > 0 && policy.DefaultTtl > config.Lock.MaxTtl {
+			ttl = int64(config.Lock.MaxTtl / time.Second)
+		}
+		return ttl, nil
+	}
+
+	requested, ttlErr := strconv.ParseInt(ttlStr, 10, 64)
+	if ttlErr != nil || requested <= 0 {
+		return 0, errors.New("Lease ttl needs to be in positive integer format")
+	}
+
+	if !policy.AllowOverride && requested != ttl {
+		return 0, errors.New(fmt.Sprintf("Lease ttl of this state is set to %d seconds by the server and cannot be overridden", ttl))
+	}
+
+	if int64(policy.MinTtl) > 0 && time.Duration(requested)*time.Second < policy.MinTtl {
+		return 0, errors.New(fmt.Sprintf("Lease ttl of this state cannot be less than %d seconds", int64(policy.MinTtl/time.Second)))
+	}
+
+	if int64(policy.MaxTtl) > 0 && time.Duration(requested)*time.Second > policy.MaxTtl {
+		return 0, errors.New(fmt.Sprintf("Lease ttl of this state cannot exceed %d seconds", int64(policy.MaxTtl/time.Second)))
+	}
+
+	if int64(config.Lock.MaxTtl) > 0 && time.Duration(requested)*time.Second > config.Lock.MaxTtl {
+		return 0, errors.New(fmt.Sprintf("Lease ttl cannot exceed %d seconds", int64(config.Lock.MaxTtl/time.Second)))
+	}
+
+	return requested, nil
+}
+
+/*
+Stores the lock information provided by the client alongside the lock, bound to the same lease so that it
+disappears with the lock.
+*/
+func putLockHolder(cli *client.EtcdClient, state string, lock *client.Lock, holder []byte) error {
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	_, err := cli.Client.Put(ctx, getLockHolderKey(state), string(holder), clientv3.WithLease(lock.Lease))
+	return err
+}
+
+func getLockHolder(cli *client.EtcdClient, state string) ([]byte, *LockHolder, error) {
+	info, err := cli.GetKey(getLockHolderKey(state), client.GetKeyOptions{})
+	if err != nil || !info.Found() {
+		return nil, nil, err
+	}
+
+	var holder LockHolder
+	unmarshalErr := json.Unmarshal([]byte(info.Value), &holder)
+	if unmarshalErr != nil {
+		return []byte(info.Value), nil, nil
+	}
+
+	return []byte(info.Value), &holder, nil
+}
+
+func readLock(cli *client.EtcdClient, state string) (*client.Lock, error) {
+	info, err := cli.GetKey(getLockKey(state), client.GetKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !info.Found() {
+		return nil, ErrLockNotFound
+	}
+
+	lock := client.Lock{}
+	unmarshalErr := json.Unmarshal([]byte(info.Value), &lock)
+	if unmarshalErr != nil {
+		return nil, ErrInvalidLock
+	}
+
+	return &lock, nil
+}
+
+/*
+Resets the ttl of the lease of a state's lock.
+If an id is passed, the renewal is refused unless it matches the id of the lock's holder, including when the holder
+didn't store an id that could be checked.
+Returns the ttl of the renewed lease in seconds.
+*/
+func renewLock(cli *client.EtcdClient, state string, id string) (int64, error) {
+	lock, lockErr := readLock(cli, state)
+	if lockErr != nil {
+		return 0, lockErr
+	}
+
+	if id != "" {
+		_, holder, holderErr := getLockHolder(cli, state)
+		if holderErr != nil {
+			return 0, holderErr
+		}
+		if holder == nil || holder.ID != id {
+			return 0, ErrLockMismatch
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	resp, err := cli.Client.KeepAliveOnce(ctx, lock.Lease)
+	if err == rpctypes.ErrLeaseNotFound {
+		return 0, ErrLockNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.TTL, nil
+}
+
+/*
+Periodically renews the lock of a state held with an id, if any, until the returned function is called.
+It is used to prevent a lock from expiring while the state it protects is being uploaded by the lock's holder.
+Without an id, the lock is not renewed as the uploader may not be its holder.
+*/
+func keepLockAlive(cli *client.EtcdClient, state string, id string) func() {
+	if id == "" {
+		return func() {}
+	}
+
+	doneCh := make(chan struct{})
+	stoppedCh := make(chan struct{})
+
+	go func() {
+		defer close(stoppedCh)
+
+		lock, lockErr := readLock(cli, state)
+		if lockErr != nil {
+			if lockErr != ErrLockNotFound {
+				fmt.Printf("Could not read lock to keep it alive during upload: %s\n", lockErr.Error())
+			}
+			return
+		}
+
+		interval := time.Duration(lock.Ttl) * time.Second / 3
+		if interval < time.Second {
+			interval = time.Second
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-doneCh:
+				return
+			case <-ticker.C:
+				_, err := renewLock(cli, state, id)
+				if err == ErrLockNotFound || err == ErrLockMismatch {
+					return
+				}
+				if err != nil {
+					fmt.Printf("Could not keep lock alive during upload: %s\n", err.Error())
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(doneCh)
+		<-stoppedCh
+	}
+}
+
+/*
+Acquires the lock of a state, waiting in line behind other clients that are also waiting on it.
+Waiters register themselves under the state's lock queue prefix with a lease that is kept alive while they wait
+and only the waiter whose registration has the lowest etcd revision attempts to acquire the lock.
+If the context is cancelled while the lock is acquired, the lock is released.
+Returns the same values as the AcquireLock method of the etcd client.
+*/
+func acquireLockInQueue(ctx context.Context, cli *client.EtcdClient, state string, ttl int64, wait time.Duration, config Config) (*client.Lock, bool, error) {
+	deadline := time.Now().Add(wait)
+
+	queueCtx, queueCancel := context.WithCancel(cli.Context)
+	defer queueCancel()
+
+	grantCtx, grantCancel := context.WithTimeout(queueCtx, cli.RequestTimeout)
+	lease, leaseErr := cli.Client.Grant(grantCtx, 10)
+	grantCancel()
+	if leaseErr != nil {
+		return nil, false, leaseErr
+	}
+	defer func() {
+		revokeCtx, revokeCancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+		defer revokeCancel()
+		_, revokeErr := cli.Client.Revoke(revokeCtx, lease.ID)
+		if revokeErr != nil {
+			fmt.Printf("Could not leave lock queue of state %s: %s\n", state, revokeErr.Error())
+		}
+	}()
+
+	keepAliveCh, keepAliveErr := cli.Client.KeepAlive(queueCtx, lease.ID)
+	if keepAliveErr != nil {
+		return nil, false, keepAliveErr
+	}
+	go func() {
+		for range keepAliveCh {
+		}
+	}()
+
+	queueKey := fmt.Sprintf("%s%x", getLockQueuePrefix(state), int64(lease.ID))
+	putCtx, putCancel := context.WithTimeout(queueCtx, cli.RequestTimeout)
+	_, putErr := cli.Client.Put(putCtx, queueKey, "", clientv3.WithLease(lease.ID))
+	putCancel()
+	if putErr != nil {
+		return nil, false, putErr
+	}
+
+	for {
+		getCtx, getCancel := context.WithTimeout(queueCtx, cli.RequestTimeout)
+		res, getErr := cli.Client.Get(
+			getCtx,
+			getLockQueuePrefix(state),
+			clientv3.WithPrefix(),
+			clientv3.WithKeysOnly(),
+			clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+			clientv3.WithLimit(1),
+		)
+		getCancel()
+		if getErr != nil {
+			return nil, false, getErr
+		}
+
+		if len(res.Kvs) > 0 && string(res.Kvs[0].Key) == queueKey {
+			lock, alreadyLocked, lockErr := cli.AcquireLock(client.AcquireLockOptions{
+				Key:           getLockKey(state),
+				Ttl:           ttl,
+				Timeout:       time.Until(deadline),
+				RetryInterval: config.Lock.RetryInterval,
+			})
+			if lockErr != nil || alreadyLocked || ctx.Err() == nil {
+				return lock, alreadyLocked, lockErr
+			}
+
+			//The client is gone and would never release the lock
+			revokeCtx, revokeCancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+			defer revokeCancel()
+			_, revokeErr := cli.Client.Revoke(revokeCtx, lock.Lease)
+			if revokeErr != nil {
+				fmt.Printf("Could not release lock of state %s acquired for a cancelled request: %s\n", state, revokeErr.Error())
+			}
+			return nil, false, ctx.Err()
+		}
+
+		if time.Now().Add(config.Lock.RetryInterval).After(deadline) {
+			return nil, true, errors.New(fmt.Sprintf("Could not acquire lock on state %s before the wait expired", state))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(config.Lock.RetryInterval):
+		}
+	}
+}
+
+/*
+Status of a state's lock, as reported by the lock inspection endpoints
+*/
+type LockStatus struct {
+	State        string          `json:"state"`
+	Lease        int64           `json:"lease"`
+	Ttl          int64           `json:"ttl"`
+	TtlRemaining int64           `json:"ttl_remaining"`
+	AcquiredAt   time.Time       `json:"acquired_at"`
+	Holder       json.RawMessage `json:"holder"`
+}
+
+func getLockStatus(cli *client.EtcdClient, state string) (*LockStatus, error) {
+	lock, lockErr := readLock(cli, state)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+
+	holder, _, holderErr := getLockHolder(cli, state)
+	if holderErr != nil {
+		return nil, holderErr
+	}
+	if len(holder) > 0 && !json.Valid(holder) {
+		holder, _ = json.Marshal(string(holder))
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	ttlRes, ttlErr := cli.Client.TimeToLive(ctx, lock.Lease)
+	if ttlErr != nil {
+		return nil, ttlErr
+	}
+	//The lease expired between the time the lock was read and now
+	if ttlRes.TTL < 0 {
+		return nil, ErrLockNotFound
+	}
+
+	return &LockStatus{
+		State:        state,
+		Lease:        int64(lock.Lease),
+		Ttl:          lock.Ttl,
+		TtlRemaining: ttlRes.TTL,
+		AcquiredAt:   lock.Timestamp,
+		Holder:       json.RawMessage(holder),
+	}, nil
+}
+
+/*
+Number of states whose lock and holder are read in a single transaction, as etcd limits the operations of transactions
+*/
+const lockListBatchSize = 64
+
+/*
+Number of lease ttls looked up concurrently when listing locks, as etcd has no call to look up several at once
+*/
+const lockListLeaseLookups = 16
+
+/*
+Reads the locks and holders of some states at a single revision, skipping the states that are no longer locked
+*/
+func readLocks(cli *client.EtcdClient, states []string) ([]LockStatus, error) {
+	ops := []clientv3.Op{}
+	for _, state := range states {
+		ops = append(ops, clientv3.OpGet(getLockKey(state)), clientv3.OpGet(getLockHolderKey(state)))
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	res, txErr := cli.Client.Txn(ctx).Then(ops...).Commit()
+	if txErr != nil {
+		return nil, txErr
+	}
+
+	locks := []LockStatus{}
+	for idx, state := range states {
+		lockKvs := res.Responses[2*idx].GetResponseRange().Kvs
+		if len(lockKvs) == 0 {
+			continue
+		}
+
+		lock := client.Lock{}
+		unmarshalErr := json.Unmarshal(lockKvs[0].Value, &lock)
+		if unmarshalErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing the lock of state %s: %s", state, unmarshalErr.Error()))
+		}
+
+		var holder []byte
+		holderKvs := res.Responses[2*idx+1].GetResponseRange().Kvs
+		if len(holderKvs) > 0 {
+			holder = holderKvs[0].Value
+		}
+		if len(holder) > 0 && !json.Valid(holder) {
+			holder, _ = json.Marshal(string(holder))
+		}
+
+		locks = append(locks, LockStatus{
+			State:      state,
+			Lease:      int64(lock.Lease),
+			Ttl:        lock.Ttl,
+			AcquiredAt: lock.Timestamp,
+			Holder:     json.RawMessage(holder),
+		})
+	}
+
+	return locks, nil
+}
+
+/*
+Fills the remaining ttl of the leases of locks, with a bounded number of concurrent lookups.
+Locks whose lease expired since they were read are dropped.
+*/
+func setLockTtls(cli *client.EtcdClient, locks []LockStatus) ([]LockStatus, error) {
+	errs := make([]error, len(locks))
+	expired := make([]bool, len(locks))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, lockListLeaseLookups)
+	for idx := range locks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+			defer cancel()
+
+			ttlRes, ttlErr := cli.Client.TimeToLive(ctx, clientv3.LeaseID(locks[idx].Lease))
+			if ttlErr != nil {
+				errs[idx] = ttlErr
+				return
+			}
+			locks[idx].TtlRemaining = ttlRes.TTL
+			expired[idx] = ttlRes.TTL < 0
+		}(idx)
+	}
+	wg.Wait()
+
+	alive := []LockStatus{}
+	for idx, lock := range locks {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		if !expired[idx] {
+			alive = append(alive, lock)
+		}
+	}
+
+	return alive, nil
+}
+
+/*
+Returns the status of all the locks of the states under a prefix.
+The lock keys are found with a single ranged read of the keys under the prefix, without their values as they include
+the chunks of the states, and the locks are then read in batches.
+*/
+func listLocks(cli *client.EtcdClient, prefix string) ([]LockStatus, error) {
+	keys, keysErr := listKeys(cli, prefix)
+	if keysErr != nil {
+		return nil, keysErr
+	}
+
+	states := []string{}
+	for _, key := range keys {
+		if state, isLock := getLockState(key); isLock {
+			states = append(states, state)
+		}
+	}
+
+	locks := []LockStatus{}
+	for start := 0; start < len(states); start += lockListBatchSize {
+		end := start + lockListBatchSize
+		if end > len(states) {
+			end = len(states)
+		}
+
+		batch, readErr := readLocks(cli, states[start:end])
+		if readErr != nil {
+			return nil, readErr
+		}
+		locks = append(locks, batch...)
+	}
+
+	return setLockTtls(cli, locks)
+}
+
+/*
+Returns the status of all the locks of the states under a prefix in all the clusters they can be routed to
+*/
+func listClusterLocks(clusters *ClusterSet, prefix string) ([]LockStatus, error) {
+	locks := []LockStatus{}
+	for _, cluster := range clusters.GetOverlapping(prefix) {
+		clusterLocks, locksErr := listLocks(cluster.Client, prefix)
+		if locksErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error listing the locks of etcd cluster %s: %s", cluster.Name, locksErr.Error()))
+		}
+
+		for _, lock := range clusterLocks {
+			if clusters.Routes(lock.State, cluster) {
+				locks = append(locks, lock)
+			}
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].State < locks[j].State })
+
+	return locks, nil
+}
@@ -11,53 +11,155 @@ import (
 
   	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
   	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Shutdown func() error
 
+/*
+Time given to uploads to abort once the drain timeout of a shutdown is exceeded
+*/
+const uploadAbortTimeout = 10 * time.Second
+
+/*
+Time given to requests in progress to finish on shutdown when the configuration has no drain timeout
+*/
+const defaultDrainTimeout = 10 * time.Second
+
+func connectEtcd(ctx context.Context, conf ConfigEtcdClient) (*client.EtcdClient, error) {
+	return client.Connect(ctx, client.EtcdClientOptions{
+		ClientCertPath:    conf.Auth.ClientCert,
+		ClientKeyPath:     conf.Auth.ClientKey,
+		CaCertPath:        conf.Auth.CaCert,
+		Username:          conf.Auth.Username,
+		Password:          conf.Auth.Password,
+		EtcdEndpoints:     conf.Endpoints,
+		ConnectionTimeout: conf.ConnectionTimeout,
+		RequestTimeout:    conf.RequestTimeout,
+		RetryInterval:     conf.RetryInterval,
+		Retries:           conf.Retries,
+	})
+}
+
+/*
+Registers the api routes, except the termination and readiness routes which are not behind authentication. Besides the methods configured in the backend declaration examples, the default methods of
+terraform's http backend are accepted: LOCK and UNLOCK on the lock address (which can be the state address) and POST
+on the state address.
+*/
+func registerRoutes(routes gin.IRoutes, handlers Handlers, config Config) {
+	routes.PUT("/lock", handlers.AcquireLock)
+	routes.Handle("LOCK", "/lock", handlers.AcquireLock)
+	routes.POST("/lock/renew", handlers.RenewLock)
+	routes.DELETE("/lock", handlers.ReleaseLock)
+	routes.Handle("UNLOCK", "/lock", handlers.ReleaseLock)
+	routes.GET("/lock", handlers.GetLock)
+	routes.GET("/locks", handlers.ListLocks)
+	routes.GET("/state", handlers.GetState)
+	routes.PUT("/state", handlers.UpsertState)
+	routes.POST("/state", handlers.UpsertState)
+	routes.DELETE("/state", handlers.DeleteState)
+	routes.Handle("LOCK", "/state", handlers.AcquireLock)
+	routes.Handle("UNLOCK", "/state", handlers.ReleaseLock)
+	routes.GET("/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.GetState, "/lock": handlers.GetLock}))
+	routes.PUT("/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.UpsertState, "/lock": handlers.AcquireLock}))
+	routes.POST("/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.UpsertState, "/lock/renew": handlers.RenewLock}))
+	routes.DELETE("/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.DeleteState, "/lock": handlers.ReleaseLock}))
+	routes.Handle("LOCK", "/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.AcquireLock, "/lock": handlers.AcquireLock}))
+	routes.Handle("UNLOCK", "/states/*name", getStatePathHandler(map[string]gin.HandlerFunc{"": handlers.ReleaseLock, "/lock": handlers.ReleaseLock}))
+	routes.POST("/state/copy", handlers.CopyState)
+	routes.POST("/state/move", handlers.MoveState)
+	routes.GET("/watch", handlers.Watch)
+	routes.GET("/admin/fsck", handlers.Fsck)
+	routes.GET("/admin/maintenance", handlers.GetMaintenance)
+	routes.PUT("/admin/maintenance", handlers.SetMaintenance)
+	routes.DELETE("/admin/maintenance", handlers.ResetMaintenance)
+	routes.GET("/admin/replication", handlers.GetReplication)
+	if config.Tokens.Enabled {
+		routes.POST("/admin/tokens", handlers.CreateToken)
+		routes.GET("/admin/tokens", handlers.ListTokens)
+		routes.DELETE("/admin/tokens/:id", handlers.DeleteToken)
+	}
+	routes.GET("/health", handlers.GetHealth)
+	routes.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
 func Serve(config Config, doneCh <-chan struct{}) <-chan error {
-	var cli *client.EtcdClient
+	var clusters *ClusterSet
+	var replicator *Replicator
 	var server *http.Server
+	var adminServer *http.Server
 	ctx, cancel := context.WithCancel(context.Background())
 	errCh := make(chan error)
 
+	drainer := NewDrainer()
+
+	//Configurations that were not loaded from a file have no defaults, and a drain timeout of 0 would abort all uploads
+	drainTimeout := config.Server.Shutdown.DrainTimeout
+	if int64(drainTimeout) <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
 	shutdown := func() error {
 		defer cancel()
-		
+
 		if server != nil {
-			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)	
+			fmt.Println("Shutdown: marking the instance as not ready and closing watch streams")
+			drainer.StartDrain()
+			if config.Server.Shutdown.ReadinessDelay > 0 {
+				fmt.Printf("Shutdown: waiting %s for load balancers to stop sending requests\n", config.Server.Shutdown.ReadinessDelay.String())
+				time.Sleep(config.Server.Shutdown.ReadinessDelay)
+			}
+
+			fmt.Printf("Shutdown: draining requests in progress for up to %s\n", drainTimeout.String())
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainTimeout)
 			defer shutdownCancel()
+			if adminServer != nil {
+				adminErr := adminServer.Shutdown(shutdownCtx)
+				if adminErr != nil {
+					adminServer.Close()
+				}
+			}
 			shutdownErr := server.Shutdown(shutdownCtx)
-			if shutdownErr != nil && shutdownErr != http.ErrServerClosed {
+			if shutdownErr == context.DeadlineExceeded {
+				fmt.Printf("Shutdown: drain timed out, aborting %d uploads in progress\n", drainer.Uploads())
+				if !drainer.AbortUploads(uploadAbortTimeout) {
+					fmt.Printf("Shutdown: %d uploads did not abort in time\n", drainer.Uploads())
+				}
+				server.Close()
+			} else if shutdownErr != nil && shutdownErr != http.ErrServerClosed {
 				return shutdownErr
 			}
+			fmt.Println("Shutdown: http server stopped")
+		}
+
+		if clusters != nil {
+			cancel()
+			replicator.Close()
+			clusters.Close()
+			fmt.Println("Shutdown: etcd clients closed")
 		}
 
 		return nil
 	}
 
 	go func() {
+		//Errors are reported after the shutdown, so that the etcd clients are closed whichever step failed
+		var err error
 		defer func() {
-			errCh <- shutdown()
+			shutdownErr := shutdown()
+			if err == nil {
+				err = shutdownErr
+			}
+			if err != nil {
+				errCh <- err
+			}
 			close(errCh)
 		}()
 
-		var err error
-		cli, err = client.Connect(ctx, client.EtcdClientOptions{
-			ClientCertPath:    config.EtcdClient.Auth.ClientCert,
-			ClientKeyPath:     config.EtcdClient.Auth.ClientKey,
-			CaCertPath:        config.EtcdClient.Auth.CaCert,
-			Username:          config.EtcdClient.Auth.Username,
-			Password:          config.EtcdClient.Auth.Password,
-			EtcdEndpoints:     config.EtcdClient.Endpoints,
-			ConnectionTimeout: config.EtcdClient.ConnectionTimeout,
-			RequestTimeout:    config.EtcdClient.RequestTimeout,
-			RetryInterval:     config.EtcdClient.RetryInterval,
-			Retries:           config.EtcdClient.Retries,
-		})
-	
+		setKeyLayout(config)
+
+		clusters, err = ConnectClusters(ctx, config)
 		if err != nil {
-			errCh <- err
 			return
 		}
 
@@ -67,41 +169,95 @@ func Serve(config Config, doneCh <-chan struct{}) <-chan error {
 
 		accounts, accountsErr := getAccounts(config)
 		if accountsErr != nil {
-			errCh <- accountsErr
+			err = accountsErr
 			return	
 		}
 
+		verifier, verifierErr := NewJwtVerifier(config.Server.Jwt)
+		if verifierErr != nil {
+			err = verifierErr
+			return
+		}
+
 		router := gin.Default()
-		server = &http.Server{
-			Addr:    fmt.Sprintf("%s:%d", config.Server.Address, config.Server.Port),
-			Handler: router,
+		proxiesErr := router.SetTrustedProxies(config.Server.TrustedProxies)
+		if proxiesErr != nil {
+			err = proxiesErr
+			return
 		}
-	
-		handlers, terminateCh := GetHandlers(config, cli)
-
-		if len(accounts) > 0 {
-			authorized := router.Group("/", gin.BasicAuth(accounts))
-			authorized.PUT("/lock", handlers.AcquireLock)
-			authorized.DELETE("/lock", handlers.ReleaseLock)
-			authorized.GET("/state", handlers.GetState)
-			authorized.PUT("/state", handlers.UpsertState)
-			authorized.DELETE("/state", handlers.DeleteState)
-			authorized.GET("/health", handlers.GetHealth)
-			if config.RemoteTerminiation {
-				authorized.POST("/termination", handlers.Terminate)
+
+		notifier := NewNotifier(config, clusters)
+		go notifier.Run(ctx)
+
+		maintenance := NewMaintenance(config.Maintenance, clusters.Default.Client)
+		go maintenance.Run(ctx)
+
+		for _, cluster := range clusters.Clusters {
+			scheduler, schedulerErr := NewBackupScheduler(config, cluster.Client, maintenance)
+			if schedulerErr != nil {
+				err = schedulerErr
+				return
 			}
+			go scheduler.Run(ctx)
+
+			collector := NewGarbageCollector(config, cluster.Client, maintenance)
+			go collector.Run(ctx)
+		}
+
+		replicator = NewReplicator(config, clusters.Default.Client, maintenance)
+		go replicator.Run(ctx)
+
+		tokens := NewTokenStore(config, clusters.Default.Client)
+
+		limiter := NewRateLimiter(config.Server.RateLimits)
+		go limiter.Run(ctx)
+
+		terminator, terminatorErr := NewTerminator(ctx, config.Termination)
+		if terminatorErr != nil {
+			err = terminatorErr
+			return
+		}
+
+		handlers, terminateCh := GetHandlers(config, clusters, notifier, maintenance, replicator, tokens, limiter, drainer, terminator)
+
+		//Load balancers probe the readiness without credentials and shouldn't be rate limited
+		router.GET("/ready", handlers.GetReadiness)
+
+		router.Use(limiter.LimitIp())
+		if len(accounts) > 0 || verifier != nil || tokens != nil {
+			registerRoutes(router.Group("/", getAuthMiddleware(accounts, verifier, tokens), limiter.LimitUser()), handlers, config)
 		} else {
-			router.PUT("/lock", handlers.AcquireLock)
-			router.DELETE("/lock", handlers.ReleaseLock)
-			router.GET("/state", handlers.GetState)
-			router.PUT("/state", handlers.UpsertState)
-			router.DELETE("/state", handlers.DeleteState)
-			router.GET("/health", handlers.GetHealth)
-			if config.RemoteTerminiation {
+			registerRoutes(router, handlers, config)
+		}
+
+		adminDoneCh := make(chan error)
+		if config.RemoteTermination {
+			if config.Termination.TokenFile == "" {
+				fmt.Println("Warning: remote termination is enabled without a token. Any request from localhost, including requests forwarded by a proxy on the same host, can terminate the process")
+			}
+			if config.Termination.Address == "" {
 				router.POST("/termination", handlers.Terminate)
+			} else {
+				adminRouter := gin.Default()
+				adminRouter.POST("/termination", handlers.Terminate)
+				adminServer = &http.Server{
+					Addr:    config.Termination.Address,
+					Handler: adminRouter,
+				}
+				go func() {
+					defer close(adminDoneCh)
+					adminErr := adminServer.ListenAndServe()
+					if adminErr != nil && adminErr != http.ErrServerClosed {
+						adminDoneCh <- adminErr
+					}
+				}()
 			}
 		}
 
+		server = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", config.Server.Address, config.Server.Port),
+			Handler: router,
+		}
 		serverDoneCh := make(chan error)
 		go func() {
 			defer close(serverDoneCh)
@@ -121,9 +277,9 @@ func Serve(config Config, doneCh <-chan struct{}) <-chan error {
 		select{
 		case <-terminateCh:
 		case serverErr := <-serverDoneCh:
-			if serverErr != nil {
-				errCh <- serverErr
-			}
+			err = serverErr
+		case adminErr := <-adminDoneCh:
+			err = adminErr
 		case <-doneCh:
 		}
 	}()
@@ -138,6 +294,15 @@ func main() {
 		os.Exit(1)	
 	}
 
+	if len(os.Args) > 1 {
+		cmdErr := RunCommand(config, os.Args[1], os.Args[2:])
+		if cmdErr != nil {
+			fmt.Println(cmdErr.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
@@ -1,14 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"os"
 	"net/http"
+	"net/http/httptest"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
 	"github.com/Ferlab-Ste-Justine/etcd-sdk/testutils"
+	"github.com/gin-gonic/gin"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func TestServe(t *testing.T) {
@@ -73,7 +99,7 @@ func TestServe(t *testing.T) {
 			Clear: false,
 			AddSlash: false,
 		},
-		RemoteTerminiation: false,
+		RemoteTermination: false,
 	}, doneCh)
 
 	defer func() {
@@ -231,4 +257,2584 @@ func TestServe(t *testing.T) {
 		t.Errorf("A password file that should not have existed if terraform destroy ran successfully did exist")
 		return
 	}
-}
\ No newline at end of file
+}
+func TestResolveStatePrefix(t *testing.T) {
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+
+	for _, namespace := range []string{"/tb", "/tb/"} {
+		keyLayout.Namespace = namespace
+
+		prefix, prefixErr := resolveStatePrefix("")
+		if prefixErr != nil {
+			t.Errorf("Error resolving an empty prefix: %s", prefixErr.Error())
+			return
+		}
+		if prefix != "/tb/" {
+			t.Errorf("Expected the empty prefix to resolve to /tb/ with namespace %s and got %s", namespace, prefix)
+		}
+		if strings.HasPrefix("/tb2/a/lock", prefix) {
+			t.Errorf("The empty prefix with namespace %s matches a sibling namespace", namespace)
+		}
+
+		prefix, prefixErr = resolveStatePrefix("team-a/")
+		if prefixErr != nil || prefix != "/tb/team-a/" {
+			t.Errorf("Expected the team-a/ prefix to resolve to /tb/team-a/ with namespace %s and got %s", namespace, prefix)
+		}
+	}
+
+	keyLayout.Namespace = ""
+	prefix, prefixErr := resolveStatePrefix("")
+	if prefixErr != nil || prefix != "" {
+		t.Errorf("Expected the empty prefix to resolve to an empty prefix without namespace and got %s", prefix)
+	}
+
+	for _, invalid := range []string{"a//b", "a/../b", "a/lock/b", "./a"} {
+		_, prefixErr = resolveStatePrefix(invalid)
+		if prefixErr != ErrInvalidStateName {
+			t.Errorf("Expected prefix %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestKeySuffixValidation(t *testing.T) {
+	for _, suffix := range []string{"/info", "/chunks", "/chunks-v2", "/lock-queue", "/a/b", "/.."} {
+		_, confErr := LoadTestConfig(fmt.Sprintf("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\nkeys:\n  state_suffix: %s\n", suffix), t)
+		if confErr == nil {
+			t.Errorf("Expected state suffix %s to be rejected", suffix)
+		}
+	}
+
+	conf, confErr := LoadTestConfig("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\nkeys:\n  state_suffix: /tfstate\n", t)
+	if confErr != nil {
+		t.Errorf("Error loading a configuration with a valid state suffix: %s", confErr.Error())
+		return
+	}
+	if conf.Keys.StateSuffix != "/tfstate" || conf.Keys.LockSuffix != "/lock" {
+		t.Errorf("Key suffixes were not loaded as expected")
+	}
+}
+
+func TestReplicatorConnectsLazily(t *testing.T) {
+	config := Config{
+		Replication: ConfigReplication{
+			Secondary: ConfigEtcdClient{
+				Endpoints: []string{"127.0.0.1:1"},
+				ConnectionTimeout: time.Second,
+				RequestTimeout: time.Second,
+			},
+		},
+	}
+
+	if NewReplicator(Config{}, nil, nil) != nil {
+		t.Errorf("Expected no replicator without a secondary cluster")
+	}
+
+	replicator := NewReplicator(config, nil, nil)
+	if replicator == nil {
+		t.Errorf("Expected a replicator to be created without connecting to the secondary cluster")
+		return
+	}
+
+	_, statusErr := replicator.Status()
+	if statusErr != ErrSecondaryNotConnected {
+		t.Errorf("Expected the status of an unconnected replicator to report it")
+	}
+
+	replicator.Close()
+	replicator.Close()
+}
+
+func TestClusterOverlap(t *testing.T) {
+	defaultCluster := &Cluster{Name: defaultClusterName}
+	teamA := &Cluster{Name: "team-a", Prefixes: []string{"/tb/team-a/"}}
+	teamAProd := &Cluster{Name: "team-a-prod", Prefixes: []string{"/tb/team-a/prod/"}}
+	clusters := &ClusterSet{Default: defaultCluster, Clusters: []*Cluster{defaultCluster, teamA, teamAProd}}
+
+	getNames := func(prefix string) string {
+		names := []string{}
+		for _, cluster := range clusters.GetOverlapping(prefix) {
+			names = append(names, cluster.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for prefix, expected := range map[string]string{
+		"": "default,team-a,team-a-prod",
+		"/tb/": "default,team-a,team-a-prod",
+		"/tb/team-a/": "team-a,team-a-prod",
+		"/tb/team-a/dev/": "team-a",
+		"/tb/team-a/prod/network": "team-a-prod",
+		"/tb/team-b/": "default",
+	} {
+		if names := getNames(prefix); names != expected {
+			t.Errorf("Expected prefix %s to overlap clusters %s and got %s", prefix, expected, names)
+		}
+	}
+
+	if !clusters.Routes("/tb/team-a/prod/network", teamAProd) || clusters.Routes("/tb/team-a/prod/network", teamA) || clusters.Routes("/tb/team-a/prod/network", defaultCluster) {
+		t.Errorf("Expected a state to only be routed to the cluster with the longest matching prefix")
+	}
+}
+
+func TestWatchEventIds(t *testing.T) {
+	single := []*Cluster{&Cluster{Name: defaultClusterName}}
+	several := []*Cluster{&Cluster{Name: defaultClusterName}, &Cluster{Name: "team-a"}}
+
+	revisions, revisionsErr := getWatchStartRevisions("41", single)
+	if revisionsErr != nil || revisions[defaultClusterName] != 42 {
+		t.Errorf("Expected a single cluster watch to resume after the revision of the last event id")
+	}
+
+	_, revisionsErr = getWatchStartRevisions("41", several)
+	if revisionsErr == nil {
+		t.Errorf("Expected a plain revision to be rejected when several clusters are watched")
+	}
+
+	revisions, revisionsErr = getWatchStartRevisions("default=41,team-a=7", several)
+	if revisionsErr != nil || revisions[defaultClusterName] != 42 || revisions["team-a"] != 8 {
+		t.Errorf("Expected a watch of several clusters to resume after the revision of each cluster")
+	}
+
+	for _, invalid := range []string{"other=3", "default=-1", "default=a", "default"} {
+		_, revisionsErr = getWatchStartRevisions(invalid, several)
+		if revisionsErr == nil {
+			t.Errorf("Expected last event id %s to be rejected", invalid)
+		}
+	}
+
+	revisions, _ = getWatchStartRevisions("", several)
+	if len(revisions) != 0 {
+		t.Errorf("Expected a new watch to have no start revisions")
+	}
+
+	if id := getWatchEventId(map[string]int64{defaultClusterName: 41}, single); id != "41" {
+		t.Errorf("Expected the event id of a single cluster watch to be the revision and got %s", id)
+	}
+
+	if id := getWatchEventId(map[string]int64{defaultClusterName: 41, "team-a": 7}, several); id != "default=41,team-a=7" {
+		t.Errorf("Expected the event id of a watch of several clusters to list their revisions and got %s", id)
+	}
+}
+
+func TestMaintenanceGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var nilMaintenance *Maintenance
+	if nilMaintenance.Enabled() {
+		t.Errorf("Expected tasks without a maintenance mode to never be paused")
+	}
+
+	for retryAfter, expected := range map[time.Duration]string{
+		500 * time.Millisecond: "1",
+		1500 * time.Millisecond: "2",
+		time.Minute: "60",
+	} {
+		maintenance := NewMaintenance(ConfigMaintenance{Enabled: true, Message: "upgrading", RetryAfter: retryAfter}, nil)
+		if !maintenance.Enabled() {
+			t.Errorf("Expected the maintenance mode of the configuration to apply until it is set")
+		}
+
+		called := false
+		handler := maintenance.Guard(func(c *gin.Context) { called = true })
+
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPut, "/state?state=a", nil)
+		handler(c)
+		if called || recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected writes to be rejected in maintenance mode")
+		}
+		if header := recorder.Header().Get("Retry-After"); header != expected {
+			t.Errorf("Expected a Retry-After header of %s for a delay of %s and got %s", expected, retryAfter.String(), header)
+		}
+
+		maintenance.apply(MaintenanceStatus{Enabled: false})
+		recorder = httptest.NewRecorder()
+		c, _ = gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPut, "/state?state=a", nil)
+		handler(c)
+		if !called {
+			t.Errorf("Expected writes to be accepted once the maintenance mode is disabled")
+		}
+		if maintenance.Status().Message != "upgrading" {
+			t.Errorf("Expected the message of the configuration to be kept when the mode has none")
+		}
+	}
+}
+
+func TestMaintenancePrecedence(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	key := "/terraform-backend-etcd/maintenance"
+	_, putErr := cli.PutKey(key, `{"enabled": true, "message": "upgrading"}`)
+	if putErr != nil {
+		t.Errorf("Error storing the maintenance mode: %s", putErr.Error())
+		return
+	}
+
+	maintenance := NewMaintenance(ConfigMaintenance{Enabled: false, Key: key}, cli)
+	if maintenance.Enabled() || maintenance.Status().Source != MaintenanceSourceConfig {
+		t.Errorf("Expected the mode of the configuration to apply before the stored mode is loaded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go maintenance.Run(ctx)
+
+	waitForStatus := func(enabled bool, source string) bool {
+		for idx := 0; idx < 50; idx++ {
+			status := maintenance.Status()
+			if status.Enabled == enabled && status.Source == source {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitForStatus(true, MaintenanceSourceStored) {
+		t.Errorf("Expected the stored mode to take precedence over the configuration: %v", maintenance.Status())
+		return
+	}
+
+	status, resetErr := maintenance.Reset()
+	if resetErr != nil {
+		t.Errorf("Error resetting the maintenance mode: %s", resetErr.Error())
+		return
+	}
+	if status.Enabled || status.Source != MaintenanceSourceConfig {
+		t.Errorf("Expected the mode of the configuration to apply once the stored mode is reset: %v", status)
+	}
+	stored, getErr := cli.GetKey(key, client.GetKeyOptions{})
+	if getErr != nil || stored.Found() {
+		t.Errorf("Expected the stored mode to be removed")
+	}
+	if !waitForStatus(false, MaintenanceSourceConfig) {
+		t.Errorf("Expected the mode of the configuration to still apply after the watch sees the reset: %v", maintenance.Status())
+	}
+}
+
+func TestLockQueueOrdering(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Lock: ConfigLock{Timeout: 5 * time.Second, RetryInterval: 100 * time.Millisecond}}
+	state := "/queue-ordering"
+
+	holder, alreadyLocked, lockErr := acquireLockInQueue(context.Background(), cli, state, 60, time.Second, config)
+	if lockErr != nil || alreadyLocked {
+		t.Errorf("Expected a free lock to be acquired")
+		return
+	}
+
+	waiterCh := make(chan error)
+	go func() {
+		_, waiterLocked, waiterErr := acquireLockInQueue(context.Background(), cli, state, 60, 10*time.Second, config)
+		if waiterLocked {
+			waiterErr = errors.New("Waiter did not acquire the lock")
+		}
+		waiterCh <- waiterErr
+	}()
+	time.Sleep(time.Second)
+
+	_, revokeErr := cli.Client.Revoke(context.Background(), holder.Lease)
+	if revokeErr != nil {
+		t.Errorf("Error releasing the lock: %s", revokeErr.Error())
+		return
+	}
+
+	_, alreadyLocked, lockErr = acquireLockInQueue(context.Background(), cli, state, 60, time.Second, config)
+	if !alreadyLocked {
+		t.Errorf("Expected a client arriving after a waiter to not acquire the lock ahead of it")
+	}
+
+	waiterErr := <-waiterCh
+	if waiterErr != nil {
+		t.Errorf("Expected the waiter to acquire the lock once it was released: %s", waiterErr.Error())
+	}
+}
+
+func TestLockQueueCancellation(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Lock: ConfigLock{Timeout: 5 * time.Second, RetryInterval: 100 * time.Millisecond}}
+	state := "/queue-cancellation"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	lock, _, lockErr := acquireLockInQueue(ctx, cli, state, 60, time.Second, config)
+	if lock != nil || lockErr != context.Canceled {
+		t.Errorf("Expected the lock acquisition of a cancelled request to fail")
+	}
+
+	_, readErr := readLock(cli, state)
+	if readErr != ErrLockNotFound {
+		t.Errorf("Expected the lock acquired for a cancelled request to be released")
+	}
+}
+
+func TestLockRenewal(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Lock: ConfigLock{Timeout: 5 * time.Second, RetryInterval: 100 * time.Millisecond}}
+
+	lock, _, lockErr := acquireLockInQueue(context.Background(), cli, "/renewal", 60, time.Second, config)
+	if lockErr != nil {
+		t.Errorf("Error acquiring lock: %s", lockErr.Error())
+		return
+	}
+	putErr := putLockHolder(cli, "/renewal", lock, []byte(`{"ID":"holder-id"}`))
+	if putErr != nil {
+		t.Errorf("Error storing lock information: %s", putErr.Error())
+		return
+	}
+
+	_, renewErr := renewLock(cli, "/renewal", "other-id")
+	if renewErr != ErrLockMismatch {
+		t.Errorf("Expected the renewal of a lock with another id to be refused")
+	}
+
+	for _, id := range []string{"holder-id", ""} {
+		ttl, renewErr := renewLock(cli, "/renewal", id)
+		if renewErr != nil || ttl != 60 {
+			t.Errorf("Expected the renewal of a lock with id '%s' to reset its ttl", id)
+		}
+	}
+
+	_, _, lockErr = acquireLockInQueue(context.Background(), cli, "/renewal-without-holder", 60, time.Second, config)
+	if lockErr != nil {
+		t.Errorf("Error acquiring lock: %s", lockErr.Error())
+		return
+	}
+
+	_, renewErr = renewLock(cli, "/renewal-without-holder", "holder-id")
+	if renewErr != ErrLockMismatch {
+		t.Errorf("Expected the renewal of a lock with an id that cannot be checked to be refused")
+	}
+
+	_, renewErr = renewLock(cli, "/renewal-missing", "")
+	if renewErr != ErrLockNotFound {
+		t.Errorf("Expected the renewal of a missing lock to report it")
+	}
+
+	keepLockAlive(cli, "/renewal", "")()
+}
+
+func TestLockTtl(t *testing.T) {
+	config := Config{
+		Lock: ConfigLock{
+			MaxTtl: 300 * time.Second,
+			Policies: []ConfigLockPolicy{
+				ConfigLockPolicy{Prefix: "/prod", DefaultTtl: 120 * time.Second, MinTtl: 60 * time.Second, MaxTtl: 240 * time.Second, AllowOverride: true},
+				ConfigLockPolicy{Prefix: "/prod/network", DefaultTtl: 90 * time.Second},
+			},
+		},
+	}
+
+	for state, expected := range map[string]int64{
+		"/prod": 120,
+		"/prod/app": 120,
+		"/prod/network": 90,
+		"/prod/network/vpc": 90,
+		"/production/app": 300,
+		"/dev/app": 300,
+	} {
+		ttl, ttlErr := getLockTtl(state, "", config)
+		if ttlErr != nil || ttl != expected {
+			t.Errorf("Expected a default ttl of %d for state %s and got %d", expected, state, ttl)
+		}
+	}
+
+	for _, requested := range []string{"0", "-5", "a", "30", "250"} {
+		_, ttlErr := getLockTtl("/prod/app", requested, config)
+		if ttlErr == nil {
+			t.Errorf("Expected a ttl of %s to be refused by the policy of /prod", requested)
+		}
+	}
+
+	ttl, ttlErr := getLockTtl("/prod/app", "200", config)
+	if ttlErr != nil || ttl != 200 {
+		t.Errorf("Expected a ttl within the policy of /prod to be accepted")
+	}
+
+	_, ttlErr = getLockTtl("/prod/network", "100", config)
+	if ttlErr == nil {
+		t.Errorf("Expected a ttl override to be refused by a policy that doesn't allow it")
+	}
+
+	_, ttlErr = getLockTtl("/dev/app", "400", config)
+	if ttlErr == nil {
+		t.Errorf("Expected a ttl above the maximum ttl to be refused")
+	}
+}
+
+func TestLockPolicyValidation(t *testing.T) {
+	for _, policies := range []string{
+		"max_ttl: 5m\n  policies:\n    - prefix: /prod\n      default_ttl: 10m",
+		"max_ttl: 5m\n  policies:\n    - prefix: /prod\n      default_ttl: 6m\n      max_ttl: 10m",
+		"max_ttl: 5m\n  policies:\n    - prefix: /prod\n      min_ttl: 6m",
+		"policies:\n    - prefix: /prod\n      default_ttl: 1m\n      min_ttl: 2m",
+		"policies:\n    - prefix: /prod\n      default_ttl: 1m\n      max_ttl: 30s",
+		"policies:\n    - prefix: /prod\n    - prefix: /prod",
+	} {
+		_, confErr := LoadTestConfig(fmt.Sprintf("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\nlock:\n  %s\n", policies), t)
+		if confErr == nil {
+			t.Errorf("Expected lock configuration to be rejected:\n%s", policies)
+		}
+	}
+
+	conf, confErr := LoadTestConfig("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\nlock:\n  max_ttl: 15m\n  policies:\n    - prefix: /prod\n", t)
+	if confErr != nil {
+		t.Errorf("Error loading a valid lock configuration: %s", confErr.Error())
+		return
+	}
+	if conf.Lock.Policies[0].DefaultTtl != 600 * time.Second {
+		t.Errorf("Expected lock policies to default to a ttl of 600 seconds")
+	}
+}
+
+func TestPermissionPrefixes(t *testing.T) {
+	permission := Permission{Prefixes: []string{"/ns/team-a"}, Operations: []string{OperationRead}}
+
+	for key, expected := range map[string]bool{
+		"/ns/team-a": true,
+		"/ns/team-a/network": true,
+		"/ns/team-ab": false,
+		"/ns/team-ab/network": false,
+		"/ns": false,
+	} {
+		if permission.Allows(OperationRead, key, false) != expected {
+			t.Errorf("Expected a permission on /ns/team-a to allow state %s: %t", key, expected)
+		}
+	}
+
+	for prefix, expected := range map[string]bool{
+		"/ns/team-a/": true,
+		"/ns/team-a/net": true,
+		"/ns/team-a": false,
+		"/ns/team": false,
+		"/ns/": false,
+	} {
+		if permission.Allows(OperationRead, prefix, true) != expected {
+			t.Errorf("Expected a permission on /ns/team-a to allow prefix %s: %t", prefix, expected)
+		}
+	}
+
+	if permission.Allows(OperationWrite, "/ns/team-a/network", false) {
+		t.Errorf("Expected a read permission to not allow writes")
+	}
+
+	trailing := Permission{Prefixes: []string{"/ns/team-a/"}}
+	if !trailing.Allows(OperationWrite, "/ns/team-a/network", false) || !trailing.Allows(OperationWrite, "/ns/team-a/", true) || trailing.Allows(OperationWrite, "/ns/team-ab", false) {
+		t.Errorf("Expected a permission on /ns/team-a/ to only cover the states under it")
+	}
+
+	all := Permission{}
+	if !all.Allows(OperationAdmin, "", true) {
+		t.Errorf("Expected a permission without prefixes and operations to allow everything")
+	}
+}
+
+func signTestJwt(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func getTestJwks(key *rsa.PrivateKey, kid string) []byte {
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"alg": "RS256",
+				"n": base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			},
+		},
+	})
+	return jwks
+}
+
+func TestJwtVerification(t *testing.T) {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Errorf("Error generating key: %s", keyErr.Error())
+		return
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwksPath := path.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksPath, getTestJwks(key, "key-1"), 0600)
+
+	verifier, verifierErr := NewJwtVerifier(ConfigJwt{
+		JwksFile: jwksPath,
+		JwksRefreshInterval: time.Hour,
+		Issuer: "https://issuer",
+		Audience: "terraform-backend",
+		Permissions: []ConfigJwtPermission{
+			ConfigJwtPermission{Claim: "groups", Values: []string{"team-a"}, Permission: Permission{Prefixes: []string{"/team-a"}, Operations: []string{OperationRead}}},
+			ConfigJwtPermission{Claim: "groups", Values: []string{"ops"}, Permission: Permission{Operations: []string{OperationAdmin}}},
+		},
+	})
+	if verifierErr != nil {
+		t.Errorf("Error creating jwt verifier: %s", verifierErr.Error())
+		return
+	}
+
+	now := time.Now().Unix()
+	getClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "pipeline",
+			"iss": "https://issuer",
+			"aud": []string{"terraform-backend"},
+			"exp": now + 300,
+			"groups": []string{"team-a"},
+		}
+		for claim, value := range overrides {
+			if value == nil {
+				delete(claims, claim)
+				continue
+			}
+			claims[claim] = value
+		}
+		return claims
+	}
+
+	principal, authErr := verifier.Authenticate(signTestJwt(key, "key-1", getClaims(nil)))
+	if authErr != nil {
+		t.Errorf("Expected a valid jwt to be accepted: %s", authErr.Error())
+		return
+	}
+	if principal.Name != "pipeline" || !principal.Allows(OperationRead, "/team-a/network", false) || principal.Allows(OperationAdmin, "/", true) {
+		t.Errorf("Expected the permissions of a jwt to be mapped from its claims")
+	}
+
+	for description, token := range map[string]string{
+		"expired": signTestJwt(key, "key-1", getClaims(map[string]interface{}{"exp": now - 120})),
+		"without expiry": signTestJwt(key, "key-1", getClaims(map[string]interface{}{"exp": nil})),
+		"not valid yet": signTestJwt(key, "key-1", getClaims(map[string]interface{}{"nbf": now + 120})),
+		"from another issuer": signTestJwt(key, "key-1", getClaims(map[string]interface{}{"iss": "https://other"})),
+		"for another audience": signTestJwt(key, "key-1", getClaims(map[string]interface{}{"aud": "other"})),
+		"signed with another key": signTestJwt(otherKey, "key-1", getClaims(nil)),
+		"signed with an unknown key": signTestJwt(key, "key-2", getClaims(nil)),
+		"tampered": signTestJwt(key, "key-1", getClaims(nil)) + "a",
+	} {
+		_, authErr = verifier.Authenticate(token)
+		if authErr == nil {
+			t.Errorf("Expected a jwt %s to be refused", description)
+		}
+	}
+}
+
+func TestJwksReloadDoesNotBlock(t *testing.T) {
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Errorf("Error generating key: %s", keyErr.Error())
+		return
+	}
+
+	blockCh := make(chan struct{})
+	var served int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&served, 1) > 1 {
+			<-blockCh
+		}
+		w.Write(getTestJwks(key, "key-1"))
+	}))
+	defer server.Close()
+	defer close(blockCh)
+
+	verifier, verifierErr := NewJwtVerifier(ConfigJwt{JwksUrl: server.URL, JwksRefreshInterval: time.Hour})
+	if verifierErr != nil {
+		t.Errorf("Error creating jwt verifier: %s", verifierErr.Error())
+		return
+	}
+
+	//Make the keys stale so that the next request reloads them from the blocked url
+	verifier.lock.Lock()
+	verifier.loadedAt = time.Now().Add(-2 * time.Hour)
+	verifier.lock.Unlock()
+
+	go verifier.getKey("key-1")
+	time.Sleep(200 * time.Millisecond)
+
+	doneCh := make(chan error)
+	go func() {
+		_, getErr := verifier.getKey("key-1")
+		doneCh <- getErr
+	}()
+
+	select {
+	case getErr := <-doneCh:
+		if getErr != nil {
+			t.Errorf("Expected a known key to be returned during a reload: %s", getErr.Error())
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected a known key to be returned without waiting for a reload in progress")
+	}
+}
+
+func TestTokenGrants(t *testing.T) {
+	principal := &Principal{
+		Name: "ci",
+		Permissions: []Permission{
+			Permission{Prefixes: []string{"/team-a"}, Operations: []string{OperationRead, OperationWrite}},
+			Permission{Prefixes: []string{"/team-b/"}, Operations: []string{OperationAdmin}},
+		},
+	}
+
+	for description, expected := range map[string]struct {
+		permission Permission
+		granted    bool
+	}{
+		"same permission": {Permission{Prefixes: []string{"/team-a"}, Operations: []string{OperationRead, OperationWrite}}, true},
+		"narrower prefix": {Permission{Prefixes: []string{"/team-a/network"}, Operations: []string{OperationRead}}, true},
+		"fewer operations": {Permission{Prefixes: []string{"/team-a"}, Operations: []string{OperationWrite}}, true},
+		"sibling prefix": {Permission{Prefixes: []string{"/team-ab"}, Operations: []string{OperationRead}}, false},
+		"broader prefix": {Permission{Prefixes: []string{"/"}, Operations: []string{OperationRead}}, false},
+		"missing operation": {Permission{Prefixes: []string{"/team-a"}, Operations: []string{OperationLock}}, false},
+		"all operations": {Permission{Prefixes: []string{"/team-a"}}, false},
+		"all states": {Permission{Operations: []string{OperationRead}}, false},
+		"spanning two permissions": {Permission{Prefixes: []string{"/team-a", "/team-b/x"}, Operations: []string{OperationRead}}, false},
+		"admin under a prefix": {Permission{Prefixes: []string{"/team-b/x"}, Operations: []string{OperationAdmin}}, true},
+	} {
+		if principal.Grants(expected.permission) != expected.granted {
+			t.Errorf("Expected the %s to be granted: %t", description, expected.granted)
+		}
+	}
+
+	unrestricted := &Principal{Name: "admin", Unrestricted: true}
+	if !unrestricted.Grants(Permission{}) {
+		t.Errorf("Expected an unrestricted client to grant any permission")
+	}
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Set(principalContextKey, principal)
+	if checkGrants(c, []Permission{Permission{Prefixes: []string{"/team-a"}}}) || recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected a token broader than its creator to be refused with a 403 status code")
+	}
+
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	if !checkGrants(c, []Permission{Permission{}}) {
+		t.Errorf("Expected tokens to not be restricted when no authentication is configured")
+	}
+}
+
+func TestServeProbes(t *testing.T) {
+	_, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	currDir, _ := os.Getwd()
+	absCertsDir := path.Join(currDir, "test", "certificates", "certs")
+	confDir := t.TempDir()
+	os.WriteFile(path.Join(confDir, "accounts.yml"), []byte("admin: secret\n"), 0600)
+
+	configTemplate := `
+server:
+  port: 8081
+  address: "127.0.0.1"
+  basic_auth: "%s"
+  rate_limits:
+    per_user:
+      rate: 1
+termination:
+  token_file: "%s"
+etcd_client:
+  endpoints:
+    - "127.0.0.1:3379"
+    - "127.0.0.2:3379"
+    - "127.0.0.3:3379"
+  connection_timeout: "10s"
+  request_timeout: "10s"
+  retry_interval: "1s"
+  retries: 6
+  auth:
+    ca_cert: "%s"
+    client_cert: "%s"
+    client_key: "%s"
+`
+	loadConfig := func(tokenFile string) (Config, error) {
+		return LoadTestConfig(fmt.Sprintf(configTemplate, path.Join(confDir, "accounts.yml"), tokenFile, path.Join(absCertsDir, "etcd-ca.crt"), path.Join(absCertsDir, "etcd-root.crt"), path.Join(absCertsDir, "etcd-root.key")), t)
+	}
+
+	tokenFile := path.Join(confDir, "termination-token")
+	os.WriteFile(tokenFile, []byte("termination-secret"), 0600)
+	config, configErr := loadConfig(tokenFile)
+	if configErr != nil {
+		t.Errorf("Error loading the configuration: %s", configErr.Error())
+		return
+	}
+
+	doneCh := make(chan struct{})
+	errCh := Serve(config, doneCh)
+	defer func() {
+		close(doneCh)
+		err := <-errCh
+		if err != nil {
+			t.Errorf("Errors occured closing http server: %s", err.Error())
+		}
+	}()
+
+	cli := http.Client{}
+	res, getErr := cli.Get("http://127.0.0.1:8081/ready")
+	for waitIdx := 0; getErr != nil; waitIdx++ {
+		if waitIdx == 100 {
+			t.Errorf("Waiting too long on http server. Aborting")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		res, getErr = cli.Get("http://127.0.0.1:8081/ready")
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the readiness to be served without credentials, got status code %d", res.StatusCode)
+	}
+
+	for idx := 0; idx < 5; idx++ {
+		res, getErr = cli.Get("http://127.0.0.1:8081/ready")
+		if getErr != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("Expected the readiness to not be rate limited")
+			return
+		}
+		res.Body.Close()
+	}
+
+	res, getErr = cli.Get("http://127.0.0.1:8081/health")
+	if getErr != nil {
+		t.Errorf("Error getting the health: %s", getErr.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the other routes to require credentials, got status code %d", res.StatusCode)
+	}
+
+	//A startup error after the etcd clients are connected is reported once they are closed
+	failingConfig, configErr := loadConfig(path.Join(confDir, "missing-token"))
+	if configErr != nil {
+		t.Errorf("Error loading the configuration: %s", configErr.Error())
+		return
+	}
+	failingErrCh := Serve(failingConfig, make(chan struct{}))
+	select {
+	case err := <-failingErrCh:
+		if err == nil {
+			t.Errorf("Expected a missing termination token file to fail the startup")
+		}
+	case <-time.After(30 * time.Second):
+		t.Errorf("Expected a startup error to be reported")
+		return
+	}
+	if _, open := <-failingErrCh; open {
+		t.Errorf("Expected the error channel to be closed after a startup error")
+	}
+}
+
+func TestServeDrainDefault(t *testing.T) {
+	currDir, _ := os.Getwd()
+	testDir := path.Join(currDir, "test")
+	absCertsDir := path.Join(testDir, "certificates", "certs")
+
+	tearDown, launchErr := testutils.LaunchTestEtcdCluster(testDir, testutils.EtcdTestClusterOpts{
+		CaCertPath:     path.Join(absCertsDir, "etcd-ca.crt"),
+		ServerCertPath: path.Join(absCertsDir, "etcd-server.crt"),
+		ServerKeyPath:  path.Join(absCertsDir, "etcd-server.key"),
+	})
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer func() {
+		errs := tearDown()
+		if len(errs) > 0 {
+			t.Errorf("Errors occured tearing down etcd cluster: %s", errs[0].Error())
+		}
+	}()
+
+	//Built directly rather than loaded from a file, so without a drain timeout
+	doneCh := make(chan struct{})
+	errCh := Serve(Config{
+		EtcdClient: ConfigEtcdClient{
+			Endpoints:         []string{"127.0.0.1:3379", "127.0.0.2:3379", "127.0.0.3:3379"},
+			ConnectionTimeout: 10 * time.Second,
+			RequestTimeout:    10 * time.Second,
+			RetryInterval:     1 * time.Second,
+			Retries:           6,
+			Auth: ConfigEtcdAuth{
+				CaCert:     path.Join(absCertsDir, "etcd-ca.crt"),
+				ClientCert: path.Join(absCertsDir, "etcd-root.crt"),
+				ClientKey:  path.Join(absCertsDir, "etcd-root.key"),
+			},
+		},
+		Lock: ConfigLock{
+			Timeout:       5 * time.Second,
+			RetryInterval: 1 * time.Second,
+		},
+		Server: ConfigServer{
+			Port:    8082,
+			Address: "127.0.0.1",
+		},
+	}, doneCh)
+
+	cli := http.Client{}
+	res, getErr := cli.Get("http://127.0.0.1:8082/health")
+	for waitIdx := 0; getErr != nil || res.StatusCode != http.StatusOK; waitIdx++ {
+		if getErr == nil {
+			res.Body.Close()
+		}
+		if waitIdx == 100 {
+			t.Errorf("Waiting too long on http server. Aborting")
+			close(doneCh)
+			<-errCh
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		res, getErr = cli.Get("http://127.0.0.1:8082/health")
+	}
+	res.Body.Close()
+
+	//An upload in progress when the shutdown starts is given time to finish rather than aborted right away
+	content := `{"version": 4, "serial": 1, "lineage": "drain", "resources": []}`
+	bodyReader, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPut, "http://127.0.0.1:8082/state?state=/drain/default", bodyReader)
+	req.ContentLength = int64(len(content))
+	resCh := make(chan *http.Response, 1)
+	go func() {
+		uploadRes, uploadErr := cli.Do(req)
+		if uploadErr != nil {
+			t.Errorf("Error uploading the state: %s", uploadErr.Error())
+		}
+		resCh <- uploadRes
+	}()
+
+	bodyWriter.Write([]byte(content[:10]))
+	time.Sleep(300 * time.Millisecond)
+	close(doneCh)
+	time.Sleep(300 * time.Millisecond)
+	bodyWriter.Write([]byte(content[10:]))
+	bodyWriter.Close()
+
+	uploadRes := <-resCh
+	if uploadRes != nil {
+		uploadRes.Body.Close()
+		if uploadRes.StatusCode != http.StatusOK {
+			t.Errorf("Expected the upload to complete during the shutdown, got status code %d", uploadRes.StatusCode)
+		}
+	}
+
+	err := <-errCh
+	if err != nil {
+		t.Errorf("Errors occured closing http server: %s", err.Error())
+	}
+}
+
+func TestFsck(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	content := `{"version": 4, "serial": 1, "lineage": "fsck", "resources": []}`
+	for _, state := range []string{"/fsck/consistent", "/fsck/inconsistent"} {
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(content), int64(len(content)), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error writing state %s: %s", state, putErr.Error())
+			return
+		}
+	}
+
+	info, _, infoErr := getStateInfo(cli, "/fsck/inconsistent")
+	if infoErr != nil || info == nil {
+		t.Errorf("Error getting the metadata of the state")
+		return
+	}
+	deleteErr := cli.DeleteKey(fmt.Sprintf("%s0", getStateChunkPrefix("/fsck/inconsistent", info.Version)))
+	if deleteErr != nil {
+		t.Errorf("Error deleting a chunk: %s", deleteErr.Error())
+		return
+	}
+
+	report, checkErr := checkStates(cli, "/fsck/", FsckOptions{})
+	if checkErr != nil {
+		t.Errorf("Error checking the states: %s", checkErr.Error())
+		return
+	}
+	if report.Inconsistent != 1 || len(report.States) != 2 {
+		t.Errorf("Expected one of the two states to be reported as inconsistent")
+		return
+	}
+	for _, stateReport := range report.States {
+		if stateReport.Consistent != (stateReport.State == "/fsck/consistent") {
+			t.Errorf("Expected state %s to be consistent: %t", stateReport.State, !stateReport.Consistent)
+		}
+	}
+
+	fsckErr := fsckCommand(Config{}, cli, []string{"--prefix", "/fsck/"})
+	if fsckErr == nil {
+		t.Errorf("Expected the fsck command to fail when inconsistent states are found")
+	}
+}
+
+func TestFsckRepair(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	states := []string{"/fsck/orphaned", "/fsck/backup", "/fsck/lost"}
+	contents := map[string]string{}
+	versions := map[string]int64{}
+	for _, state := range states {
+		contents[state] = fmt.Sprintf(`{"version": 4, "serial": 1, "lineage": "%s", "resources": []}`, state)
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(contents[state]), int64(len(contents[state])), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error writing state %s: %s", state, putErr.Error())
+			return
+		}
+
+		info, _, infoErr := getStateInfo(cli, state)
+		if infoErr != nil || info == nil {
+			t.Errorf("Error getting the metadata of state %s", state)
+			return
+		}
+		versions[state] = info.Version
+	}
+
+	//Leave the chunks of the first version of a state behind, as a failed write would, then corrupt every state
+	for _, state := range states {
+		update := fmt.Sprintf(`{"version": 4, "serial": 2, "lineage": "%s", "resources": []}`, state)
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(update), int64(len(update)), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error updating state %s: %s", state, putErr.Error())
+			return
+		}
+		if state == "/fsck/orphaned" {
+			_, orphanErr := cli.PutKey(fmt.Sprintf("%s0", getStateChunkPrefix(state, versions[state])), contents[state])
+			if orphanErr != nil {
+				t.Errorf("Error writing an orphaned chunk: %s", orphanErr.Error())
+				return
+			}
+		}
+
+		info, _, infoErr := getStateInfo(cli, state)
+		if infoErr != nil || info == nil {
+			t.Errorf("Error getting the metadata of state %s", state)
+			return
+		}
+		deleteErr := cli.DeleteKey(fmt.Sprintf("%s0", getStateChunkPrefix(state, info.Version)))
+		if deleteErr != nil {
+			t.Errorf("Error deleting a chunk: %s", deleteErr.Error())
+			return
+		}
+	}
+
+	//The most recent backup is not a valid state, so the one before it is restored
+	store := &directoryBackupStore{directory: t.TempDir()}
+	backups := map[string]string{
+		"20261001T000000Z-v1.tfstate": contents["/fsck/backup"],
+		"20261002T000000Z-v2.tfstate": "not a state",
+	}
+	for name, content := range backups {
+		backupErr := store.Put(getBackupStatePrefix("/fsck/backup")+name, []byte(content))
+		if backupErr != nil {
+			t.Errorf("Error writing a backup: %s", backupErr.Error())
+			return
+		}
+	}
+
+	report, checkErr := checkStates(cli, "/fsck/", FsckOptions{Repair: true, Backups: store})
+	if checkErr != nil {
+		t.Errorf("Error checking the states: %s", checkErr.Error())
+		return
+	}
+	if report.Inconsistent != 3 || report.Repaired != 2 {
+		t.Errorf("Expected two of the three inconsistent states to be repaired: %d %d", report.Inconsistent, report.Repaired)
+	}
+
+	expectedSources := map[string]string{
+		"/fsck/orphaned": fmt.Sprintf("version %d", versions["/fsck/orphaned"]),
+		"/fsck/backup":   fmt.Sprintf("backup %s20261001T000000Z-v1.tfstate", getBackupStatePrefix("/fsck/backup")),
+		"/fsck/lost":     "",
+	}
+	for _, stateReport := range report.States {
+		if stateReport.RepairedFrom != expectedSources[stateReport.State] || stateReport.Repaired != (expectedSources[stateReport.State] != "") {
+			t.Errorf("Expected state %s to be repaired from '%s', got '%s'", stateReport.State, expectedSources[stateReport.State], stateReport.RepairedFrom)
+		}
+	}
+
+	for _, state := range []string{"/fsck/orphaned", "/fsck/backup"} {
+		content, _, readErr := readState(cli, state)
+		if readErr != nil {
+			t.Errorf("Error reading state %s: %s", state, readErr.Error())
+			continue
+		}
+		if string(content) != contents[state] {
+			t.Errorf("Expected state %s to be rolled back to its first version: %s", state, string(content))
+		}
+	}
+	orphanedKeys, keysErr := listKeys(cli, getStateChunkPrefix("/fsck/orphaned", versions["/fsck/orphaned"]))
+	if keysErr != nil || len(orphanedKeys) != 0 {
+		t.Errorf("Expected the chunks of the promoted version to be removed")
+	}
+
+	//States that could not be repaired still fail the command
+	fsckErr := fsckCommand(Config{}, cli, []string{"--prefix", "/fsck/", "--repair"})
+	if fsckErr == nil || !strings.Contains(fsckErr.Error(), "1 inconsistent") {
+		t.Errorf("Expected the fsck command to fail for the state that could not be repaired: %v", fsckErr)
+	}
+	fsckErr = fsckCommand(Config{}, cli, []string{"--prefix", "/fsck/orphaned"})
+	if fsckErr != nil {
+		t.Errorf("Expected the repaired state to be consistent: %s", fsckErr.Error())
+	}
+}
+
+func TestGcCommandGrace(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Gc: ConfigGc{Grace: 2 * time.Second}}
+	content := `{"version": 4, "serial": 1, "lineage": "gc", "resources": []}`
+	_, putErr := putState(context.Background(), cli, Config{}, nil, "/gc-grace/network", strings.NewReader(content), int64(len(content)), PutStateOptions{})
+	if putErr != nil {
+		t.Errorf("Error writing the state: %s", putErr.Error())
+		return
+	}
+	orphanKey := fmt.Sprintf("%s0", getStateChunkPrefix("/gc-grace/network", 9))
+	_, putErr = cli.PutKey(orphanKey, "orphan")
+	if putErr != nil {
+		t.Errorf("Error writing an orphaned chunk: %s", putErr.Error())
+		return
+	}
+	orphanExists := func() bool {
+		orphan, _ := cli.GetKey(orphanKey, client.GetKeyOptions{})
+		return orphan.Found()
+	}
+
+	start := time.Now()
+	gcErr := gcCommand(config, cli, []string{"--prefix", "/gc-grace/", "--dry-run"})
+	if gcErr != nil || time.Since(start) >= config.Gc.Grace || !orphanExists() {
+		t.Errorf("Expected a dry run to report right away without removing chunks: %v", gcErr)
+	}
+
+	start = time.Now()
+	gcErr = gcCommand(config, cli, []string{"--prefix", "/gc-grace/"})
+	if gcErr != nil {
+		t.Errorf("Error collecting garbage: %s", gcErr.Error())
+		return
+	}
+	if time.Since(start) < config.Gc.Grace || orphanExists() {
+		t.Errorf("Expected the gc command to wait for the grace of the gc configuration before removing chunks")
+	}
+
+	start = time.Now()
+	gcErr = gcCommand(config, cli, []string{"--prefix", "/gc-grace/"})
+	if gcErr != nil || time.Since(start) >= config.Gc.Grace {
+		t.Errorf("Expected the gc command not to wait when there are no chunks to remove: %v", gcErr)
+	}
+
+	cli.PutKey(orphanKey, "orphan")
+	start = time.Now()
+	gcErr = gcCommand(config, cli, []string{"--prefix", "/gc-grace/", "--grace", "0s"})
+	if gcErr != nil || time.Since(start) >= config.Gc.Grace || orphanExists() {
+		t.Errorf("Expected the grace flag to override the grace of the gc configuration: %v", gcErr)
+	}
+}
+
+func TestInternalKeys(t *testing.T) {
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+
+	config, configErr := LoadTestConfig("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\n", t)
+	if configErr != nil {
+		t.Errorf("Error loading the configuration: %s", configErr.Error())
+		return
+	}
+	setKeyLayout(config)
+
+	for _, key := range []string{"/terraform-backend-etcd/replication/lock", "/terraform-backend-etcd/gc/lock", "/terraform-backend-etcd/tokens/abc", "/terraform-backend-etcd/maintenance", "/terraform-backend-etcd/webhooks/1"} {
+		if !isInternalKey(key) {
+			t.Errorf("Expected %s to be an internal key", key)
+		}
+	}
+	for _, key := range []string{"/terraform/network/lock", "/terraform-backend-etcd/tokens-other/lock", "/terraform-backend-etcd/maintenance-window/lock"} {
+		if isInternalKey(key) {
+			t.Errorf("Expected %s not to be an internal key", key)
+		}
+	}
+
+	namespaced, _ := LoadTestConfig("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\nkeys:\n  namespace: /tb\n", t)
+	if namespaced.Gc.Prefix != "/tb/" {
+		t.Errorf("Expected the gc prefix to default to the namespace, got %s", namespaced.Gc.Prefix)
+	}
+}
+
+func TestGcSkipsForeignLocks(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+	setKeyLayout(Config{Replication: ConfigReplication{LockKey: "/gc-foreign/backend/replication/lock"}})
+
+	//A lock of a background task held for longer than the maximum age of locks and a foreign key with the lock suffix
+	_, _, acquireErr := cli.AcquireLock(client.AcquireLockOptions{Key: "/gc-foreign/backend/replication/lock", Ttl: 60, Timeout: time.Second})
+	if acquireErr != nil {
+		t.Errorf("Error acquiring the replication lock: %s", acquireErr.Error())
+		return
+	}
+	cli.PutKey("/gc-foreign/other/lock", "not a lock")
+	cli.PutKey("/gc-foreign/empty/lock", "{}")
+	time.Sleep(10 * time.Millisecond)
+
+	report, gcErr := collectGarbage(cli, GcOptions{Prefix: "/gc-foreign/", LockMaxAge: time.Millisecond})
+	if gcErr != nil {
+		t.Errorf("Expected foreign lock keys not to fail the collection: %s", gcErr.Error())
+		return
+	}
+	if len(report.Locks) != 0 {
+		t.Errorf("Expected internal and foreign locks not to be removed, got %v", report.Locks)
+	}
+	for _, key := range []string{"/gc-foreign/backend/replication/lock", "/gc-foreign/other/lock", "/gc-foreign/empty/lock"} {
+		info, _ := cli.GetKey(key, client.GetKeyOptions{})
+		if !info.Found() {
+			t.Errorf("Expected key %s to be left alone", key)
+		}
+	}
+}
+
+func TestBackupArchiveReplacement(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := path.Join(dir, "states.zip")
+	os.WriteFile(archivePath, []byte("previous backup"), 0600)
+
+	_, backupErr := backupStatesToFile(nil, "/", archivePath)
+	if backupErr == nil {
+		t.Errorf("Expected a backup with an unsupported extension to fail")
+	}
+
+	previous, _ := os.ReadFile(archivePath)
+	if string(previous) != "previous backup" {
+		t.Errorf("Expected a failed backup to leave the previous archive untouched")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected a failed backup to remove its temporary file")
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	content := `{"version": 4, "serial": 1, "lineage": "backup", "resources": []}`
+	_, putErr := putState(context.Background(), cli, Config{}, nil, "/backup/network", strings.NewReader(content), int64(len(content)), PutStateOptions{})
+	if putErr != nil {
+		t.Errorf("Error writing the state: %s", putErr.Error())
+		return
+	}
+
+	dir := t.TempDir()
+	archivePath := path.Join(dir, "states.tar.gz")
+	os.WriteFile(archivePath, []byte("previous backup"), 0600)
+
+	manifest, backupErr := backupStatesToFile(cli, "/backup/", archivePath)
+	if backupErr != nil {
+		t.Errorf("Error backing up the states: %s", backupErr.Error())
+		return
+	}
+	if len(manifest.States) != 1 {
+		t.Errorf("Expected the state to be backed up")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected the backup to only leave the archive behind")
+	}
+
+	report, restoreErr := restoreStatesFromFile(cli, archivePath, RestoreOptions{ToPrefix: "/restored/"})
+	if restoreErr != nil {
+		t.Errorf("Error restoring the states: %s", restoreErr.Error())
+		return
+	}
+
+	restored, _, readErr := readState(cli, "/restored/network")
+	if readErr != nil || string(restored) != content {
+		t.Errorf("Expected the backed up state to be restored under the new prefix: %v", report)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 7", "*/0 * * * *", "5-1 * * * *", "a * * * *", "0 0 31 2 *"} {
+		_, parseErr := parseCronSchedule(expr)
+		if parseErr == nil {
+			t.Errorf("Expected schedule %s to be refused", expr)
+		}
+	}
+
+	start := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC)
+	for expr, expected := range map[string]time.Time{
+		"* * * * *": time.Date(2024, time.March, 15, 10, 8, 0, 0, time.UTC),
+		"*/15 * * * *": time.Date(2024, time.March, 15, 10, 15, 0, 0, time.UTC),
+		"0 2 * * *": time.Date(2024, time.March, 16, 2, 0, 0, 0, time.UTC),
+		"0-30/10 10 * * *": time.Date(2024, time.March, 15, 10, 10, 0, 0, time.UTC),
+		"0 0 1 * *": time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC),
+		"30 6 * * 1-5": time.Date(2024, time.March, 18, 6, 30, 0, 0, time.UTC),
+		"0 0 1,20 * 0": time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *": time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC),
+	} {
+		schedule, parseErr := parseCronSchedule(expr)
+		if parseErr != nil {
+			t.Errorf("Error parsing schedule %s: %s", expr, parseErr.Error())
+			continue
+		}
+
+		next := schedule.Next(start)
+		if !next.Equal(expected) {
+			t.Errorf("Expected the run of schedule %s after %s to be at %s, got %s", expr, start, expected, next)
+		}
+	}
+
+	_, configErr := LoadTestConfig("backups:\n  interval: 1h\n  schedule: \"0 2 * * *\"\n  directory: /tmp\n", t)
+	if configErr == nil {
+		t.Errorf("Expected scheduled backups with both an interval and a schedule to be refused")
+	}
+}
+
+func TestBackupStatePrefix(t *testing.T) {
+	for state, expected := range map[string]string{
+		"/team-a/network": "%2Fteam-a%2Fnetwork/",
+		".": "%2E/",
+		"..": "%2E%2E/",
+		"...": ".../",
+		"a.b": "a.b/",
+	} {
+		if getBackupStatePrefix(state) != expected {
+			t.Errorf("Expected the backup prefix of state %s to be %s, got %s", state, expected, getBackupStatePrefix(state))
+		}
+	}
+
+	dir := t.TempDir()
+	store := &directoryBackupStore{directory: path.Join(dir, "backups")}
+	putErr := store.Put(getBackupStatePrefix("..")+"20240101T000000Z-v1.tfstate", []byte("{}"))
+	if putErr != nil {
+		t.Errorf("Error exporting a state: %s", putErr.Error())
+		return
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "backups" {
+		t.Errorf("Expected the export of state .. to stay in the backup directory")
+	}
+}
+
+/*
+Minimal s3 api storing objects in memory, without checking signatures
+*/
+func newFakeS3Server(bucket string) *httptest.Server {
+	var lock sync.Mutex
+	objects := map[string][]byte{}
+
+	type listEntry struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+	}
+	type listResult struct {
+		XMLName     xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string      `xml:"Name"`
+		Prefix      string      `xml:"Prefix"`
+		KeyCount    int         `xml:"KeyCount"`
+		MaxKeys     int         `xml:"MaxKeys"`
+		IsTruncated bool        `xml:"IsTruncated"`
+		Contents    []listEntry `xml:"Contents"`
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+bucket), "/")
+		switch {
+		case r.Method == http.MethodGet && key == "":
+			result := listResult{Name: bucket, Prefix: r.URL.Query().Get("prefix"), MaxKeys: 1000, Contents: []listEntry{}}
+			names := []string{}
+			for name := range objects {
+				if strings.HasPrefix(name, result.Prefix) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				result.Contents = append(result.Contents, listEntry{Key: name, Size: len(objects[name]), LastModified: "2024-01-01T00:00:00.000Z", ETag: "\"etag\""})
+			}
+			result.KeyCount = len(result.Contents)
+			output, _ := xml.Marshal(result)
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write(output)
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[key] = body
+			w.Header().Set("ETag", "\"etag\"")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+}
+
+func TestS3BackupStore(t *testing.T) {
+	server := newFakeS3Server("backups")
+	defer server.Close()
+
+	store, storeErr := newS3BackupStore(ConfigBackupS3{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Bucket: "backups",
+		Path: "terraform",
+		Region: "us-east-1",
+		Insecure: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+		RequestTimeout: 10 * time.Second,
+	})
+	if storeErr != nil {
+		t.Errorf("Error creating the s3 store: %s", storeErr.Error())
+		return
+	}
+
+	scheduler := &BackupScheduler{config: Config{Backups: ConfigBackups{Retention: 2}}, store: store}
+	state := "/team-a/network"
+	for version := 1; version <= 3; version++ {
+		name := fmt.Sprintf("%s20240101T00000%dZ-v%d.tfstate", getBackupStatePrefix(state), version, version)
+		putErr := store.Put(name, []byte("{}"))
+		if putErr != nil {
+			t.Errorf("Error exporting a state version: %s", putErr.Error())
+			return
+		}
+	}
+	store.Put(getBackupStatePrefix("/team-a/dns")+"20240101T000000Z-v7.tfstate", []byte("{}"))
+
+	lastVersion, lastErr := scheduler.getLastVersion(state)
+	if lastErr != nil || lastVersion != 3 {
+		t.Errorf("Expected the last exported version to be found in the store")
+	}
+
+	pruneErr := scheduler.prune(state)
+	if pruneErr != nil {
+		t.Errorf("Error pruning the exports: %s", pruneErr.Error())
+		return
+	}
+
+	names, listErr := store.List(getBackupStatePrefix(state))
+	if listErr != nil {
+		t.Errorf("Error listing the exports: %s", listErr.Error())
+		return
+	}
+	if len(names) != 2 || getBackupVersion(names[0]) != 2 || getBackupVersion(names[1]) != 3 {
+		t.Errorf("Expected the exports beyond the retention count to be pruned, got %v", names)
+	}
+
+	names, _ = store.List(getBackupStatePrefix("/team-a/dns"))
+	if len(names) != 1 {
+		t.Errorf("Expected the exports of other states to be left alone")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	receivedBody := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		receivedBody <- body
+	}))
+	defer server.Close()
+
+	notifier := &Notifier{http: &http.Client{Timeout: 5 * time.Second}}
+	sendErr := notifier.send(ConfigWebhook{Name: "ci", Url: server.URL, Secret: "secret"}, Event{Id: "1", Type: EventStateUpdated, State: "/team-a/network"})
+	if sendErr != nil {
+		t.Errorf("Error sending the event: %s", sendErr.Error())
+		return
+	}
+
+	req, body := <-received, <-receivedBody
+	timestamp := req.Header.Get("X-Webhook-Timestamp")
+	sentAt, parseErr := strconv.ParseInt(timestamp, 10, 64)
+	if parseErr != nil || time.Since(time.Unix(sentAt, 0)) > time.Minute {
+		t.Errorf("Expected the time of the delivery to be passed in a header, got %s", timestamp)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if req.Header.Get("X-Webhook-Signature") != expected {
+		t.Errorf("Expected the signature to cover the timestamp and the body")
+	}
+
+	if getWebhookSignature("secret", "1", body) == getWebhookSignature("secret", "2", body) {
+		t.Errorf("Expected a replayed body with another timestamp to have another signature")
+	}
+}
+
+func TestHeldLockScope(t *testing.T) {
+	for expected, prefixes := range map[string][]string{
+		"/team-": []string{"/team-a/", "/team-b/"},
+		"/team-a/": []string{"/team-a/", "/team-a/network"},
+		"": []string{"/team-a/", ""},
+		"/": []string{"/a", "/b"},
+	} {
+		if getCommonPrefix(prefixes) != expected {
+			t.Errorf("Expected the common prefix of %v to be %s, got %s", prefixes, expected, getCommonPrefix(prefixes))
+		}
+	}
+
+	notifier := &Notifier{config: Config{Webhooks: ConfigWebhooks{Endpoints: []ConfigWebhook{
+		ConfigWebhook{Name: "states", Events: []string{EventStateUpdated}},
+		ConfigWebhook{Name: "team-a", Events: []string{EventLockHeld}, Prefixes: []string{"/team-a/"}},
+		ConfigWebhook{Name: "team-b", Prefixes: []string{"/team-b/"}},
+	}}}}
+	prefixes := notifier.getHeldLockPrefixes()
+	if len(prefixes) != 2 || !hasAnyPrefix("/team-b/dns", prefixes) || hasAnyPrefix("/team-c/dns", prefixes) {
+		t.Errorf("Expected only the prefixes of the webhooks receiving lock held events to be checked, got %v", prefixes)
+	}
+}
+
+func TestListLocks(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Lock: ConfigLock{Timeout: 5 * time.Second, RetryInterval: 100 * time.Millisecond}}
+	content := `{"version": 4, "serial": 1, "lineage": "locks", "resources": []}`
+
+	//More states than fit in a single batch, each with a state whose chunks are not read when listing
+	leases := map[string]int64{}
+	for idx := 0; idx < lockListBatchSize+6; idx++ {
+		state := fmt.Sprintf("/list-locks/state-%03d", idx)
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(content), int64(len(content)), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error writing state %s: %s", state, putErr.Error())
+			return
+		}
+
+		lock, _, lockErr := acquireLockInQueue(context.Background(), cli, state, 60, time.Second, config)
+		if lockErr != nil {
+			t.Errorf("Error locking state %s: %s", state, lockErr.Error())
+			return
+		}
+		leases[state] = int64(lock.Lease)
+
+		holderErr := putLockHolder(cli, state, lock, []byte(fmt.Sprintf(`{"ID": "%d"}`, idx)))
+		if holderErr != nil {
+			t.Errorf("Error storing the lock holder of state %s: %s", state, holderErr.Error())
+			return
+		}
+	}
+
+	_, revokeErr := cli.Client.Revoke(context.Background(), clientv3.LeaseID(leases["/list-locks/state-000"]))
+	if revokeErr != nil {
+		t.Errorf("Error releasing a lock: %s", revokeErr.Error())
+		return
+	}
+
+	locks, listErr := listLocks(cli, "/list-locks/")
+	if listErr != nil {
+		t.Errorf("Error listing the locks: %s", listErr.Error())
+		return
+	}
+	if len(locks) != lockListBatchSize+5 {
+		t.Errorf("Expected the %d held locks to be listed, got %d", lockListBatchSize+5, len(locks))
+		return
+	}
+
+	for _, lock := range locks {
+		if lock.Lease != leases[lock.State] || lock.TtlRemaining <= 0 || lock.TtlRemaining > 60 {
+			t.Errorf("Expected the lease of the lock of state %s to be reported with its remaining ttl", lock.State)
+		}
+
+		var holder LockHolder
+		json.Unmarshal(lock.Holder, &holder)
+		if fmt.Sprintf("/list-locks/state-%03s", holder.ID) != lock.State {
+			t.Errorf("Expected the holder of the lock of state %s to be reported", lock.State)
+		}
+	}
+}
+
+func TestTerraformStatePeek(t *testing.T) {
+	content := `{"version": 4, "terraform_version": "1.9.0", "outputs": {"a": {"value": [1, 2]}}, "serial": 3, "lineage": "peek", "resources": []}`
+	header, reader, peekErr := peekTerraformState(strings.NewReader(content))
+	if peekErr != nil {
+		t.Errorf("Error peeking the state: %s", peekErr.Error())
+		return
+	}
+	if *header.Lineage != "peek" || *header.Serial != 3 {
+		t.Errorf("Expected the lineage and serial to be read, got %s and %d", *header.Lineage, *header.Serial)
+	}
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != content {
+		t.Errorf("Expected the returned reader to return the whole content")
+	}
+
+	for _, invalid := range []string{"", "not json", `{"version": 4, "serial": 3}`, `{"serial": "3", "lineage": "peek"}`, `[1, 2]`} {
+		_, reader, peekErr := peekTerraformState(strings.NewReader(invalid))
+		if peekErr != ErrNotTerraformState {
+			t.Errorf("Expected %s not to be a terraform state, got %v", invalid, peekErr)
+		}
+		rest, _ := io.ReadAll(reader)
+		if string(rest) != invalid {
+			t.Errorf("Expected the returned reader to return the whole content of %s", invalid)
+		}
+	}
+}
+
+func TestConsulImportEntries(t *testing.T) {
+	plain := `{"version": 4, "serial": 1, "lineage": "plain", "resources": []}`
+	chunkedContent := `{"version": 4, "serial": 2, "lineage": "chunked", "resources": []}`
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write([]byte(`{"version": 4, "serial": 3, "lineage": "compressed", "resources": []}`))
+	gzipWriter.Close()
+
+	kvs := []consulKvEntry{
+		{Key: "terraform/plain", Value: base64.StdEncoding.EncodeToString([]byte(plain))},
+		{Key: "terraform/plain/.lock", Value: base64.StdEncoding.EncodeToString([]byte("lock"))},
+		{Key: "terraform/plain/.lockinfo", Value: base64.StdEncoding.EncodeToString([]byte("{}"))},
+		{Key: "terraform/chunked", Value: base64.StdEncoding.EncodeToString([]byte(`{"hash": "abc", "chunks": ["terraform/chunked/tfstate.abc/0", "terraform/chunked/tfstate.abc/1"]}`))},
+		{Key: "terraform/chunked/tfstate.abc/0", Value: base64.StdEncoding.EncodeToString([]byte(chunkedContent[:20]))},
+		{Key: "terraform/chunked/tfstate.abc/1", Value: base64.StdEncoding.EncodeToString([]byte(chunkedContent[20:]))},
+		{Key: "terraform/plain-env:staging", Value: base64.StdEncoding.EncodeToString(compressed.Bytes())},
+	}
+	exportPath := path.Join(t.TempDir(), "export.json")
+	b, _ := json.Marshal(kvs)
+	os.WriteFile(exportPath, b, 0600)
+
+	entries, entriesErr := getConsulImportEntries(exportPath, "/consul")
+	if entriesErr != nil {
+		t.Errorf("Error getting the entries of the export: %s", entriesErr.Error())
+		return
+	}
+
+	expected := map[string]string{
+		"/consul/terraform/chunked":           "chunked",
+		"/consul/terraform/plain":             "plain",
+		"/consul/terraform/plain-env:staging": "compressed",
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d entries, got %d", len(expected), len(entries))
+		return
+	}
+	for _, entry := range entries {
+		header, parseErr := parseTerraformState(entry.Content)
+		if parseErr != nil || *header.Lineage != expected[entry.State] {
+			t.Errorf("Expected state %s to have the content of its consul key", entry.State)
+		}
+	}
+
+	kvs = append(kvs[:4], kvs[5:]...)
+	b, _ = json.Marshal(kvs)
+	os.WriteFile(exportPath, b, 0600)
+	_, entriesErr = getConsulImportEntries(exportPath, "/consul")
+	if entriesErr == nil {
+		t.Errorf("Expected an export with a missing chunk to be rejected")
+	}
+}
+
+func TestPutStateChecks(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	put := func(content string, opts PutStateOptions) (bool, error) {
+		return putState(context.Background(), cli, Config{}, nil, "/checks/network", strings.NewReader(content), int64(len(content)), opts)
+	}
+
+	initial := `{"version": 4, "serial": 2, "lineage": "checks", "resources": []}`
+	written, putErr := put(initial, PutStateOptions{})
+	if putErr != nil || !written {
+		t.Errorf("Expected the first version of the state to be written: %v", putErr)
+		return
+	}
+
+	written, putErr = put(initial, PutStateOptions{})
+	if putErr != nil || written {
+		t.Errorf("Expected an identical state not to be written again: %v", putErr)
+	}
+
+	rejected := map[string]error{
+		`{"version": 4, "serial": 3, "lineage": "other", "resources": []}`:    ErrLineageMismatch,
+		`{"version": 4, "serial": 1, "lineage": "checks", "resources": []}`:   ErrSerialNotNewer,
+		`{"version": 4, "serial": 2, "lineage": "checks", "resources": [{}]}`: ErrSerialConflict,
+		`{"version": 4, "resources": []}`:                                     ErrNotTerraformState,
+	}
+	for content, expectedErr := range rejected {
+		_, putErr = put(content, PutStateOptions{})
+		if putErr != expectedErr {
+			t.Errorf("Expected %s to be rejected with %v, got %v", content, expectedErr, putErr)
+		}
+	}
+
+	//Uploads of unknown size are checked after being spooled
+	regression := `{"version": 4, "serial": 1, "lineage": "checks", "resources": []}`
+	_, putErr = putState(context.Background(), cli, Config{}, nil, "/checks/network", strings.NewReader(regression), -1, PutStateOptions{})
+	if putErr != ErrSerialNotNewer {
+		t.Errorf("Expected a spooled regression to be rejected, got %v", putErr)
+	}
+
+	written, putErr = put(regression, PutStateOptions{Force: true})
+	if putErr != nil || !written {
+		t.Errorf("Expected a forced regression to be written: %v", putErr)
+	}
+	content, _, readErr := readState(cli, "/checks/network")
+	if readErr != nil || string(content) != regression {
+		t.Errorf("Expected the forced state to replace the existing state")
+	}
+
+	newer := `{"version": 4, "serial": 5, "lineage": "checks", "resources": []}`
+	written, putErr = put(newer, PutStateOptions{})
+	if putErr != nil || !written {
+		t.Errorf("Expected a newer serial to be written: %v", putErr)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	contents := map[string]string{
+		"/round-trip":         `{"version": 4, "serial": 1, "lineage": "prefix", "resources": []}`,
+		"/round-trip/network": `{"version": 4, "serial": 1, "lineage": "network", "resources": []}`,
+	}
+	for state, content := range contents {
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(content), int64(len(content)), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error writing state %s: %s", state, putErr.Error())
+			return
+		}
+	}
+
+	dir := t.TempDir()
+	_, exportErr := exportStates(cli, "/round-trip", dir)
+	if exportErr != nil {
+		t.Errorf("Error exporting the states: %s", exportErr.Error())
+		return
+	}
+
+	entries, entriesErr := getDirectoryImportEntries(dir, "/round-trip")
+	if entriesErr != nil {
+		t.Errorf("Error getting the entries of the export: %s", entriesErr.Error())
+		return
+	}
+	if len(entries) != len(contents) {
+		t.Errorf("Expected %d entries, got %d", len(contents), len(entries))
+	}
+	for _, result := range importStates(cli, Config{}, entries, ImportOptions{}) {
+		if result.Error != nil || result.Status != ImportUnchanged {
+			t.Errorf("Expected state %s to be re-imported in itself unchanged, got %s: %v", result.State, result.Status, result.Error)
+		}
+	}
+}
+
+func TestTerminationGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tokenFile := path.Join(t.TempDir(), "termination-token")
+	os.WriteFile(tokenFile, []byte("termination-secret\n"), 0600)
+	withToken, terminatorErr := NewTerminator(context.Background(), ConfigTermination{TokenFile: tokenFile})
+	if terminatorErr != nil {
+		t.Errorf("Error creating the terminator: %s", terminatorErr.Error())
+		return
+	}
+	withoutToken, _ := NewTerminator(context.Background(), ConfigTermination{})
+
+	cases := []struct {
+		terminator *Terminator
+		remoteAddr string
+		token      string
+		allowed    bool
+	}{
+		{terminator: withToken, remoteAddr: "127.0.0.1:40000", token: "", allowed: false},
+		{terminator: withToken, remoteAddr: "[::1]:40000", token: "wrong", allowed: false},
+		{terminator: withToken, remoteAddr: "127.0.0.1:40000", token: "termination-secret", allowed: true},
+		{terminator: withToken, remoteAddr: "10.0.0.2:40000", token: "termination-secret", allowed: true},
+		{terminator: withoutToken, remoteAddr: "127.0.0.1:40000", token: "", allowed: true},
+		{terminator: withoutToken, remoteAddr: "10.0.0.2:40000", token: "", allowed: false},
+		{terminator: withoutToken, remoteAddr: "10.0.0.2:40000", token: "termination-secret", allowed: false},
+	}
+	for _, tc := range cases {
+		called := false
+		handler := tc.terminator.Guard(func(c *gin.Context) { called = true })
+
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/termination", nil)
+		c.Request.RemoteAddr = tc.remoteAddr
+		c.Request.Header.Set("X-Forwarded-For", "127.0.0.1")
+		if tc.token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		handler(c)
+		if called != tc.allowed || (!tc.allowed && recorder.Code != http.StatusForbidden) {
+			t.Errorf("Expected termination from %s with token %q and a configured token %t to be allowed: %t", tc.remoteAddr, tc.token, tc.terminator.token != "", tc.allowed)
+		}
+	}
+
+	called := false
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/termination", nil)
+	c.Request.RemoteAddr = "10.0.0.2:40000"
+	c.Request.SetBasicAuth("terraform", "termination-secret")
+	withToken.Guard(func(c *gin.Context) { called = true })(c)
+	if !called {
+		t.Errorf("Expected the token to be accepted as a basic auth password")
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := NewRateLimiter(ConfigRateLimits{PerUser: ConfigRate{Rate: 0.001, Burst: 1}})
+	limitUser := limiter.LimitUser()
+	request := func(name string, remoteAddr string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/state?state=a", nil)
+		c.Request.RemoteAddr = remoteAddr
+		c.Set(principalContextKey, &Principal{Name: name})
+		limitUser(c)
+		if c.IsAborted() {
+			return recorder.Code
+		}
+		return http.StatusOK
+	}
+
+	if request("alice", "10.0.0.1:40000") != http.StatusOK || request("alice", "10.0.0.2:40000") != http.StatusTooManyRequests {
+		t.Errorf("Expected named clients to be limited across source ips")
+	}
+	if request("", "10.0.0.1:40000") != http.StatusOK {
+		t.Errorf("Expected the fallback of unnamed clients not to share the bucket of named clients")
+	}
+	if request("", "10.0.0.1:40000") != http.StatusTooManyRequests {
+		t.Errorf("Expected unnamed clients to be limited per source ip")
+	}
+	if request("", "10.0.0.3:40000") != http.StatusOK {
+		t.Errorf("Expected unnamed clients of other source ips to have their own bucket")
+	}
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket := newRateLimit(ConfigRate{Rate: 10, Burst: 2})
+	for idx := 0; idx < 2; idx++ {
+		if allowed, _ := bucket.take("a"); !allowed {
+			t.Errorf("Expected the burst to be allowed")
+		}
+	}
+	allowed, retryAfter := bucket.take("a")
+	if allowed || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("Expected an empty bucket to be refused with the time to the next token, got %s", retryAfter)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if allowed, _ := bucket.take("a"); !allowed {
+		t.Errorf("Expected the bucket to refill at the configured rate")
+	}
+	time.Sleep(250 * time.Millisecond)
+	bucket.evict()
+	if len(bucket.buckets) != 0 {
+		t.Errorf("Expected buckets that filled up again to be evicted")
+	}
+
+	if newRateLimit(ConfigRate{}) != nil {
+		t.Errorf("Expected limits without a rate not to be enforced")
+	}
+
+	limiter := NewRateLimiter(ConfigRateLimits{PerIp: ConfigRate{Rate: 0.5, Burst: 1}, MaxConcurrentUploads: 1, UploadRetryAfter: 3 * time.Second})
+	limitIp := limiter.LimitIp()
+	codes := []int{}
+	for idx := 0; idx < 2; idx++ {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/health", nil)
+		c.Request.RemoteAddr = "10.0.0.1:40000"
+		limitIp(c)
+		codes = append(codes, recorder.Code)
+		if idx == 1 && recorder.Header().Get("Retry-After") != "2" {
+			t.Errorf("Expected a Retry-After header of 2 seconds, got %s", recorder.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Expected requests over the ip rate to be refused, got %v", codes)
+	}
+
+	releaseCh := make(chan struct{})
+	startedCh := make(chan struct{})
+	upload := limiter.LimitUploads(func(c *gin.Context) {
+		close(startedCh)
+		<-releaseCh
+	})
+	go func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/state?state=a", nil)
+		upload(c)
+	}()
+	<-startedCh
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/state?state=b", nil)
+	upload(c)
+	close(releaseCh)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "3" {
+		t.Errorf("Expected uploads over the maximum to be refused with the configured retry delay")
+	}
+}
+
+func TestSpoolBody(t *testing.T) {
+	content := strings.Repeat("state", 100)
+	spoolDir := t.TempDir()
+
+	for _, conf := range []ConfigUpload{{MaxBufferedSize: 500}, {MaxBufferedSize: 500, SpoolDirectory: spoolDir}} {
+		spooled, size, spoolErr := spoolBody(strings.NewReader(content), conf)
+		if spoolErr != nil {
+			t.Errorf("Error spooling a body of the maximum size: %s", spoolErr.Error())
+			return
+		}
+		if size != int64(len(content)) {
+			t.Errorf("Expected a spooled size of %d, got %d", len(content), size)
+		}
+		read, _ := io.ReadAll(spooled)
+		if string(read) != content {
+			t.Errorf("Expected the spooled body to be read from the start")
+		}
+		spooled.Close()
+
+		_, _, spoolErr = spoolBody(strings.NewReader(content+"s"), conf)
+		if spoolErr != ErrUploadTooLarge {
+			t.Errorf("Expected bodies over the maximum size to be rejected, got %v", spoolErr)
+		}
+	}
+
+	files, _ := os.ReadDir(spoolDir)
+	if len(files) != 0 {
+		t.Errorf("Expected the spool files to be removed once closed or rejected")
+	}
+
+	_, _, spoolErr := spoolBody(strings.NewReader(content), ConfigUpload{MaxBufferedSize: 500, SpoolDirectory: path.Join(spoolDir, "missing")})
+	if spoolErr == nil {
+		t.Errorf("Expected a missing spool directory to fail the upload")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &abortableReader{ctx: ctx, reader: strings.NewReader(content)}
+	buf := make([]byte, 10)
+	if _, readErr := reader.Read(buf); readErr != nil {
+		t.Errorf("Expected reads to succeed before the context is cancelled")
+	}
+	cancel()
+	if _, readErr := reader.Read(buf); readErr != ErrUploadAborted {
+		t.Errorf("Expected reads to be aborted once the context is cancelled, got %v", readErr)
+	}
+	_, _, spoolErr = spoolBody(reader, ConfigUpload{MaxBufferedSize: 500})
+	if spoolErr == nil {
+		t.Errorf("Expected the spooling of an aborted upload to fail")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	newEvent := func(eventType mvccpb.Event_EventType, key string, value string) *clientv3.Event {
+		return &clientv3.Event{Type: eventType, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: 12}}
+	}
+
+	cases := []struct {
+		event    *clientv3.Event
+		expected WatchEvent
+	}{
+		{event: newEvent(clientv3.EventTypePut, getStateInfoKey("/watch/network"), `{"Version": 3}`), expected: WatchEvent{Type: EventStateUpdated, State: "/watch/network", Revision: 12, Version: 3}},
+		{event: newEvent(clientv3.EventTypeDelete, getStateInfoKey("/watch/network"), ""), expected: WatchEvent{Type: EventStateDeleted, State: "/watch/network", Revision: 12}},
+		{event: newEvent(clientv3.EventTypePut, getLockKey("/watch/network"), ""), expected: WatchEvent{Type: EventLockAcquired, State: "/watch/network", Revision: 12}},
+		{event: newEvent(clientv3.EventTypeDelete, getLockKey("/watch/network"), ""), expected: WatchEvent{Type: EventLockReleased, State: "/watch/network", Revision: 12}},
+	}
+	for _, tc := range cases {
+		event, isEvent := getWatchEvent(tc.event)
+		if !isEvent || *event != tc.expected {
+			t.Errorf("Expected a change of key %s to be streamed as %v, got %v", string(tc.event.Kv.Key), tc.expected, event)
+		}
+	}
+
+	for _, key := range []string{getLockHolderKey("/watch/network"), fmt.Sprintf("%s0", getStateChunkPrefix("/watch/network", 3))} {
+		if _, isEvent := getWatchEvent(newEvent(clientv3.EventTypePut, key, "")); isEvent {
+			t.Errorf("Expected changes of key %s not to be streamed", key)
+		}
+	}
+}
+
+func TestMigratedState(t *testing.T) {
+	cases := []struct {
+		workspace string
+		opts      LegacyMigrationOptions
+		expected  string
+	}{
+		{workspace: "default", opts: LegacyMigrationOptions{Prefix: "/legacy/", AddSlash: true, Separator: "-"}, expected: "/legacy"},
+		{workspace: "staging", opts: LegacyMigrationOptions{Prefix: "/legacy/", AddSlash: true, Separator: "-"}, expected: "/legacy-staging"},
+		{workspace: "default", opts: LegacyMigrationOptions{Prefix: "/legacy", Separator: "/"}, expected: "/legacy"},
+		{workspace: "staging", opts: LegacyMigrationOptions{Prefix: "/legacy", Separator: "/"}, expected: "/legacy/staging"},
+	}
+	for _, tc := range cases {
+		if state := getMigratedState(tc.workspace, tc.opts); state != tc.expected {
+			t.Errorf("Expected workspace %s of prefix %s to be migrated to %s, got %s", tc.workspace, tc.opts.Prefix, tc.expected, state)
+		}
+	}
+}
+
+func TestLegacyMigration(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	legacyKeys := map[string]string{
+		"/legacy/default":          `{"version": 4, "serial": 1, "lineage": "default", "resources": []}`,
+		"/legacy/staging":          `{"version": 4, "serial": 1, "lineage": "staging", "resources": []}`,
+		"/legacy/locked":           `{"version": 4, "serial": 1, "lineage": "locked", "resources": []}`,
+		"/legacy/locked.lockinfo":  `{"ID": "lock"}`,
+		"/legacy/notes":            "not a state",
+		"/legacy/nested/workspace": `{"version": 4, "serial": 1, "lineage": "nested", "resources": []}`,
+	}
+	for key, value := range legacyKeys {
+		_, putErr := cli.PutKey(key, value)
+		if putErr != nil {
+			t.Errorf("Error writing legacy key %s: %s", key, putErr.Error())
+			return
+		}
+	}
+
+	opts := LegacyMigrationOptions{Prefix: "/legacy/", AddSlash: true, Separator: "-", DryRun: true}
+	results, migrateErr := migrateLegacyStates(cli, opts)
+	if migrateErr != nil || len(results) != 3 {
+		t.Errorf("Expected the 3 legacy workspaces to be found: %v", migrateErr)
+		return
+	}
+
+	opts.DryRun = false
+	opts.Delete = true
+	results, migrateErr = migrateLegacyStates(cli, opts)
+	if migrateErr != nil {
+		t.Errorf("Error migrating the legacy states: %s", migrateErr.Error())
+		return
+	}
+
+	expected := map[string]string{
+		"default": MigrationMigrated,
+		"staging": MigrationMigrated,
+		"locked":  MigrationSkippedLocked,
+	}
+	for _, result := range results {
+		if result.Status != expected[result.Workspace] || result.Deleted != (result.Status == MigrationMigrated) {
+			t.Errorf("Unexpected migration of workspace %s: %s, deleted: %t", result.Workspace, result.Status, result.Deleted)
+		}
+		if result.Status != MigrationMigrated {
+			continue
+		}
+
+		content, _, readErr := readState(cli, result.State)
+		if readErr != nil || string(content) != legacyKeys[result.LegacyKey] {
+			t.Errorf("Expected workspace %s to be migrated to state %s", result.Workspace, result.State)
+		}
+		legacy, _ := cli.GetKey(result.LegacyKey, client.GetKeyOptions{})
+		if legacy.Found() {
+			t.Errorf("Expected the legacy key %s to be deleted once migrated", result.LegacyKey)
+		}
+	}
+
+	locked, _ := cli.GetKey("/legacy/locked", client.GetKeyOptions{})
+	if !locked.Found() {
+		t.Errorf("Expected the legacy key of a locked workspace to be kept")
+	}
+}
+
+func TestCopyState(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{Lock: ConfigLock{Timeout: 5 * time.Second, RetryInterval: 100 * time.Millisecond}}
+	content := `{"version": 4, "serial": 1, "lineage": "copy", "resources": []}`
+	for _, state := range []string{"/copy/source", "/copy/existing", "/copy/locked"} {
+		_, putErr := putState(context.Background(), cli, Config{}, nil, state, strings.NewReader(content), int64(len(content)), PutStateOptions{})
+		if putErr != nil {
+			t.Errorf("Error writing state %s: %s", state, putErr.Error())
+			return
+		}
+	}
+	_, _, lockErr := acquireLockInQueue(context.Background(), cli, "/copy/locked", 60, time.Second, config)
+	if lockErr != nil {
+		t.Errorf("Error locking the state: %s", lockErr.Error())
+		return
+	}
+
+	refused := []struct {
+		from     string
+		to       string
+		expected error
+	}{
+		{from: "/copy/missing", to: "/copy/target", expected: ErrStateNotFound},
+		{from: "/copy/source", to: "/copy/existing", expected: ErrStateExists},
+		{from: "/copy/locked", to: "/copy/target", expected: ErrStateLocked},
+	}
+	for _, tc := range refused {
+		copyErr := copyState(cli, tc.from, tc.to, false)
+		if copyErr != tc.expected {
+			t.Errorf("Expected the copy of %s to %s to be refused with %v, got %v", tc.from, tc.to, tc.expected, copyErr)
+		}
+	}
+
+	copyErr := copyState(cli, "/copy/source", "/copy/copied", false)
+	if copyErr != nil {
+		t.Errorf("Error copying the state: %s", copyErr.Error())
+		return
+	}
+	for _, state := range []string{"/copy/source", "/copy/copied"} {
+		copied, _, readErr := readState(cli, state)
+		if readErr != nil || string(copied) != content {
+			t.Errorf("Expected state %s to have the content of the source after a copy", state)
+		}
+	}
+
+	moveErr := copyState(cli, "/copy/copied", "/copy/moved", true)
+	if moveErr != nil {
+		t.Errorf("Error moving the state: %s", moveErr.Error())
+		return
+	}
+	moved, _, readErr := readState(cli, "/copy/moved")
+	if readErr != nil || string(moved) != content {
+		t.Errorf("Expected the moved state to have the content of the source")
+	}
+	info, _, infoErr := getStateInfo(cli, "/copy/copied")
+	if infoErr != nil || info != nil {
+		t.Errorf("Expected the source of a move to be deleted")
+	}
+	keys, _ := listKeys(cli, fmt.Sprintf("%s/", getStateKey("/copy/copied")))
+	if len(keys) != 0 {
+		t.Errorf("Expected the chunks of the source of a move to be deleted, got %v", keys)
+	}
+}
+
+/*
+Returns a router of the api routes whose handlers respond with their name and the state they resolved
+*/
+func getTestRouter() *gin.Engine {
+	handlers := Handlers{}
+	handlersValue := reflect.ValueOf(&handlers).Elem()
+	for idx := 0; idx < handlersValue.NumField(); idx++ {
+		name := handlersValue.Type().Field(idx).Name
+		handlersValue.Field(idx).Set(reflect.ValueOf(gin.HandlerFunc(func(c *gin.Context) {
+			state, ok := getStateParam(c, "state")
+			if ok {
+				c.String(http.StatusOK, "%s %s", name, state)
+			}
+		})))
+	}
+
+	router := gin.New()
+	registerRoutes(router, handlers, Config{})
+	return router
+}
+
+func TestStateRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+	keyLayout.Namespace = "/tb"
+
+	router := getTestRouter()
+
+	cases := []struct {
+		method   string
+		target   string
+		expected string
+	}{
+		{method: http.MethodGet, target: "/states/team-a/network", expected: "GetState /tb/team-a/network"},
+		{method: http.MethodGet, target: "/states/team-a/network/lock", expected: "GetLock /tb/team-a/network"},
+		{method: http.MethodPut, target: "/states/team-a/network", expected: "UpsertState /tb/team-a/network"},
+		{method: http.MethodPut, target: "/states/team-a/network/lock", expected: "AcquireLock /tb/team-a/network"},
+		{method: http.MethodPost, target: "/states/team-a/network", expected: "UpsertState /tb/team-a/network"},
+		{method: http.MethodPost, target: "/states/team-a/network/lock/renew", expected: "RenewLock /tb/team-a/network"},
+		{method: http.MethodDelete, target: "/states/team-a/network", expected: "DeleteState /tb/team-a/network"},
+		{method: http.MethodDelete, target: "/states/team-a/network/lock", expected: "ReleaseLock /tb/team-a/network"},
+		{method: "LOCK", target: "/states/team-a/network", expected: "AcquireLock /tb/team-a/network"},
+		{method: "UNLOCK", target: "/states/team-a/network/lock", expected: "ReleaseLock /tb/team-a/network"},
+		{method: http.MethodGet, target: "/states/team%20a/net%2Fwork", expected: "GetState /tb/team a/net/work"},
+		{method: http.MethodGet, target: "/state?state=team-a/network", expected: "GetState /tb/team-a/network"},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.target, nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != tc.expected {
+			t.Errorf("Expected %s %s to be handled by %s, got status code %d and %s", tc.method, tc.target, tc.expected, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	for _, invalid := range []string{"/states/", "/states/team-a//network", "/states/team-a/%2E%2E/network", "/states/team-a/state/network"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, invalid, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected the invalid state name of %s to be rejected, got status code %d", invalid, recorder.Code)
+		}
+	}
+}
+
+func TestTerraformMethods(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := getTestRouter()
+
+	//Methods sent by terraform's http backend when lock_method, unlock_method and update_method are not set
+	cases := []struct {
+		method   string
+		target   string
+		expected string
+	}{
+		{method: http.MethodPost, target: "/state?state=network", expected: "UpsertState network"},
+		{method: "LOCK", target: "/state?state=network", expected: "AcquireLock network"},
+		{method: "UNLOCK", target: "/state?state=network", expected: "ReleaseLock network"},
+		{method: "LOCK", target: "/lock?state=network", expected: "AcquireLock network"},
+		{method: "UNLOCK", target: "/lock?state=network", expected: "ReleaseLock network"},
+		{method: http.MethodPut, target: "/lock?state=network", expected: "AcquireLock network"},
+		{method: http.MethodDelete, target: "/lock?state=network", expected: "ReleaseLock network"},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.target, nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != tc.expected {
+			t.Errorf("Expected %s %s to be handled by %s, got status code %d and %s", tc.method, tc.target, tc.expected, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	drainer := NewDrainer()
+	if drainer.IsDraining() {
+		t.Errorf("Expected a new drainer not to be draining")
+	}
+	drainer.StartDrain()
+	drainer.StartDrain()
+	select {
+	case <-drainer.Draining():
+	default:
+		t.Errorf("Expected the draining channel to be closed once draining starts")
+	}
+
+	startedCh := make(chan struct{})
+	doneCh := make(chan error)
+	upload := drainer.TrackUpload(func(c *gin.Context) {
+		close(startedCh)
+		reader := &abortableReader{ctx: drainer.UploadContext(), reader: rand.Reader}
+		buf := make([]byte, 1)
+		for {
+			_, readErr := reader.Read(buf)
+			if readErr != nil {
+				doneCh <- readErr
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	go func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		upload(c)
+	}()
+	<-startedCh
+	if drainer.Uploads() != 1 {
+		t.Errorf("Expected the upload in progress to be counted")
+	}
+
+	//Draining lets uploads in progress finish until they are aborted
+	select {
+	case <-doneCh:
+		t.Errorf("Expected the upload not to be aborted before AbortUploads is called")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	abortedCh := make(chan bool)
+	go func() {
+		abortedCh <- drainer.AbortUploads(5 * time.Second)
+	}()
+	if readErr := <-doneCh; readErr != ErrUploadAborted {
+		t.Errorf("Expected the upload to be aborted, got %v", readErr)
+	}
+	if !<-abortedCh {
+		t.Errorf("Expected AbortUploads to report that all uploads returned")
+	}
+	if drainer.Uploads() != 0 {
+		t.Errorf("Expected the aborted upload not to be counted anymore")
+	}
+
+	stuck := NewDrainer()
+	releaseCh := make(chan struct{})
+	stuckStartedCh := make(chan struct{})
+	go func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		stuck.TrackUpload(func(c *gin.Context) {
+			close(stuckStartedCh)
+			<-releaseCh
+		})(c)
+	}()
+	<-stuckStartedCh
+	if stuck.AbortUploads(200 * time.Millisecond) {
+		t.Errorf("Expected AbortUploads to report uploads that didn't return before the timeout")
+	}
+	close(releaseCh)
+}
+
+func TestAuthentication(t *testing.T) {
+	accounts := gin.Accounts{"admin": "admin-password"}
+	request := func(setAuth func(req *http.Request)) (*Principal, error) {
+		req := httptest.NewRequest(http.MethodGet, "/state?state=a", nil)
+		setAuth(req)
+		return authenticate(req, accounts, nil, nil)
+	}
+
+	principal, authErr := request(func(req *http.Request) { req.SetBasicAuth("admin", "admin-password") })
+	if authErr != nil || principal.Name != "admin" || !principal.Unrestricted {
+		t.Errorf("Expected the accounts of the basic auth file to be unrestricted")
+	}
+
+	for _, setAuth := range []func(req *http.Request){
+		func(req *http.Request) {},
+		func(req *http.Request) { req.SetBasicAuth("admin", "wrong") },
+		func(req *http.Request) { req.SetBasicAuth("other", "admin-password") },
+		func(req *http.Request) { req.Header.Set("Authorization", "Bearer tbe_id_secret") },
+		func(req *http.Request) { req.Header.Set("Authorization", "Bearer a.b.c") },
+	} {
+		_, authErr = request(setAuth)
+		if authErr != ErrUnauthenticated {
+			t.Errorf("Expected invalid credentials to be rejected, got %v", authErr)
+		}
+	}
+}
+
+func TestTokenValidation(t *testing.T) {
+	store := NewTokenStore(Config{Tokens: ConfigTokens{Enabled: true, MaxExpiry: time.Hour}}, nil)
+	permissions := []Permission{{Prefixes: []string{"/team-a"}, Operations: []string{OperationRead}}}
+
+	if validationErr := store.Validate(ApiTokenOptions{Permissions: permissions, ExpiresIn: time.Hour}); validationErr != nil {
+		t.Errorf("Expected a valid token to be accepted: %s", validationErr.Error())
+	}
+
+	for _, invalid := range []ApiTokenOptions{
+		{ExpiresIn: time.Hour},
+		{Permissions: []Permission{{Operations: []string{"delete"}}}, ExpiresIn: time.Hour},
+		{Permissions: permissions, ExpiresIn: -time.Hour},
+		{Permissions: permissions},
+		{Permissions: permissions, ExpiresIn: 2 * time.Hour},
+	} {
+		if store.Validate(invalid) == nil {
+			t.Errorf("Expected token options %v to be rejected", invalid)
+		}
+	}
+
+	if NewTokenStore(Config{}, nil) != nil {
+		t.Errorf("Expected no token store when tokens are not enabled")
+	}
+}
+
+func TestApiTokens(t *testing.T) {
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	store := NewTokenStore(Config{Tokens: ConfigTokens{Enabled: true, Prefix: "/tokens"}}, cli)
+	permissions := []Permission{{Prefixes: []string{"/team-a"}, Operations: []string{OperationRead}}}
+	token, stored, createErr := store.Create(ApiTokenOptions{Name: "ci", Permissions: permissions, CreatedBy: "admin"})
+	if createErr != nil {
+		t.Errorf("Error creating the token: %s", createErr.Error())
+		return
+	}
+	if !isApiToken(token) || stored.Hash != "" {
+		t.Errorf("Expected the token to have the api token prefix and its hash not to be returned")
+	}
+
+	for _, setAuth := range []func(req *http.Request){
+		func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) },
+		func(req *http.Request) { req.SetBasicAuth("terraform", token) },
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/state?state=a", nil)
+		setAuth(req)
+		principal, authErr := authenticate(req, gin.Accounts{}, nil, store)
+		if authErr != nil {
+			t.Errorf("Error authenticating with the token: %s", authErr.Error())
+			continue
+		}
+		if principal.Name != "token/"+stored.Id || principal.Unrestricted || !principal.Allows(OperationRead, "/team-a/network", false) || principal.Allows(OperationWrite, "/team-a/network", false) {
+			t.Errorf("Expected the token to authenticate a client with its permissions")
+		}
+	}
+
+	for _, invalid := range []string{token + "0", strings.Split(token, "_")[0] + "_" + strings.Split(token, "_")[1], "tbe_../" + stored.Id + "_secret", "tbe_missing_secret"} {
+		if _, authErr := store.Authenticate(invalid); authErr != ErrInvalidToken {
+			t.Errorf("Expected token %s to be rejected, got %v", invalid, authErr)
+		}
+	}
+
+	tokens, listErr := store.List()
+	if listErr != nil || len(tokens) != 1 || tokens[0].Hash != "" || tokens[0].CreatedBy != "admin" {
+		t.Errorf("Expected the token to be listed without its hash")
+	}
+
+	expiring, _, createErr := store.Create(ApiTokenOptions{Name: "short", Permissions: permissions, ExpiresIn: time.Second})
+	if createErr != nil {
+		t.Errorf("Error creating an expiring token: %s", createErr.Error())
+		return
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, authErr := store.Authenticate(expiring); authErr != ErrInvalidToken {
+		t.Errorf("Expected an expired token to be rejected, got %v", authErr)
+	}
+
+	deleteErr := store.Delete(stored.Id)
+	if deleteErr != nil {
+		t.Errorf("Error deleting the token: %s", deleteErr.Error())
+		return
+	}
+	if _, authErr := store.Authenticate(token); authErr != ErrInvalidToken {
+		t.Errorf("Expected a deleted token to be rejected, got %v", authErr)
+	}
+	if store.Delete(stored.Id) != ErrTokenNotFound {
+		t.Errorf("Expected the deletion of a missing token to report it")
+	}
+}
+
+func TestInternalLocks(t *testing.T) {
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+	setKeyLayout(Config{
+		Backups:     ConfigBackups{LockKey: "/terraform-backend-etcd/backups/lock"},
+		Gc:          ConfigGc{LockKey: "/terraform-backend-etcd/gc/lock"},
+		Replication: ConfigReplication{LockKey: "/terraform-backend-etcd/replication/lock"},
+	})
+
+	for _, key := range []string{"/terraform-backend-etcd/backups/lock", "/terraform-backend-etcd/gc/lock", "/terraform-backend-etcd/replication/lock"} {
+		if _, isLock := getLockState(key); isLock {
+			t.Errorf("Expected the lock of a background task %s not to be a lock of a state", key)
+		}
+		if _, isEvent := getWatchEvent(&clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(key)}}); isEvent {
+			t.Errorf("Expected the lock of a background task %s not to be streamed", key)
+		}
+	}
+
+	state, isLock := getLockState("/terraform/replication/lock")
+	if !isLock || state != "/terraform/replication" {
+		t.Errorf("Expected the locks of states to be recognized")
+	}
+}
+
+func TestClusterSegmentRouting(t *testing.T) {
+	defaultCluster := &Cluster{Name: defaultClusterName}
+	prod := &Cluster{Name: "prod", Prefixes: []string{"/prod"}}
+	clusters := &ClusterSet{Default: defaultCluster, Clusters: []*Cluster{defaultCluster, prod}}
+
+	for state, expected := range map[string]*Cluster{
+		"/prod":                 prod,
+		"/prod/network":         prod,
+		"/production/network":   defaultCluster,
+		"/prod-legacy/network":  defaultCluster,
+		"/staging/prod/network": defaultCluster,
+	} {
+		if cluster := clusters.GetCluster(state); cluster != expected {
+			t.Errorf("Expected state %s to be routed to cluster %s, got %s", state, expected.Name, cluster.Name)
+		}
+	}
+
+	for prefix, expected := range map[string]string{
+		"/prod/":  "prod",
+		"/prod":   "prod,default",
+		"/pro":    "default,prod",
+		"/produc": "default",
+	} {
+		names := []string{}
+		for _, cluster := range clusters.GetOverlapping(prefix) {
+			names = append(names, cluster.Name)
+		}
+		if strings.Join(names, ",") != expected {
+			t.Errorf("Expected prefix %s to overlap clusters %s, got %s", prefix, expected, strings.Join(names, ","))
+		}
+	}
+}
+
+func TestWebhookPrefixes(t *testing.T) {
+	webhook := ConfigWebhook{Name: "team-a", Prefixes: []string{"/team-a"}}
+
+	for state, expected := range map[string]bool{
+		"/team-a":          true,
+		"/team-a/network":  true,
+		"/team-ab/network": false,
+		"/team-b/network":  false,
+	} {
+		if matches := webhookMatches(webhook, Event{Type: EventStateUpdated, State: state}); matches != expected {
+			t.Errorf("Expected a webhook for /team-a to match the events of %s: %t", state, expected)
+		}
+	}
+
+	if !webhookMatches(ConfigWebhook{Name: "all"}, Event{Type: EventLockAcquired, State: "/team-ab/network"}) {
+		t.Errorf("Expected a webhook without prefixes to match all states")
+	}
+}
+
+func TestUploadChecks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cli, tearDown, launchErr := LaunchTestEtcd(t)
+	if launchErr != nil {
+		t.Errorf("Error occured launching test etcd cluster: %s", launchErr.Error())
+		return
+	}
+	defer tearDown()
+
+	config := Config{}
+	clusters := &ClusterSet{Default: &Cluster{Name: defaultClusterName, Client: cli}}
+	clusters.Clusters = []*Cluster{clusters.Default}
+	terminator, _ := NewTerminator(context.Background(), ConfigTermination{})
+	handlers, _ := GetHandlers(config, clusters, nil, NewMaintenance(ConfigMaintenance{}, nil), nil, nil, NewRateLimiter(ConfigRateLimits{}), NewDrainer(), terminator)
+
+	upload := func(target string, content string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, target, strings.NewReader(content))
+		handlers.UpsertState(c)
+		return recorder.Code
+	}
+
+	newer := `{"version": 4, "serial": 2, "lineage": "upload", "resources": []}`
+	older := `{"version": 4, "serial": 1, "lineage": "upload", "resources": []}`
+	cases := []struct {
+		target   string
+		content  string
+		expected int
+	}{
+		{target: "/state?state=/upload/network", content: newer, expected: http.StatusOK},
+		{target: "/state?state=/upload/network", content: older, expected: http.StatusConflict},
+		{target: "/state?state=/upload/network", content: `{"version": 4, "serial": 3, "lineage": "other", "resources": []}`, expected: http.StatusConflict},
+		{target: "/state?state=/upload/network", content: "not a state", expected: http.StatusBadRequest},
+		{target: "/state?state=/upload/network&force=false", content: older, expected: http.StatusConflict},
+		{target: "/state?state=/upload/network&force=true", content: older, expected: http.StatusOK},
+		{target: "/state?state=/upload/other&force=true", content: "not a state", expected: http.StatusOK},
+	}
+	for _, tc := range cases {
+		if code := upload(tc.target, tc.content); code != tc.expected {
+			t.Errorf("Expected the upload of %s to %s to get status code %d, got %d", tc.content, tc.target, tc.expected, code)
+		}
+	}
+
+	content, _, readErr := readState(cli, "/upload/network")
+	if readErr != nil || string(content) != older {
+		t.Errorf("Expected a forced upload to replace the state")
+	}
+}
+
+func TestInternalStateNames(t *testing.T) {
+	prevLayout := keyLayout
+	defer func() { keyLayout = prevLayout }()
+
+	config, configErr := LoadTestConfig("etcd_client:\n  endpoints: [\"127.0.0.1:2379\"]\n", t)
+	if configErr != nil {
+		t.Errorf("Error loading the configuration: %s", configErr.Error())
+		return
+	}
+	setKeyLayout(config)
+
+	for _, name := range []string{"/terraform-backend-etcd", "/terraform-backend-etcd/tokens", "/terraform-backend-etcd/tokens/abc", "/terraform-backend-etcd/maintenance/network", "/terraform-backend-etcd/gc"} {
+		if _, stateErr := resolveState(name); stateErr != ErrInternalStateName {
+			t.Errorf("Expected state name %s to be rejected, got %v", name, stateErr)
+		}
+	}
+	for _, prefix := range []string{"/terraform-backend-etcd/tokens/", "/terraform-backend-etcd/tokens/a"} {
+		if _, prefixErr := resolveStatePrefix(prefix); prefixErr != ErrInternalStateName {
+			t.Errorf("Expected prefix %s to be rejected, got %v", prefix, prefixErr)
+		}
+	}
+
+	for _, name := range []string{"/terraform/network", "/terraform-backend-etcd-states/network"} {
+		if _, stateErr := resolveState(name); stateErr != nil {
+			t.Errorf("Expected state name %s to be accepted: %s", name, stateErr.Error())
+		}
+	}
+	if _, prefixErr := resolveStatePrefix("/terraform"); prefixErr != nil {
+		t.Errorf("Expected prefixes covering internal keys to still be listable: %s", prefixErr.Error())
+	}
+
+	if _, importErr := importState(nil, config, ImportEntry{State: "/terraform-backend-etcd/tokens/abc", Content: []byte("{}")}, ImportOptions{}); importErr != ErrInternalStateName {
+		t.Errorf("Expected imports in internal keys to be rejected, got %v", importErr)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+/*
+Time to wait before watching the maintenance mode again after the watch failed
+*/
+const maintenanceWatchRetryInterval = 5 * time.Second
+
+var ErrMaintenanceMode = errors.New("Paused by the maintenance mode")
+
+/*
+Origins of the maintenance mode of an instance
+*/
+const (
+	MaintenanceSourceConfig = "configuration"
+	MaintenanceSourceStored = "etcd"
+)
+
+type MaintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	Source  string `json:"source,omitempty"`
+}
+
+/*
+Maintenance mode of the backend, in which states can still be read but not written or locked and the background
+tasks (garbage collection, scheduled backups and replication) are paused.
+It is stored in the default etcd cluster and watched, so that it is shared by all the instances of the backend.
+The stored mode takes precedence over the mode of the configuration, which only applies until the mode is first set
+and once it is reset. It can be toggled at runtime with the SIGUSR1 signal or the admin endpoints.
+*/
+type Maintenance struct {
+	cli           *client.EtcdClient
+	key           string
+	lock          sync.Mutex
+	status        MaintenanceStatus
+	defaultStatus MaintenanceStatus
+	retryAfter    time.Duration
+}
+
+func NewMaintenance(conf ConfigMaintenance, cli *client.EtcdClient) *Maintenance {
+	m := &Maintenance{
+		cli: cli,
+		key: conf.Key,
+		defaultStatus: MaintenanceStatus{
+			Enabled: conf.Enabled,
+			Message: conf.Message,
+			Source:  MaintenanceSourceConfig,
+		},
+		retryAfter: conf.RetryAfter,
+	}
+	m.apply(m.defaultStatus)
+	return m
+}
+
+/*
+Updates the mode of this instance from the mode stored in etcd
+*/
+func (m *Maintenance) apply(status MaintenanceStatus) {
+	if status.Message == "" {
+		status.Message = m.defaultStatus.Message
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if status.Enabled != m.status.Enabled {
+		fmt.Printf("Maintenance mode enabled: %t (from the %s)\n", status.Enabled, status.Source)
+	}
+	m.status = status
+
+	if status.Enabled {
+		maintenanceModeMetric.Set(1)
+	} else {
+		maintenanceModeMetric.Set(0)
+	}
+}
+
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.status
+}
+
+/*
+Whether the maintenance mode is enabled. Tasks without a maintenance mode are never paused.
+*/
+func (m *Maintenance) Enabled() bool {
+	if m == nil {
+		return false
+	}
+
+	return m.Status().Enabled
+}
+
+/*
+Enables or disables the maintenance mode of all the instances of the backend.
+If no message is passed, the message of the configuration is used.
+*/
+func (m *Maintenance) Set(enabled bool, message string) (MaintenanceStatus, error) {
+	status := MaintenanceStatus{Enabled: enabled, Message: message}
+	if status.Message == "" {
+		status.Message = m.defaultStatus.Message
+	}
+
+	output, _ := json.Marshal(status)
+	_, putErr := m.cli.PutKey(m.key, string(output))
+	if putErr != nil {
+		return m.Status(), putErr
+	}
+
+	status.Source = MaintenanceSourceStored
+	m.apply(status)
+	return status, nil
+}
+
+/*
+Removes the mode stored in etcd so that the mode of the configuration applies again to all the instances of the backend
+*/
+func (m *Maintenance) Reset() (MaintenanceStatus, error) {
+	deleteErr := m.cli.DeleteKey(m.key)
+	if deleteErr != nil {
+		return m.Status(), deleteErr
+	}
+
+	m.apply(m.defaultStatus)
+	return m.defaultStatus, nil
+}
+
+func (m *Maintenance) Toggle() (MaintenanceStatus, error) {
+	return m.Set(!m.Status().Enabled, "")
+}
+
+func parseMaintenanceStatus(value []byte) (MaintenanceStatus, error) {
+	var status MaintenanceStatus
+	unmarshalErr := json.Unmarshal(value, &status)
+	if unmarshalErr != nil {
+		return status, errors.New(fmt.Sprintf("Error parsing the maintenance mode: %s", unmarshalErr.Error()))
+	}
+	status.Source = MaintenanceSourceStored
+
+	return status, nil
+}
+
+/*
+Loads the mode stored in etcd and follows its changes until the context is cancelled or the watch fails
+*/
+func (m *Maintenance) watch(ctx context.Context) error {
+	getCtx, cancel := context.WithTimeout(m.cli.Context, m.cli.RequestTimeout)
+	res, getErr := m.cli.Client.Get(getCtx, m.key)
+	cancel()
+	if getErr != nil {
+		return getErr
+	}
+
+	if len(res.Kvs) == 0 {
+		m.apply(m.defaultStatus)
+	} else {
+		status, parseErr := parseMaintenanceStatus(res.Kvs[0].Value)
+		if parseErr != nil {
+			return parseErr
+		}
+		if status.Enabled != m.defaultStatus.Enabled {
+			fmt.Printf("Maintenance mode stored at key %s (enabled: %t) overrides the configuration (enabled: %t) until it is reset\n", m.key, status.Enabled, m.defaultStatus.Enabled)
+		}
+		m.apply(status)
+	}
+
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+
+	wc := m.cli.Client.Watch(clientv3.WithRequireLeader(watchCtx), m.key, clientv3.WithRev(res.Header.Revision+1))
+	for res := range wc {
+		if res.Err() != nil {
+			return res.Err()
+		}
+
+		for _, ev := range res.Events {
+			if ev.Type == clientv3.EventTypeDelete {
+				m.apply(m.defaultStatus)
+				continue
+			}
+
+			status, parseErr := parseMaintenanceStatus(ev.Kv.Value)
+			if parseErr != nil {
+				return parseErr
+			}
+			m.apply(status)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("Watch on the maintenance mode was closed")
+}
+
+/*
+Wraps a handler that writes or locks states so that it is rejected while the maintenance mode is enabled
+*/
+func (m *Maintenance) Guard(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := m.Status()
+		if status.Enabled {
+			c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(m.retryAfter.Seconds())), 10))
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "maintenance",
+				"error":  status.Message,
+			})
+			return
+		}
+
+		handler(c)
+	}
+}
+
+/*
+Follows the maintenance mode stored in etcd and toggles it whenever the SIGUSR1 signal is received,
+until the context is cancelled
+*/
+func (m *Maintenance) Run(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+
+	go func() {
+		for {
+			watchErr := m.watch(ctx)
+			if watchErr != nil {
+				fmt.Printf("Could not follow the maintenance mode: %s\n", watchErr.Error())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(maintenanceWatchRetryInterval):
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			_, toggleErr := m.Toggle()
+			if toggleErr != nil {
+				fmt.Printf("Could not toggle the maintenance mode: %s\n", toggleErr.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backupRunsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_backup_runs_total",
+			Help: "Number of scheduled backup runs, by result",
+		},
+		[]string{"result"},
+	)
+	backupStatesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_backup_exported_states_total",
+			Help: "Number of state versions exported by scheduled backups",
+		},
+	)
+	backupLastSuccessMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "terraform_backend_etcd_backup_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful scheduled backup run",
+		},
+	)
+	gcRunsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_gc_runs_total",
+			Help: "Number of background garbage collection runs, by result",
+		},
+		[]string{"result"},
+	)
+	gcReclaimedBytesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_gc_reclaimed_bytes_total",
+			Help: "Number of bytes of orphaned state chunks removed by background garbage collection",
+		},
+	)
+	gcRemovedLocksMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_gc_removed_locks_total",
+			Help: "Number of abandoned locks removed by background garbage collection",
+		},
+	)
+	maintenanceModeMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "terraform_backend_etcd_maintenance_mode",
+			Help: "Whether the maintenance mode is enabled on this instance",
+		},
+	)
+	clusterRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_cluster_requests_total",
+			Help: "Number of api requests routed to each etcd cluster",
+		},
+		[]string{"cluster"},
+	)
+	clusterUpMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "terraform_backend_etcd_cluster_up",
+			Help: "Whether each etcd cluster was reachable on the last health check",
+		},
+		[]string{"cluster"},
+	)
+	replicationLagMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "terraform_backend_etcd_replication_lag_revisions",
+			Help: "Number of revisions of the primary etcd cluster that were not yet confirmed as replicated to the secondary cluster",
+		},
+	)
+	rateLimitedRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "terraform_backend_etcd_rate_limited_requests_total",
+			Help: "Number of requests rejected by each rate limit",
+		},
+		[]string{"limit"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		backupRunsMetric,
+		backupStatesMetric,
+		backupLastSuccessMetric,
+		gcRunsMetric,
+		gcReclaimedBytesMetric,
+		gcRemovedLocksMetric,
+		maintenanceModeMetric,
+		clusterRequestsMetric,
+		clusterUpMetric,
+		replicationLagMetric,
+		rateLimitedRequestsMetric,
+	)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rateBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+/*
+Token buckets limiting the rate of requests of each client, identified by a key
+*/
+type rateLimit struct {
+	conf    ConfigRate
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newRateLimit(conf ConfigRate) *rateLimit {
+	if conf.Rate <= 0 {
+		return nil
+	}
+
+	return &rateLimit{
+		conf:    conf,
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+/*
+Takes a token from the bucket of a client, returning how long to wait for the next token if there is none left
+*/
+func (l *rateLimit) take(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &rateBucket{tokens: float64(l.conf.Burst), updatedAt: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(l.conf.Burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.conf.Rate)
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.conf.Rate * float64(time.Second))
+	}
+
+	bucket.tokens -= 1
+	return true, 0
+}
+
+/*
+Removes the buckets that filled up again, which behave like new ones
+*/
+func (l *rateLimit) evict() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	fillTime := time.Duration(float64(l.conf.Burst) / l.conf.Rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if time.Since(bucket.updatedAt) >= fillTime {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func rejectRateLimited(c *gin.Context, limit string, retryAfter time.Duration) {
+	rateLimitedRequestsMetric.WithLabelValues(limit).Inc()
+	c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"status": "rate limited",
+		"error":  "Too many requests, retry later",
+	})
+}
+
+/*
+Limits the rate of requests per source ip and per authenticated client, as well as the number of state uploads
+in progress, which are memory and etcd heavy. Limits that are not configured are not enforced.
+*/
+type RateLimiter struct {
+	perIp            *rateLimit
+	perUser          *rateLimit
+	uploads          chan struct{}
+	uploadRetryAfter time.Duration
+}
+
+func NewRateLimiter(conf ConfigRateLimits) *RateLimiter {
+	limiter := &RateLimiter{
+		perIp:            newRateLimit(conf.PerIp),
+		perUser:          newRateLimit(conf.PerUser),
+		uploadRetryAfter: conf.UploadRetryAfter,
+	}
+	if conf.MaxConcurrentUploads > 0 {
+		limiter.uploads = make(chan struct{}, conf.MaxConcurrentUploads)
+	}
+
+	return limiter
+}
+
+/*
+Middleware limiting the rate of requests per source ip
+*/
+func (r *RateLimiter) LimitIp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.perIp == nil {
+			return
+		}
+
+		allowed, retryAfter := r.perIp.take(c.ClientIP())
+		if !allowed {
+			rejectRateLimited(c, "ip", retryAfter)
+		}
+	}
+}
+
+/*
+Middleware limiting the rate of requests per authenticated client. It needs to run after the authentication middleware.
+Clients without a name, like jwts without a subject, are limited per source ip instead.
+*/
+func (r *RateLimiter) LimitUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.perUser == nil {
+			return
+		}
+
+		key := "user:" + getPrincipalName(c)
+		if key == "user:" {
+			key = "ip:" + c.ClientIP()
+		}
+
+		allowed, retryAfter := r.perUser.take(key)
+		if !allowed {
+			rejectRateLimited(c, "user", retryAfter)
+		}
+	}
+}
+
+/*
+Wraps a handler uploading states so that it is rejected while the maximum number of uploads are in progress
+*/
+func (r *RateLimiter) LimitUploads(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r.uploads == nil {
+			handler(c)
+			return
+		}
+
+		select {
+		case r.uploads <- struct{}{}:
+		default:
+			rejectRateLimited(c, "uploads", r.uploadRetryAfter)
+			return
+		}
+		defer func() { <-r.uploads }()
+
+		handler(c)
+	}
+}
+
+/*
+Periodically removes the rate limit state of idle clients until the context is cancelled
+*/
+func (r *RateLimiter) Run(ctx context.Context) {
+	if r.perIp == nil && r.perUser == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, limit := range []*rateLimit{r.perIp, r.perUser} {
+				if limit != nil {
+					limit.evict()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var ErrReplicationCompacted = errors.New("Replication checkpoint was compacted in the primary cluster")
+
+/*
+Last revision of the primary cluster whose changes were applied to the secondary cluster.
+It is stored in the secondary cluster once all the changes it covers are applied.
+*/
+type ReplicationCheckpoint struct {
+	Revision  int64
+	Timestamp time.Time
+}
+
+type ReplicationStatus struct {
+	Active               bool      `json:"active"`
+	PrimaryRevision      int64     `json:"primary_revision"`
+	CheckpointRevision   int64     `json:"checkpoint_revision"`
+	CheckpointTimestamp  time.Time `json:"checkpoint_timestamp"`
+	LagRevisions         int64     `json:"lag_revisions"`
+	CheckpointAgeSeconds int64     `json:"checkpoint_age_seconds"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+/*
+Mirrors the state versions and deletions under a prefix of the default cluster to a secondary cluster.
+Changes are followed with an etcd watch resuming from the checkpoint and a full synchronization is done
+when there is no checkpoint or when the checkpoint was compacted in the primary cluster.
+Locks are not replicated.
+The secondary cluster is connected to when replication starts, so that its unavailability doesn't prevent the
+backend from starting.
+*/
+type Replicator struct {
+	config      Config
+	primary     *client.EtcdClient
+	secondary   *client.EtcdClient
+	maintenance *Maintenance
+	lock        sync.Mutex
+	active      bool
+	lastErr     error
+	closed      bool
+}
+
+var ErrSecondaryNotConnected = errors.New("Not connected to the secondary etcd cluster")
+
+func NewReplicator(config Config, primary *client.EtcdClient, maintenance *Maintenance) *Replicator {
+	if len(config.Replication.Secondary.Endpoints) == 0 {
+		return nil
+	}
+
+	return &Replicator{
+		config:      config,
+		primary:     primary,
+		maintenance: maintenance,
+	}
+}
+
+/*
+Connects to the secondary cluster if it isn't already connected
+*/
+func (r *Replicator) connect(ctx context.Context) error {
+	r.lock.Lock()
+	connected := r.secondary != nil
+	r.lock.Unlock()
+	if connected {
+		return nil
+	}
+
+	secondary, secondaryErr := connectEtcd(ctx, r.config.Replication.Secondary)
+	if secondaryErr != nil {
+		return errors.New(fmt.Sprintf("Error connecting to the secondary etcd cluster: %s", secondaryErr.Error()))
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		secondary.Close()
+		return ErrSecondaryNotConnected
+	}
+	r.secondary = secondary
+
+	return nil
+}
+
+/*
+Closes the client of the secondary cluster. Replication cannot resume afterward.
+*/
+func (r *Replicator) Close() {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.closed && r.secondary != nil {
+		r.secondary.Close()
+	}
+	r.closed = true
+}
+
+func (r *Replicator) getCheckpoint() (ReplicationCheckpoint, error) {
+	checkpoint := ReplicationCheckpoint{}
+
+	info, infoErr := r.secondary.GetKey(r.config.Replication.CheckpointKey, client.GetKeyOptions{})
+	if infoErr != nil || !info.Found() {
+		return checkpoint, infoErr
+	}
+
+	unmarshalErr := json.Unmarshal([]byte(info.Value), &checkpoint)
+	return checkpoint, unmarshalErr
+}
+
+func (r *Replicator) putCheckpoint(revision int64) error {
+	output, _ := json.Marshal(ReplicationCheckpoint{Revision: revision, Timestamp: time.Now()})
+	_, err := r.secondary.PutKey(r.config.Replication.CheckpointKey, string(output))
+	return err
+}
+
+/*
+Reads a key of the primary cluster as it was at a given revision
+*/
+func (r *Replicator) getPrimaryKey(key string, revision int64) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(r.primary.Context, r.primary.RequestTimeout)
+	defer cancel()
+
+	res, err := r.primary.Client.Get(ctx, key, clientv3.WithRev(revision))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res.Kvs) == 0 {
+		return nil, false, nil
+	}
+
+	return res.Kvs[0].Value, true, nil
+}
+
+/*
+Reads the version of a state that was current at a revision of the primary cluster.
+If that revision was compacted, the current version of the state is read instead.
+*/
+func (r *Replicator) readPrimaryState(state string, revision int64) (*client.ChunkedKeyInfo, [][]byte, error) {
+	value, found, getErr := r.getPrimaryKey(getStateInfoKey(state), revision)
+	if getErr == rpctypes.ErrCompacted {
+		content, info, readErr := readState(r.primary, state)
+		if readErr != nil || info == nil {
+			return nil, nil, readErr
+		}
+		chunks := [][]byte{}
+		for len(content) > 0 {
+			size := len(content)
+			if size > stateChunkSize {
+				size = stateChunkSize
+			}
+			chunks = append(chunks, content[:size])
+			content = content[size:]
+		}
+		return info, chunks, nil
+	}
+	if getErr != nil || !found {
+		return nil, nil, getErr
+	}
+
+	info := client.ChunkedKeyInfo{}
+	unmarshalErr := json.Unmarshal(value, &info)
+	if unmarshalErr != nil {
+		return nil, nil, unmarshalErr
+	}
+
+	chunks := [][]byte{}
+	for idx := int64(0); idx < info.Count; idx++ {
+		chunk, chunkFound, chunkErr := r.getPrimaryKey(fmt.Sprintf("%s%d", getStateChunkPrefix(state, info.Version), idx), revision)
+		if chunkErr != nil {
+			return nil, nil, chunkErr
+		}
+		if !chunkFound {
+			return nil, nil, errors.New(fmt.Sprintf("Chunk %d of version %d of state %s is missing in the primary cluster", idx, info.Version, state))
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return &info, chunks, nil
+}
+
+/*
+Writes a state version in the secondary cluster with the same version number as in the primary cluster.
+The chunks are written first and the metadata is then written.
+*/
+func (r *Replicator) replicateState(state string, revision int64) error {
+	info, chunks, readErr := r.readPrimaryState(state, revision)
+	if readErr != nil {
+		return readErr
+	}
+	//The state was deleted, which will be replicated by a later event
+	if info == nil {
+		return nil
+	}
+
+	chunksPrefix := getStateChunkPrefix(state, info.Version)
+	clearErr := r.secondary.DeletePrefix(chunksPrefix)
+	if clearErr != nil {
+		return clearErr
+	}
+
+	for idx, chunk := range chunks {
+		_, putErr := r.secondary.PutKey(fmt.Sprintf("%s%d", chunksPrefix, idx), string(chunk))
+		if putErr != nil {
+			return putErr
+		}
+	}
+
+	output, _ := json.Marshal(info)
+	_, putErr := r.secondary.PutKey(getStateInfoKey(state), string(output))
+	if putErr != nil {
+		return putErr
+	}
+
+	//Remove the chunks of the versions that were replaced
+	keys, keysErr := listKeys(r.secondary, fmt.Sprintf("%s/chunks/", getStateKey(state)))
+	if keysErr != nil {
+		return keysErr
+	}
+	for _, key := range keys {
+		chunkState, _, _, isChunk := parseStateChunkKey(key)
+		if !isChunk || chunkState != state || strings.HasPrefix(key, chunksPrefix) {
+			continue
+		}
+		deleteErr := r.secondary.DeleteKey(key)
+		if deleteErr != nil {
+			return deleteErr
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) deleteState(state string) error {
+	return r.secondary.DeletePrefix(fmt.Sprintf("%s/", getStateKey(state)))
+}
+
+/*
+Copies all the states of the primary cluster at its current revision to the secondary cluster and deletes
+the states of the secondary cluster that don't exist in the primary cluster.
+Returns the revision the secondary cluster was synchronized with.
+The checkpoint is only written once all the states are synchronized.
+*/
+func (r *Replicator) synchronize() (int64, error) {
+	ctx, cancel := context.WithTimeout(r.primary.Context, r.primary.RequestTimeout)
+	res, err := r.primary.Client.Get(ctx, r.config.Replication.Prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	revision := res.Header.Revision
+
+	states := map[string]bool{}
+	for _, kv := range res.Kvs {
+		state, isInfo := getStateInfoState(string(kv.Key))
+		if !isInfo {
+			continue
+		}
+
+		states[state] = true
+		replicateErr := r.replicateState(state, revision)
+		if replicateErr != nil {
+			return 0, errors.New(fmt.Sprintf("Error replicating state %s: %s", state, replicateErr.Error()))
+		}
+	}
+
+	secondaryStates, secondaryErr := listStates(r.secondary, r.config.Replication.Prefix)
+	if secondaryErr != nil {
+		return 0, secondaryErr
+	}
+	for _, state := range secondaryStates {
+		if states[state] {
+			continue
+		}
+
+		deleteErr := r.deleteState(state)
+		if deleteErr != nil {
+			return 0, errors.New(fmt.Sprintf("Error deleting state %s: %s", state, deleteErr.Error()))
+		}
+	}
+
+	fmt.Printf("Synchronized %d states with the secondary etcd cluster at revision %d\n", len(states), revision)
+	return revision, r.putCheckpoint(revision)
+}
+
+func (r *Replicator) applyEvent(ev *clientv3.Event) error {
+	state, isInfo := getStateInfoState(string(ev.Kv.Key))
+	if !isInfo {
+		return nil
+	}
+
+	if ev.Type == clientv3.EventTypeDelete {
+		return r.deleteState(state)
+	}
+
+	return r.replicateState(state, ev.Kv.ModRevision)
+}
+
+/*
+Replicates the changes of the primary cluster from the checkpoint until the context is cancelled or an error occurs
+*/
+func (r *Replicator) replicate(ctx context.Context) error {
+	checkpoint, checkpointErr := r.getCheckpoint()
+	if checkpointErr != nil {
+		return checkpointErr
+	}
+
+	revision := checkpoint.Revision
+	if revision == 0 {
+		var syncErr error
+		revision, syncErr = r.synchronize()
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := r.primary.Client.Watch(
+		clientv3.WithRequireLeader(watchCtx),
+		r.config.Replication.Prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithRev(revision+1),
+		clientv3.WithProgressNotify(),
+	)
+
+	ticker := time.NewTicker(r.config.Replication.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if r.maintenance.Enabled() {
+				return ErrMaintenanceMode
+			}
+
+			progressErr := r.primary.Client.RequestProgress(watchCtx)
+			if progressErr != nil {
+				return progressErr
+			}
+		case res, ok := <-wc:
+			if !ok {
+				return errors.New("Watch on the primary etcd cluster was closed")
+			}
+			if res.CompactRevision != 0 {
+				deleteErr := r.secondary.DeleteKey(r.config.Replication.CheckpointKey)
+				if deleteErr != nil {
+					return deleteErr
+				}
+				return ErrReplicationCompacted
+			}
+			if res.Err() != nil {
+				return res.Err()
+			}
+			//Changes that are not applied are replicated from the checkpoint once the maintenance mode is disabled
+			if r.maintenance.Enabled() {
+				return ErrMaintenanceMode
+			}
+
+			for _, ev := range res.Events {
+				applyErr := r.applyEvent(ev)
+				if applyErr != nil {
+					return errors.New(fmt.Sprintf("Error replicating change to key %s: %s", string(ev.Kv.Key), applyErr.Error()))
+				}
+			}
+
+			//The events of a revision, which can change several states in a transaction, are never split across responses.
+			//The checkpoint is only moved once all of them are applied so that an interrupted revision is replicated again.
+			if len(res.Events) > 0 {
+				revision = res.Events[len(res.Events)-1].Kv.ModRevision
+				putErr := r.putCheckpoint(revision)
+				if putErr != nil {
+					return putErr
+				}
+			}
+
+			//All the changes up to the revision of a progress notification were received
+			if res.IsProgressNotify() && res.Header.Revision > revision {
+				revision = res.Header.Revision
+				putErr := r.putCheckpoint(revision)
+				if putErr != nil {
+					return putErr
+				}
+			}
+			replicationLagMetric.Set(float64(res.Header.Revision - revision))
+		}
+	}
+}
+
+func (r *Replicator) setStatus(active bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.active = active
+	r.lastErr = err
+}
+
+func (r *Replicator) Status() (ReplicationStatus, error) {
+	r.lock.Lock()
+	status := ReplicationStatus{Active: r.active}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	connected := r.secondary != nil
+	r.lock.Unlock()
+
+	if !connected {
+		return status, ErrSecondaryNotConnected
+	}
+
+	checkpoint, checkpointErr := r.getCheckpoint()
+	if checkpointErr != nil {
+		return status, checkpointErr
+	}
+
+	revision, revisionErr := getEtcdRevision(r.primary)
+	if revisionErr != nil {
+		return status, revisionErr
+	}
+
+	status.PrimaryRevision = revision
+	status.CheckpointRevision = checkpoint.Revision
+	status.CheckpointTimestamp = checkpoint.Timestamp
+	status.LagRevisions = revision - checkpoint.Revision
+	if checkpoint.Revision > 0 {
+		status.CheckpointAgeSeconds = int64(time.Since(checkpoint.Timestamp) / time.Second)
+	}
+
+	return status, nil
+}
+
+/*
+Holds a lock in the primary cluster for as long as it replicates, so that a single instance of the backend
+replicates at a time
+*/
+func (r *Replicator) runWithLock(ctx context.Context) (bool, error) {
+	lock, alreadyLocked, lockErr := r.primary.AcquireLock(client.AcquireLockOptions{
+		Key:     r.config.Replication.LockKey,
+		Ttl:     30,
+		Timeout: time.Second,
+	})
+	if alreadyLocked || lockErr != nil {
+		return false, lockErr
+	}
+	defer r.primary.ReleaseLock(r.config.Replication.LockKey)
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keepAliveCh, keepAliveErr := r.primary.Client.KeepAlive(lockCtx, lock.Lease)
+	if keepAliveErr != nil {
+		return false, keepAliveErr
+	}
+	go func() {
+		for range keepAliveCh {
+		}
+		//The lock was lost
+		cancel()
+	}()
+
+	r.setStatus(true, nil)
+	return true, r.replicate(lockCtx)
+}
+
+/*
+Replicates until the context is cancelled, retrying after errors, including failures to connect to the secondary cluster.
+Replication is paused while the maintenance mode is enabled.
+*/
+func (r *Replicator) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	defer r.Close()
+
+	for {
+		active := false
+		runErr := ErrMaintenanceMode
+		if !r.maintenance.Enabled() {
+			runErr = r.connect(ctx)
+			if runErr == nil {
+				active, runErr = r.runWithLock(ctx)
+			}
+		}
+		if runErr != nil && runErr != ErrReplicationCompacted && runErr != ErrMaintenanceMode {
+			fmt.Printf("Replication to the secondary etcd cluster failed: %s\n", runErr.Error())
+		}
+		r.setStatus(false, runErr)
+		if active && runErr == ErrReplicationCompacted {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.Replication.RetryInterval):
+		}
+	}
+}
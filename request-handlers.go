@@ -4,8 +4,9 @@ import (
   "fmt"
   "io"
   "net/http"
-  "strconv"
+  "sort"
   "strings"
+  "time"
 
   "github.com/Ferlab-Ste-Justine/etcd-sdk/client"
   "github.com/gin-gonic/gin"
@@ -19,8 +20,8 @@ func getLegacyStatePath(state string, config Config) string {
 	return fmt.Sprintf("%sdefault", state)
 }
 
-func getLegacyState(c *gin.Context, cli *client.EtcdClient, config Config) {
-	statePath := getLegacyStatePath(c.Query("state"), config)
+func getLegacyState(c *gin.Context, state string, cli *client.EtcdClient, config Config) {
+	statePath := getLegacyStatePath(state, config)
 
 	keyInfo, keyErr := cli.GetKey(statePath, client.GetKeyOptions{})
 	if keyErr != nil {
@@ -47,8 +48,8 @@ func getLegacyState(c *gin.Context, cli *client.EtcdClient, config Config) {
 	)
 }
 
-func clearLegacyState(c *gin.Context, cli *client.EtcdClient, config Config) {
-	statePath := getLegacyStatePath(c.Query("state"), config)
+func clearLegacyState(state string, cli *client.EtcdClient, config Config) {
+	statePath := getLegacyStatePath(state, config)
 	keyInfo, keyErr := cli.GetKey(statePath, client.GetKeyOptions{})
 	if keyErr != nil {
 		fmt.Printf("Could not check for legacy state: %s\n", keyErr.Error())
@@ -66,44 +67,158 @@ func clearLegacyState(c *gin.Context, cli *client.EtcdClient, config Config) {
 	}
 }
 
+/*
+Returns the etcd prefix of the state named by a query parameter, or by the path for path-based routes,
+responding with an error if it is missing or invalid
+*/
+func getStateParam(c *gin.Context, param string) (string, bool) {
+	name := c.Query(param)
+	if param == "state" && c.Param("name") != "" {
+		name = c.Param("name")
+	}
+	if name == "" {
+		c.JSON(http.StatusBadRequest , gin.H{
+			"error": fmt.Sprintf("%s%s query parameter is missing", strings.ToUpper(param[:1]), param[1:]),
+		})
+		return "", false
+	}
+
+	state, stateErr := resolveState(name)
+	if stateErr != nil {
+		c.JSON(http.StatusBadRequest , gin.H{
+			"error": stateErr.Error(),
+		})
+		return "", false
+	}
+
+	if !checkAuthorization(c, state, false) {
+		return "", false
+	}
+
+	return state, true
+}
+
+/*
+Returns the etcd prefix matching the prefix query parameter, responding with an error if it is invalid
+*/
+func getPrefixParam(c *gin.Context) (string, bool) {
+	prefix, prefixErr := resolveStatePrefix(c.Query("prefix"))
+	if prefixErr != nil {
+		c.JSON(http.StatusBadRequest , gin.H{
+			"error": prefixErr.Error(),
+		})
+		return "", false
+	}
+
+	if !checkAuthorization(c, prefix, true) {
+		return "", false
+	}
+
+	return prefix, true
+}
+
+/*
+Dispatches the path-based routes of the form /states/<name><suffix> to the handler of their suffix, where
+the suffix is empty for the state itself. The state name in the path is stripped of its suffix before the handler runs.
+*/
+func getStatePathHandler(handlers map[string]gin.HandlerFunc) gin.HandlerFunc {
+	suffixes := []string{}
+	for suffix := range handlers {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool { return len(suffixes[i]) > len(suffixes[j]) })
+
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		for _, suffix := range suffixes {
+			if suffix != "" && !strings.HasSuffix(name, suffix) {
+				continue
+			}
+
+			for idx := range c.Params {
+				if c.Params[idx].Key == "name" {
+					c.Params[idx].Value = strings.TrimSuffix(name, suffix)
+				}
+			}
+			handlers[suffix](c)
+			return
+		}
+
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "not found",
+		})
+	}
+}
+
 type Handlers struct{
-	AcquireLock gin.HandlerFunc
-	ReleaseLock gin.HandlerFunc
-	UpsertState gin.HandlerFunc
-	GetState    gin.HandlerFunc
-	DeleteState gin.HandlerFunc
-	GetHealth   gin.HandlerFunc
-	Terminate   gin.HandlerFunc
+	AcquireLock      gin.HandlerFunc
+	RenewLock        gin.HandlerFunc
+	ReleaseLock      gin.HandlerFunc
+	GetLock          gin.HandlerFunc
+	ListLocks        gin.HandlerFunc
+	UpsertState      gin.HandlerFunc
+	GetState         gin.HandlerFunc
+	DeleteState      gin.HandlerFunc
+	CopyState        gin.HandlerFunc
+	MoveState        gin.HandlerFunc
+	Fsck             gin.HandlerFunc
+	GetMaintenance   gin.HandlerFunc
+	SetMaintenance   gin.HandlerFunc
+	ResetMaintenance gin.HandlerFunc
+	GetReplication   gin.HandlerFunc
+	CreateToken      gin.HandlerFunc
+	ListTokens       gin.HandlerFunc
+	DeleteToken      gin.HandlerFunc
+	Watch            gin.HandlerFunc
+	GetHealth        gin.HandlerFunc
+	GetReadiness     gin.HandlerFunc
+	Terminate        gin.HandlerFunc
 }
 
-func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct{}) {
-	terminateCh := make(chan struct{})
-	
+func GetHandlers(config Config, clusters *ClusterSet, notifier *Notifier, maintenance *Maintenance, replicator *Replicator, tokens *TokenStore, limiter *RateLimiter, drainer *Drainer, terminator *Terminator) (Handlers, <-chan struct{}) {
 	acquireLock := func(c *gin.Context) {
-		state := c.Query("state")
-		if state == "" {
-			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "State query parameter is missing",
-			})
-			return		
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
 		}
+		cli := clusters.Get(state)
 		
-		leaseTtlStr := c.DefaultQuery("lease_ttl", "600")
-		ttl, ttlErr := strconv.ParseInt(leaseTtlStr, 10, 64)
+		ttl, ttlErr := getLockTtl(state, c.Query("lease_ttl"), config)
 		if ttlErr != nil {
 			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "Lease ttl needs to be in integer format",
+				"error": ttlErr.Error(),
 			})
 			return		
 		}
+
+		holder, holderErr := c.GetRawData()
+		if holderErr != nil {
+			c.JSON(http.StatusBadRequest , gin.H{
+				"error": fmt.Sprintf("Error reading the lock information: %s", holderErr.Error()),
+			})
+			return
+		}
 		
-		state = fmt.Sprintf("%s/lock", state)
-		_, alreadyLocked, lockErr := cli.AcquireLock(client.AcquireLockOptions{
-			Key: state,
-			Ttl: ttl,
-			Timeout: config.Lock.Timeout,
-			RetryInterval: config.Lock.RetryInterval,
-		})
+		//Clients that don't wait still queue for the lock timeout so that they never acquire the lock ahead of waiters
+		wait := config.Lock.Timeout
+		if waitStr := c.Query("wait"); waitStr != "" {
+			var waitErr error
+			wait, waitErr = time.ParseDuration(waitStr)
+			if waitErr != nil || wait <= 0 {
+				c.JSON(http.StatusBadRequest , gin.H{
+					"error": "Wait needs to be a positive golang duration string",
+				})
+				return
+			}
+			if int64(config.Lock.MaxWait) > 0 && wait > config.Lock.MaxWait {
+				c.JSON(http.StatusBadRequest , gin.H{
+					"error": fmt.Sprintf("Wait cannot exceed %s", config.Lock.MaxWait.String()),
+				})
+				return
+			}
+		}
+
+		lock, alreadyLocked, lockErr := acquireLockInQueue(c.Request.Context(), cli, state, ttl, wait, config)
 		if alreadyLocked {
 			c.JSON(http.StatusLocked, gin.H{
 				"status": "locked",
@@ -118,22 +233,86 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 			return
 		}
 
+		terminator.TrackLock(state, cli, lock)
+
+		if len(holder) > 0 {
+			putErr := putLockHolder(cli, state, lock, holder)
+			if putErr != nil {
+				fmt.Printf("Could not store lock information for state %s: %s\n", state, putErr.Error())
+			}
+		}
+
+		notifier.Notify(Event{
+			Type:  EventLockAcquired,
+			State: state,
+			Lock:  getEventLock(holder),
+		})
+
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
 		})
 	}
 
+	renewLockHandler := func(c *gin.Context) {
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
+		}
+		cli := clusters.Get(state)
+
+		ttl, renewErr := renewLock(cli, state, c.Query("ID"))
+		if renewErr == ErrLockNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "not found",
+			})
+			return
+		}
+		if renewErr == ErrLockMismatch {
+			c.JSON(http.StatusConflict, gin.H{
+				"status": "error",
+				"error": renewErr.Error(),
+			})
+			return
+		}
+		if renewErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": renewErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"ttl": ttl,
+		})
+	}
+
 	releaseLock := func(c *gin.Context) {
-		state := c.Query("state")
-		if state == "" {
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
+		}
+		cli := clusters.Get(state)
+
+		requester, requesterErr := c.GetRawData()
+		if requesterErr != nil {
 			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "State query parameter is missing",
+				"error": fmt.Sprintf("Error reading the lock information: %s", requesterErr.Error()),
 			})
-			return		
+			return
 		}
 
-		state = fmt.Sprintf("%s/lock", state)
-		releaseErr := cli.ReleaseLock(state)
+		holder, holderInfo, holderErr := getLockHolder(cli, state)
+		if holderErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": holderErr.Error(),
+			})
+			return
+		}
+
+		releaseErr := cli.ReleaseLock(getLockKey(state))
 		if releaseErr != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
@@ -141,27 +320,103 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 			})
 			return
 		}
+		terminator.UntrackLock(state)
+
+		notifier.Notify(Event{
+			Type:  getReleaseEventType(requester, holderInfo),
+			State: state,
+			Lock:  getEventLock(holder),
+		})
 
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
 		})
 	}
 
-	upsertState := func(c *gin.Context) {
-		state := c.Query("state")
-		if state == "" {
-			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "State query parameter is missing",
+	getLock := func(c *gin.Context) {
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
+		}
+		cli := clusters.Get(state)
+
+		status, statusErr := getLockStatus(cli, state)
+		if statusErr == ErrLockNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "not found",
 			})
-			return		
+			return
+		}
+		if statusErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": statusErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, status)
+	}
+
+	listLocksHandler := func(c *gin.Context) {
+		prefix, prefixOk := getPrefixParam(c)
+		if !prefixOk {
+			return
+		}
+
+		locks, locksErr := listClusterLocks(clusters, prefix)
+		if locksErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": locksErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"locks": locks,
+		})
+	}
+
+	upsertState := func(c *gin.Context) {
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
 		}
+		cli := clusters.Get(state)
 
-		state = fmt.Sprintf("%s/state", state)
-		putErr := cli.PutChunkedKey(&client.ChunkedKeyPayload{
-			Key: state,
-			Value: c.Request.Body,
-			Size: c.Request.ContentLength,
+		_, putErr := putState(drainer.UploadContext(), cli, config, notifier, state, c.Request.Body, c.Request.ContentLength, PutStateOptions{
+			LockId: c.Query("ID"),
+			Force:  c.Query("force") == "true",
 		})
+		if putErr != nil && drainer.UploadContext().Err() != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "error",
+				"error": ErrUploadAborted.Error(),
+			})
+			return
+		}
+		if putErr == ErrUploadTooLarge {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"status": "error",
+				"error": putErr.Error(),
+			})
+			return
+		}
+		if putErr == ErrNotTerraformState {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status": "error",
+				"error": putErr.Error(),
+			})
+			return
+		}
+		if putErr == ErrLineageMismatch || putErr == ErrSerialNotNewer || putErr == ErrSerialConflict {
+			c.JSON(http.StatusConflict, gin.H{
+				"status": "error",
+				"error": putErr.Error(),
+			})
+			return
+		}
 		if putErr != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
@@ -170,26 +425,20 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 			return
 		}
 
-		if config.LegacySupport.Clear {
-			clearLegacyState(c, cli, config)
-		}
-
+		state = getStateKey(state)
 		c.JSON(http.StatusOK, gin.H{
 			"state": state,
 		})
 	}
 
 	getState := func(c *gin.Context) {
-		state := c.Query("state")
-		if state == "" {
-			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "State query parameter is missing",
-			})
-			return		
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
 		}
+		cli := clusters.Get(state)
 
-		state = fmt.Sprintf("%s/state", state)
-		payload, getErr := cli.GetChunkedKey(state)
+		payload, getErr := cli.GetChunkedKey(getStateKey(state))
 		if getErr != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
@@ -201,7 +450,7 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 		//No data
 		if payload == nil {
 			if config.LegacySupport.Read {
-				getLegacyState(c, cli, config)
+				getLegacyState(c, state, cli, config)
 				return
 			}
 
@@ -216,16 +465,278 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 	}
 
 	deleteState := func(c *gin.Context) {
-		state := c.Query("state")
-		if state == "" {
+		state, stateOk := getStateParam(c, "state")
+		if !stateOk {
+			return
+		}
+		cli := clusters.Get(state)
+
+		deleteErr := cli.DeleteChunkedKey(getStateKey(state))
+		if deleteErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": deleteErr.Error(),
+			})
+			return
+		}
+
+		notifier.Notify(Event{
+			Type:  EventStateDeleted,
+			State: state,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"state": getStateKey(state),
+		})
+	}
+
+	getCopyStateHandler := func(move bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			from, fromOk := getStateParam(c, "from")
+			if !fromOk {
+				return
+			}
+			to, toOk := getStateParam(c, "to")
+			if !toOk {
+				return
+			}
+			if from == to {
+				c.JSON(http.StatusBadRequest , gin.H{
+					"error": "From and to query parameters need to be different",
+				})
+				return
+			}
+
+			cli := clusters.Get(from)
+			if clusters.GetCluster(from) != clusters.GetCluster(to) {
+				c.JSON(http.StatusBadRequest , gin.H{
+					"error": "From and to states need to be stored in the same etcd cluster",
+				})
+				return
+			}
+
+			copyErr := copyState(cli, from, to, move)
+			if copyErr == ErrStateNotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"status": "not found",
+				})
+				return
+			}
+			if copyErr == ErrStateLocked {
+				c.JSON(http.StatusLocked, gin.H{
+					"status": "locked",
+				})
+				return
+			}
+			if copyErr == ErrStateExists || copyErr == ErrStateChanged {
+				c.JSON(http.StatusConflict, gin.H{
+					"status": "error",
+					"error": copyErr.Error(),
+				})
+				return
+			}
+			if copyErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status": "error",
+					"error": copyErr.Error(),
+				})
+				return
+			}
+
+			if move {
+				notifier.Notify(Event{
+					Type:  EventStateDeleted,
+					State: from,
+				})
+			}
+			notifier.Notify(Event{
+				Type:    EventStateUpdated,
+				State:   to,
+				Version: getEventVersion(cli, to),
+			})
+
+			c.JSON(http.StatusOK, gin.H{
+				"state": getStateKey(to),
+			})
+		}
+	}
+
+	getFsckHandler := func(repair bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			prefix, prefixOk := getPrefixParam(c)
+			if !prefixOk {
+				return
+			}
+
+			opts := FsckOptions{Repair: repair}
+			if repair {
+				store, storeErr := newBackupStore(config.Backups)
+				if storeErr != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{
+						"status": "error",
+						"error": storeErr.Error(),
+					})
+					return
+				}
+				opts.Backups = store
+			}
+
+			report, checkErr := checkClusterStates(clusters, prefix, opts)
+			for _, stateReport := range report.States {
+				if stateReport.Repaired {
+					notifier.Notify(Event{
+						Type:    EventStateUpdated,
+						State:   stateReport.State,
+						Version: getEventVersion(clusters.Get(stateReport.State), stateReport.State),
+					})
+				}
+			}
+			if checkErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status": "error",
+					"error": checkErr.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, report)
+		}
+	}
+
+	//Repairs write states, so they are rejected in maintenance mode like other writes
+	checkFsck := getFsckHandler(false)
+	repairFsck := maintenance.Guard(getFsckHandler(true))
+	fsck := func(c *gin.Context) {
+		if c.Query("repair") == "true" {
+			repairFsck(c)
+			return
+		}
+
+		checkFsck(c)
+	}
+
+	getMaintenance := func(c *gin.Context) {
+		c.JSON(http.StatusOK, maintenance.Status())
+	}
+
+	setMaintenance := func(c *gin.Context) {
+		var body struct {
+			Enabled *bool  `json:"enabled"`
+			Message string `json:"message"`
+		}
+		bindErr := c.ShouldBindJSON(&body)
+		if bindErr != nil || body.Enabled == nil {
 			c.JSON(http.StatusBadRequest , gin.H{
-				"error": "State query parameter is missing",
+				"error": "Body needs to be a json object with an enabled boolean and an optional message",
 			})
-			return		
+			return
 		}
 
-		state = fmt.Sprintf("%s/state", state)
-		deleteErr := cli.DeleteChunkedKey(state)
+		status, setErr := maintenance.Set(*body.Enabled, body.Message)
+		if setErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": setErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, status)
+	}
+
+	resetMaintenance := func(c *gin.Context) {
+		status, resetErr := maintenance.Reset()
+		if resetErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": resetErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, status)
+	}
+
+	createToken := func(c *gin.Context) {
+		var body struct {
+			Name        string       `json:"name"`
+			Permissions []Permission `json:"permissions"`
+			ExpiresIn   string       `json:"expires_in"`
+		}
+		bindErr := c.ShouldBindJSON(&body)
+		if bindErr != nil {
+			c.JSON(http.StatusBadRequest , gin.H{
+				"error": "Body needs to be a json object with a name, a list of permissions and an optional expires_in duration",
+			})
+			return
+		}
+
+		var expiresIn time.Duration
+		if body.ExpiresIn != "" {
+			var expiresInErr error
+			expiresIn, expiresInErr = time.ParseDuration(body.ExpiresIn)
+			if expiresInErr != nil {
+				c.JSON(http.StatusBadRequest , gin.H{
+					"error": "Expires_in needs to be a golang duration string",
+				})
+				return
+			}
+		}
+
+		opts := ApiTokenOptions{
+			Name:        body.Name,
+			Permissions: body.Permissions,
+			ExpiresIn:   expiresIn,
+			CreatedBy:   getPrincipalName(c),
+		}
+		validationErr := tokens.Validate(opts)
+		if validationErr != nil {
+			c.JSON(http.StatusBadRequest , gin.H{
+				"error": validationErr.Error(),
+			})
+			return
+		}
+
+		if !checkGrants(c, opts.Permissions) {
+			return
+		}
+
+		secret, token, createErr := tokens.Create(opts)
+		if createErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": createErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"token": secret,
+			"info": token,
+		})
+	}
+
+	listTokens := func(c *gin.Context) {
+		list, listErr := tokens.List()
+		if listErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": listErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+
+	deleteToken := func(c *gin.Context) {
+		deleteErr := tokens.Delete(c.Param("id"))
+		if deleteErr == ErrTokenNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "not found",
+			})
+			return
+		}
 		if deleteErr != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
@@ -235,44 +746,150 @@ func GetHandlers(config Config, cli *client.EtcdClient) (Handlers, <-chan struct
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"state": state,
+			"status": "ok",
 		})
 	}
 
+	getReplication := func(c *gin.Context) {
+		if replicator == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status": "not found",
+				"error": "Replication is not configured",
+			})
+			return
+		}
+
+		status, statusErr := replicator.Status()
+		if statusErr == ErrSecondaryNotConnected {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "unavailable",
+				"error": statusErr.Error(),
+			})
+			return
+		}
+		if statusErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": statusErr.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, status)
+	}
+
+	watch := func(c *gin.Context) {
+		prefix, prefixOk := getPrefixParam(c)
+		if !prefixOk {
+			return
+		}
+
+		lastEventId := c.GetHeader("Last-Event-ID")
+		if lastEventId == "" {
+			lastEventId = c.Query("last_event_id")
+		}
+
+		watched := clusters.GetOverlapping(prefix)
+		startRevisions, revisionErr := getWatchStartRevisions(lastEventId, watched)
+		if revisionErr != nil {
+			c.JSON(http.StatusBadRequest , gin.H{
+				"error": revisionErr.Error(),
+			})
+			return
+		}
+
+		streamWatchEvents(c, clusters, watched, prefix, startRevisions, config.Server.WatchKeepAlive, drainer.Draining())
+	}
+
 	getHealth := func(c *gin.Context) {
-		_, err := cli.GetMembers(false)
-		if err != nil {
+		errs := clusters.CheckHealth()
+
+		statuses := map[string]string{}
+		for _, cluster := range clusters.Clusters {
+			statuses[cluster.Name] = "ok"
+			if err, ok := errs[cluster.Name]; ok {
+				statuses[cluster.Name] = err.Error()
+			}
+		}
+
+		if err, ok := errs[defaultClusterName]; ok {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status": "error",
 				"error": err.Error(),
+				"clusters": statuses,
 			})
 			return	
 		}
+		if len(errs) > 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+				"error": "Some etcd clusters are unreachable",
+				"clusters": statuses,
+			})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
+			"clusters": statuses,
 		})
 	}
 
-	terminate := func(c *gin.Context) {
-		if c != nil {
-			fmt.Println("Termination triggered via api")
+	getReadiness := func(c *gin.Context) {
+		if drainer.IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "draining",
+			})
+			return
+		}
 
-			c.JSON(http.StatusOK, gin.H{
-				"status": "ok",
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+	}
+
+	terminate := func(c *gin.Context) {
+		if c.Query("wait_for_locks") == "true" {
+			held := terminator.HeldLocks()
+			fmt.Printf("Termination triggered via api, once the %d locks held by this instance are released\n", held)
+			terminator.TerminateWhenUnlocked()
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"status": "waiting",
+				"locks": held,
 			})
+			return
 		}
 
-		close(terminateCh)
+		fmt.Println("Termination triggered via api")
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+		terminator.Terminate()
 	}
 
 	return Handlers{
-		AcquireLock: acquireLock,
-		ReleaseLock: releaseLock,
-		UpsertState: upsertState,
-		GetState:    getState,
-		DeleteState: deleteState,
-		GetHealth:   getHealth,
-		Terminate:   terminate,
-	}, terminateCh
+		AcquireLock:      authorize(OperationLock, maintenance.Guard(acquireLock)),
+		RenewLock:        authorize(OperationLock, renewLockHandler),
+		ReleaseLock:      authorize(OperationLock, releaseLock),
+		GetLock:          authorize(OperationRead, getLock),
+		ListLocks:        authorize(OperationRead, listLocksHandler),
+		UpsertState:      authorize(OperationWrite, maintenance.Guard(limiter.LimitUploads(drainer.TrackUpload(upsertState)))),
+		GetState:         authorize(OperationRead, getState),
+		DeleteState:      authorize(OperationWrite, maintenance.Guard(deleteState)),
+		CopyState:        authorize(OperationWrite, maintenance.Guard(getCopyStateHandler(false))),
+		MoveState:        authorize(OperationWrite, maintenance.Guard(getCopyStateHandler(true))),
+		Fsck:             authorize(OperationAdmin, fsck),
+		GetMaintenance:   authorize(OperationAdmin, getMaintenance),
+		SetMaintenance:   authorize(OperationAdmin, setMaintenance),
+		ResetMaintenance: authorize(OperationAdmin, resetMaintenance),
+		GetReplication:   authorize(OperationAdmin, getReplication),
+		CreateToken:      authorize(OperationAdmin, createToken),
+		ListTokens:       authorize(OperationAdmin, listTokens),
+		DeleteToken:      authorize(OperationAdmin, deleteToken),
+		Watch:            authorize(OperationRead, watch),
+		GetHealth:        getHealth,
+		GetReadiness:     getReadiness,
+		Terminate:        terminator.Guard(terminate),
+	}, terminator.Done()
 }
\ No newline at end of file
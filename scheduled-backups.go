@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var backupVersionRegex = regexp.MustCompile(`-v(\d+)\.tfstate$`)
+
+/*
+Destination of scheduled backups.
+Object names are slash separated, with the first segment identifying the state.
+*/
+type BackupStore interface {
+	Put(name string, content []byte) error
+	Get(name string) ([]byte, error)
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+type directoryBackupStore struct {
+	directory string
+}
+
+func (s *directoryBackupStore) Put(name string, content []byte) error {
+	path := filepath.Join(s.directory, filepath.FromSlash(name))
+	mkdirErr := os.MkdirAll(filepath.Dir(path), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+
+	//Write to a temporary file first so that a partial backup is never mistaken for a complete one
+	tmpPath := fmt.Sprintf("%s.tmp", path)
+	writeErr := os.WriteFile(tmpPath, content, 0600)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (s *directoryBackupStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.directory, filepath.FromSlash(name)))
+}
+
+func (s *directoryBackupStore) List(prefix string) ([]string, error) {
+	dir := filepath.Join(s.directory, filepath.FromSlash(prefix))
+	entries, readErr := os.ReadDir(dir)
+	if os.IsNotExist(readErr) {
+		return []string{}, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		names = append(names, prefix+entry.Name())
+	}
+
+	return names, nil
+}
+
+func (s *directoryBackupStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.directory, filepath.FromSlash(name)))
+}
+
+type s3BackupStore struct {
+	client  *minio.Client
+	bucket  string
+	path    string
+	timeout time.Duration
+}
+
+func (s *s3BackupStore) Put(name string, content []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, s.bucket, s.path+name, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	})
+	return err
+}
+
+func (s *s3BackupStore) Get(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	obj, getErr := s.client.GetObject(ctx, s.bucket, s.path+name, minio.GetObjectOptions{})
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer obj.Close()
+
+	return io.ReadAll(obj)
+}
+
+func (s *s3BackupStore) List(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	names := []string{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.path + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, s.path))
+	}
+
+	return names, nil
+}
+
+func (s *s3BackupStore) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	return s.client.RemoveObject(ctx, s.bucket, s.path+name, minio.RemoveObjectOptions{})
+}
+
+func newS3BackupStore(conf ConfigBackupS3) (*s3BackupStore, error) {
+	transport, transportErr := minio.DefaultTransport(!conf.Insecure)
+	if transportErr != nil {
+		return nil, transportErr
+	}
+
+	if conf.CaCert != "" {
+		caCert, caErr := ioutil.ReadFile(conf.CaCert)
+		if caErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading the s3 ca certificate: %s", caErr.Error()))
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("Error parsing the s3 ca certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	s3Client, clientErr := minio.New(conf.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, ""),
+		Secure:    !conf.Insecure,
+		Region:    conf.Region,
+		Transport: transport,
+	})
+	if clientErr != nil {
+		return nil, clientErr
+	}
+
+	path := conf.Path
+	if path != "" && !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	return &s3BackupStore{
+		client:  s3Client,
+		bucket:  conf.Bucket,
+		path:    path,
+		timeout: conf.RequestTimeout,
+	}, nil
+}
+
+/*
+Returns the store of the scheduled backups, or nil if none is configured
+*/
+func newBackupStore(conf ConfigBackups) (BackupStore, error) {
+	if conf.Directory != "" {
+		return &directoryBackupStore{directory: conf.Directory}, nil
+	}
+
+	if conf.S3.Endpoint == "" {
+		return nil, nil
+	}
+
+	return newS3BackupStore(conf.S3)
+}
+
+/*
+Periodically exports the states that changed since the previous run to a backup store, one object per state version,
+and prunes the versions of each state beyond the retention count.
+Backups run at a fixed interval or on a cron schedule.
+*/
+type BackupScheduler struct {
+	config      Config
+	cli         *client.EtcdClient
+	maintenance *Maintenance
+	store       BackupStore
+	schedule    *CronSchedule
+}
+
+func NewBackupScheduler(config Config, cli *client.EtcdClient, maintenance *Maintenance) (*BackupScheduler, error) {
+	if int64(config.Backups.Interval) == 0 && config.Backups.Schedule == "" {
+		return nil, nil
+	}
+
+	var schedule *CronSchedule
+	if config.Backups.Schedule != "" {
+		var scheduleErr error
+		schedule, scheduleErr = parseCronSchedule(config.Backups.Schedule)
+		if scheduleErr != nil {
+			return nil, scheduleErr
+		}
+	}
+
+	store, storeErr := newBackupStore(config.Backups)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	return &BackupScheduler{
+		config:      config,
+		cli:         cli,
+		maintenance: maintenance,
+		store:       store,
+		schedule:    schedule,
+	}, nil
+}
+
+/*
+Returns the prefix of the exports of a state in the backup store.
+The state is url encoded into a single segment, with dots also encoded for . and .. so that they can't be
+interpreted as relative paths by the directory store.
+*/
+func getBackupStatePrefix(state string) string {
+	escaped := url.PathEscape(state)
+	if escaped == "." || escaped == ".." {
+		escaped = strings.ReplaceAll(escaped, ".", "%2E")
+	}
+
+	return fmt.Sprintf("%s/", escaped)
+}
+
+/*
+Returns the time of the first run after the given time
+*/
+func (s *BackupScheduler) getNextRun(after time.Time) time.Time {
+	if s.schedule != nil {
+		return s.schedule.Next(after)
+	}
+
+	return after.Add(s.config.Backups.Interval)
+}
+
+func getBackupVersion(name string) int64 {
+	match := backupVersionRegex.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+
+	version, _ := strconv.ParseInt(match[1], 10, 64)
+	return version
+}
+
+/*
+Returns the version of a state that was last exported.
+It is looked up in the backup store rather than remembered as another instance may have run the previous backup.
+*/
+func (s *BackupScheduler) getLastVersion(state string) (int64, error) {
+	names, listErr := s.store.List(getBackupStatePrefix(state))
+	if listErr != nil {
+		return 0, listErr
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	sort.Strings(names)
+	return getBackupVersion(names[len(names)-1]), nil
+}
+
+func (s *BackupScheduler) prune(state string) error {
+	if s.config.Backups.Retention <= 0 {
+		return nil
+	}
+
+	names, listErr := s.store.List(getBackupStatePrefix(state))
+	if listErr != nil {
+		return listErr
+	}
+	sort.Strings(names)
+
+	for len(names) > s.config.Backups.Retention {
+		deleteErr := s.store.Delete(names[0])
+		if deleteErr != nil {
+			return deleteErr
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+func (s *BackupScheduler) exportState(state string) (bool, error) {
+	info, _, infoErr := getStateInfo(s.cli, state)
+	if infoErr != nil || info == nil {
+		return false, infoErr
+	}
+
+	lastVersion, lastErr := s.getLastVersion(state)
+	if lastErr != nil {
+		return false, lastErr
+	}
+	if info.Version == lastVersion {
+		return false, nil
+	}
+
+	content, readInfo, readErr := readState(s.cli, state)
+	if readErr != nil || readInfo == nil {
+		return false, readErr
+	}
+
+	name := fmt.Sprintf("%s%s-v%d.tfstate", getBackupStatePrefix(state), time.Now().UTC().Format("20060102T150405Z"), readInfo.Version)
+	putErr := s.store.Put(name, content)
+	if putErr != nil {
+		return false, putErr
+	}
+
+	return true, s.prune(state)
+}
+
+func (s *BackupScheduler) runOnce() error {
+	states, statesErr := listStates(s.cli, s.config.Backups.Prefix)
+	if statesErr != nil {
+		return statesErr
+	}
+
+	exported := 0
+	for _, state := range states {
+		ok, exportErr := s.exportState(state)
+		if exportErr != nil {
+			return errors.New(fmt.Sprintf("Error exporting state %s: %s", state, exportErr.Error()))
+		}
+		if ok {
+			exported += 1
+			backupStatesMetric.Inc()
+		}
+	}
+
+	fmt.Printf("Scheduled backup exported %d changed states out of %d\n", exported, len(states))
+	return nil
+}
+
+/*
+Runs the scheduled backups until the context is cancelled, skipping the runs that happen in maintenance mode.
+A lock in etcd ensures that only one instance of the backend runs a given backup when several are deployed.
+*/
+func (s *BackupScheduler) Run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+
+	next := s.getNextRun(time.Now())
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			current := next
+			next = s.getNextRun(current)
+			//Runs missed while the previous one was in progress are skipped
+			if next.Before(time.Now()) {
+				next = s.getNextRun(time.Now())
+			}
+			timer.Reset(time.Until(next))
+
+			if s.maintenance.Enabled() {
+				continue
+			}
+
+			_, alreadyLocked, lockErr := s.cli.AcquireLock(client.AcquireLockOptions{
+				Key:     s.config.Backups.LockKey,
+				Ttl:     int64(next.Sub(current)/time.Second) + 60,
+				Timeout: time.Second,
+			})
+			if alreadyLocked {
+				continue
+			}
+			if lockErr != nil {
+				fmt.Printf("Could not acquire scheduled backup lock: %s\n", lockErr.Error())
+				backupRunsMetric.WithLabelValues("failure").Inc()
+				continue
+			}
+
+			runErr := s.runOnce()
+			if runErr != nil {
+				fmt.Printf("Scheduled backup failed: %s\n", runErr.Error())
+				backupRunsMetric.WithLabelValues("failure").Inc()
+			} else {
+				backupRunsMetric.WithLabelValues("success").Inc()
+				backupLastSuccessMetric.SetToCurrentTime()
+			}
+
+			releaseErr := s.cli.ReleaseLock(s.config.Backups.LockKey)
+			if releaseErr != nil {
+				fmt.Printf("Could not release scheduled backup lock: %s\n", releaseErr.Error())
+			}
+		}
+	}
+}
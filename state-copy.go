@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var ErrStateNotFound = errors.New("Source state not found")
+var ErrStateExists = errors.New("Target state already exists")
+var ErrStateLocked = errors.New("Source or target state is locked")
+var ErrStateChanged = errors.New("Source or target state changed during the copy")
+
+func isStateLocked(cli *client.EtcdClient, state string) (bool, error) {
+	_, lockErr := readLock(cli, state)
+	if lockErr == ErrLockNotFound {
+		return false, nil
+	}
+
+	return lockErr == nil, lockErr
+}
+
+/*
+Copies the chunks of a state's current version under the target state, keeping the version number.
+The chunks are not visible as a state until the target's metadata is written.
+*/
+func copyStateChunks(cli *client.EtcdClient, from string, to string, info *client.ChunkedKeyInfo) error {
+	clearErr := cli.DeletePrefix(getStateChunkPrefix(to, info.Version))
+	if clearErr != nil {
+		return clearErr
+	}
+
+	for idx := int64(0); idx < info.Count; idx++ {
+		chunk, chunkErr := cli.GetKey(fmt.Sprintf("%s%d", getStateChunkPrefix(from, info.Version), idx), client.GetKeyOptions{})
+		if chunkErr != nil {
+			return chunkErr
+		}
+		//A new version of the source was written and the chunks of the copied version were deleted
+		if !chunk.Found() {
+			return ErrStateChanged
+		}
+
+		_, putErr := cli.PutKey(fmt.Sprintf("%s%d", getStateChunkPrefix(to, info.Version), idx), chunk.Value)
+		if putErr != nil {
+			return putErr
+		}
+	}
+
+	return nil
+}
+
+/*
+Removes the chunks copied for a target state that didn't get created, unless the target was created in the meantime
+*/
+func clearCopiedStateChunks(cli *client.EtcdClient, to string, version int64) {
+	targetInfo, _, targetErr := getStateInfo(cli, to)
+	if targetErr != nil || targetInfo != nil {
+		return
+	}
+
+	clearErr := cli.DeletePrefix(getStateChunkPrefix(to, version))
+	if clearErr != nil {
+		fmt.Printf("Could not clear the copied chunks of state %s: %s\n", to, clearErr.Error())
+	}
+}
+
+/*
+Copies a state to a target that doesn't exist, server-side.
+The chunks are copied first and the target's metadata is then written in a transaction that fails if the source was
+modified, the target was created or either state was locked in the meantime.
+When moving, the same transaction deletes the source state's metadata and chunks.
+*/
+func copyState(cli *client.EtcdClient, from string, to string, move bool) error {
+	info, infoRevision, infoErr := getStateInfo(cli, from)
+	if infoErr != nil {
+		return infoErr
+	}
+	if info == nil {
+		return ErrStateNotFound
+	}
+
+	targetInfo, _, targetErr := getStateInfo(cli, to)
+	if targetErr != nil {
+		return targetErr
+	}
+	if targetInfo != nil {
+		return ErrStateExists
+	}
+
+	for _, state := range []string{from, to} {
+		locked, lockedErr := isStateLocked(cli, state)
+		if lockedErr != nil {
+			return lockedErr
+		}
+		if locked {
+			return ErrStateLocked
+		}
+	}
+
+	copyErr := copyStateChunks(cli, from, to, info)
+	if copyErr != nil {
+		clearCopiedStateChunks(cli, to, info.Version)
+		return copyErr
+	}
+
+	output, _ := json.Marshal(info)
+	ops := []clientv3.Op{clientv3.OpPut(getStateInfoKey(to), string(output))}
+	if move {
+		sourcePrefix := fmt.Sprintf("%s/", getStateKey(from))
+		ops = append(ops, clientv3.OpDelete(sourcePrefix, clientv3.WithPrefix()))
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+	defer cancel()
+
+	res, txErr := cli.Client.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(getStateInfoKey(from)), "=", infoRevision),
+		clientv3.Compare(clientv3.CreateRevision(getStateInfoKey(to)), "=", 0),
+		clientv3.Compare(clientv3.CreateRevision(getLockKey(from)), "=", 0),
+		clientv3.Compare(clientv3.CreateRevision(getLockKey(to)), "=", 0),
+	).Then(ops...).Commit()
+	if txErr != nil {
+		return txErr
+	}
+	if !res.Succeeded {
+		clearCopiedStateChunks(cli, to, info.Version)
+		return ErrStateChanged
+	}
+
+	return nil
+}
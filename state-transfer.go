@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	ImportImported      = "imported"
+	ImportWouldImport   = "would import"
+	ImportUnchanged     = "unchanged"
+	ImportSkippedLocked = "skipped: state is locked"
+)
+
+const exportMappingFile = "mapping.yml"
+
+var ErrLineageMismatch = errors.New("Lineage of the state differs from the lineage of the existing state")
+var ErrSerialNotNewer = errors.New("Serial of the state is lower than the serial of the existing state")
+var ErrSerialConflict = errors.New("State has the same serial as the existing state but a different content")
+var ErrNotTerraformState = errors.New("Content is not a terraform state as it doesn't have a lineage and a serial")
+
+/*
+Fields of a terraform state used to determine whether a state can replace another
+*/
+type TerraformStateHeader struct {
+	Lineage *string `json:"lineage"`
+	Serial  *int64  `json:"serial"`
+}
+
+func parseTerraformState(content []byte) (*TerraformStateHeader, error) {
+	var header TerraformStateHeader
+	unmarshalErr := json.Unmarshal(content, &header)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if header.Lineage == nil || header.Serial == nil {
+		return nil, ErrNotTerraformState
+	}
+
+	return &header, nil
+}
+
+func isTerraformState(content []byte) bool {
+	_, err := parseTerraformState(content)
+	return err == nil
+}
+
+/*
+Reads the lineage and serial of a terraform state from the start of its content, where terraform writes them, so that
+large states don't have to be read in full. Returns a reader of the whole content, including the part that was read.
+*/
+func peekTerraformState(content io.Reader) (*TerraformStateHeader, io.Reader, error) {
+	var buf bytes.Buffer
+	decoder := json.NewDecoder(io.TeeReader(content, &buf))
+	peeked := func() io.Reader {
+		return io.MultiReader(bytes.NewReader(buf.Bytes()), content)
+	}
+
+	header := TerraformStateHeader{}
+	token, tokenErr := decoder.Token()
+	if tokenErr != nil || token != json.Delim('{') {
+		return nil, peeked(), getTerraformStateError(tokenErr)
+	}
+
+	for header.Lineage == nil || header.Serial == nil {
+		if !decoder.More() {
+			return nil, peeked(), ErrNotTerraformState
+		}
+
+		key, keyErr := decoder.Token()
+		if keyErr != nil {
+			return nil, peeked(), getTerraformStateError(keyErr)
+		}
+
+		var decodeErr error
+		switch key {
+		case "lineage":
+			decodeErr = decoder.Decode(&header.Lineage)
+		case "serial":
+			decodeErr = decoder.Decode(&header.Serial)
+		default:
+			var value json.RawMessage
+			decodeErr = decoder.Decode(&value)
+		}
+		if decodeErr != nil {
+			return nil, peeked(), getTerraformStateError(decodeErr)
+		}
+	}
+
+	return &header, peeked(), nil
+}
+
+/*
+Errors of the json decoder due to the content are reported as the content not being a terraform state,
+while errors of the underlying reader are returned as is
+*/
+func getTerraformStateError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrNotTerraformState
+	}
+
+	return err
+}
+
+/*
+Applies the same rules as terraform when a state replaces another: the lineage must be the same and the serial must
+not go back. Returns a reader of the new content, which may have been partially read, and whether it is identical to
+the existing state. The states are only read in full when they have the same serial.
+Existing states that are not terraform states can be replaced by any state.
+*/
+func checkStateUpdate(cli *client.EtcdClient, state string, content io.Reader) (io.Reader, bool, error) {
+	header, content, peekErr := peekTerraformState(content)
+	if peekErr != nil {
+		return content, false, peekErr
+	}
+
+	existing, getErr := cli.GetChunkedKey(getStateKey(state))
+	if getErr != nil || existing == nil {
+		return content, false, getErr
+	}
+	defer existing.Close()
+
+	existingHeader, existingContent, existingErr := peekTerraformState(existing)
+	if existingErr == ErrNotTerraformState {
+		return content, false, nil
+	}
+	if existingErr != nil {
+		return content, false, existingErr
+	}
+
+	if *existingHeader.Lineage != *header.Lineage {
+		return content, false, ErrLineageMismatch
+	}
+	if *header.Serial < *existingHeader.Serial {
+		return content, false, ErrSerialNotNewer
+	}
+	if *header.Serial > *existingHeader.Serial {
+		return content, false, nil
+	}
+
+	existingBytes, readErr := ioutil.ReadAll(existingContent)
+	if readErr != nil {
+		return content, false, readErr
+	}
+	contentBytes, readErr := ioutil.ReadAll(content)
+	if readErr != nil {
+		return bytes.NewReader(contentBytes), false, readErr
+	}
+	if !bytes.Equal(existingBytes, contentBytes) {
+		return bytes.NewReader(contentBytes), false, ErrSerialConflict
+	}
+
+	return bytes.NewReader(contentBytes), true, nil
+}
+
+type ImportEntry struct {
+	File  string
+	State string
+	//Content of the state when it doesn't come from its own file, as with consul kv exports
+	Content []byte
+}
+
+type ImportOptions struct {
+	Force  bool
+	DryRun bool
+}
+
+type ImportResult struct {
+	ImportEntry
+	Status string
+	Error  error
+}
+
+/*
+Returns the states of a directory tree of terraform states.
+Each file with a .tfstate extension is imported in the state made of the prefix followed by the file's relative path
+without the extension. A .tfstate file at the root of the tree is imported in the prefix itself.
+*/
+func getDirectoryImportEntries(dir string, prefix string) ([]ImportEntry, error) {
+	entries := []ImportEntry{}
+
+	walkErr := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".tfstate") {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(dir, filePath)
+		if relErr != nil {
+			return relErr
+		}
+
+		entries = append(entries, ImportEntry{
+			File:  filePath,
+			State: path.Join(prefix, strings.TrimSuffix(filepath.ToSlash(rel), ".tfstate")),
+		})
+		return nil
+	})
+
+	return entries, walkErr
+}
+
+/*
+Entry of the json file written by the consul kv export command
+*/
+type consulKvEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+/*
+Value stored by terraform's consul backend in the key of a state that is too large for a single consul key
+*/
+type consulChunkedState struct {
+	Hash   string   `json:"hash"`
+	Chunks []string `json:"chunks"`
+}
+
+/*
+Returns the states of a consul kv export of the keys written by terraform's consul backend.
+Each state is imported in the state made of the prefix followed by its consul key (workspaces other than the default one
+having the -env:<workspace> suffix in consul). States split in chunks are reassembled, gzip compressed states are
+decompressed and the lock keys are skipped.
+*/
+func getConsulImportEntries(exportPath string, prefix string) ([]ImportEntry, error) {
+	b, readErr := ioutil.ReadFile(exportPath)
+	if readErr != nil {
+		return nil, errors.New(fmt.Sprintf("Error reading the consul kv export: %s", readErr.Error()))
+	}
+
+	kvs := []consulKvEntry{}
+	unmarshalErr := json.Unmarshal(b, &kvs)
+	if unmarshalErr != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing the consul kv export: %s", unmarshalErr.Error()))
+	}
+
+	values := map[string][]byte{}
+	for _, kv := range kvs {
+		value, decodeErr := base64.StdEncoding.DecodeString(kv.Value)
+		if decodeErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error decoding the value of consul key %s: %s", kv.Key, decodeErr.Error()))
+		}
+		values[kv.Key] = value
+	}
+
+	chunkKeys := map[string]bool{}
+	chunked := map[string]consulChunkedState{}
+	for key, value := range values {
+		var chunkedState consulChunkedState
+		if json.Unmarshal(value, &chunkedState) == nil && len(chunkedState.Chunks) > 0 {
+			chunked[key] = chunkedState
+			for _, chunkKey := range chunkedState.Chunks {
+				chunkKeys[chunkKey] = true
+			}
+		}
+	}
+
+	entries := []ImportEntry{}
+	for key, value := range values {
+		if chunkKeys[key] || strings.HasSuffix(key, "/.lock") || strings.HasSuffix(key, "/.lockinfo") {
+			continue
+		}
+
+		if chunkedState, isChunked := chunked[key]; isChunked {
+			var buf bytes.Buffer
+			for _, chunkKey := range chunkedState.Chunks {
+				chunk, chunkExists := values[chunkKey]
+				if !chunkExists {
+					return nil, errors.New(fmt.Sprintf("Chunk %s of consul key %s is missing from the export", chunkKey, key))
+				}
+				buf.Write(chunk)
+			}
+			value = buf.Bytes()
+		}
+
+		if len(value) > 1 && value[0] == 0x1f && value[1] == 0x8b {
+			gzipReader, gzipErr := gzip.NewReader(bytes.NewReader(value))
+			if gzipErr != nil {
+				return nil, errors.New(fmt.Sprintf("Error decompressing the value of consul key %s: %s", key, gzipErr.Error()))
+			}
+			decompressed, decompressErr := ioutil.ReadAll(gzipReader)
+			if decompressErr != nil {
+				return nil, errors.New(fmt.Sprintf("Error decompressing the value of consul key %s: %s", key, decompressErr.Error()))
+			}
+			value = decompressed
+		}
+
+		entries = append(entries, ImportEntry{
+			File:    fmt.Sprintf("%s:%s", exportPath, key),
+			State:   path.Join(prefix, key),
+			Content: value,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].State < entries[j].State
+	})
+
+	return entries, nil
+}
+
+/*
+Returns the states listed in a yaml mapping file of file paths to states.
+Relative file paths are relative to the directory of the mapping file.
+*/
+func getMappingImportEntries(mappingPath string) ([]ImportEntry, error) {
+	b, readErr := ioutil.ReadFile(mappingPath)
+	if readErr != nil {
+		return nil, errors.New(fmt.Sprintf("Error reading the mapping file: %s", readErr.Error()))
+	}
+
+	mapping := map[string]string{}
+	unmarshalErr := yaml.Unmarshal(b, &mapping)
+	if unmarshalErr != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing the mapping file: %s", unmarshalErr.Error()))
+	}
+
+	entries := []ImportEntry{}
+	for file, state := range mapping {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(mappingPath), file)
+		}
+		entries = append(entries, ImportEntry{File: file, State: state})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+
+	return entries, nil
+}
+
+func importState(cli *client.EtcdClient, config Config, entry ImportEntry, opts ImportOptions) (string, error) {
+	if isInternalState(entry.State) {
+		return "", ErrInternalStateName
+	}
+
+	content := entry.Content
+	if content == nil {
+		var readErr error
+		content, readErr = ioutil.ReadFile(entry.File)
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+
+	_, lockErr := readLock(cli, entry.State)
+	if lockErr == nil {
+		return ImportSkippedLocked, nil
+	}
+	if lockErr != ErrLockNotFound {
+		return "", lockErr
+	}
+
+	if opts.DryRun {
+		unchanged := false
+		if !opts.Force {
+			var checkErr error
+			_, unchanged, checkErr = checkStateUpdate(cli, entry.State, bytes.NewReader(content))
+			if checkErr != nil {
+				return "", checkErr
+			}
+		}
+		if unchanged {
+			return ImportUnchanged, nil
+		}
+		return ImportWouldImport, nil
+	}
+
+	written, putErr := putState(context.Background(), cli, config, nil, entry.State, bytes.NewReader(content), int64(len(content)), PutStateOptions{Force: opts.Force})
+	if putErr != nil {
+		return "", putErr
+	}
+	if !written {
+		return ImportUnchanged, nil
+	}
+
+	return ImportImported, nil
+}
+
+/*
+Imports terraform states from files through the same write path as state uploads.
+An error on a given state doesn't prevent the other states from being imported.
+*/
+func importStates(cli *client.EtcdClient, config Config, entries []ImportEntry, opts ImportOptions) []ImportResult {
+	results := []ImportResult{}
+	for _, entry := range entries {
+		status, importErr := importState(cli, config, entry, opts)
+		results = append(results, ImportResult{
+			ImportEntry: entry,
+			Status:      status,
+			Error:       importErr,
+		})
+	}
+
+	return results
+}
+
+/*
+Exports the states under a prefix in a directory tree with the layout expected by the import command.
+A mapping file of the exported files to their states is written alongside them.
+*/
+func exportStates(cli *client.EtcdClient, prefix string, dir string) ([]ImportEntry, error) {
+	exported := []ImportEntry{}
+	mapping := map[string]string{}
+
+	states, statesErr := listStates(cli, prefix)
+	if statesErr != nil {
+		return exported, statesErr
+	}
+
+	for _, state := range states {
+		rel := strings.TrimPrefix(strings.TrimPrefix(state, prefix), "/")
+		for _, segment := range strings.Split(rel, "/") {
+			if rel != "" && (segment == ".." || segment == "." || segment == "") {
+				return exported, errors.New(fmt.Sprintf("State %s cannot be exported as a file path", state))
+			}
+		}
+		//A state equal to the prefix is exported as .tfstate, which the directory import maps back to the prefix
+		file := fmt.Sprintf("%s.tfstate", rel)
+
+		content, info, readErr := readState(cli, state)
+		if readErr != nil {
+			return exported, errors.New(fmt.Sprintf("Error reading state %s: %s", state, readErr.Error()))
+		}
+		if info == nil {
+			continue
+		}
+
+		filePath := filepath.Join(dir, filepath.FromSlash(file))
+		mkdirErr := os.MkdirAll(filepath.Dir(filePath), 0700)
+		if mkdirErr != nil {
+			return exported, mkdirErr
+		}
+		writeErr := os.WriteFile(filePath, content, 0600)
+		if writeErr != nil {
+			return exported, writeErr
+		}
+
+		mapping[file] = state
+		exported = append(exported, ImportEntry{File: filePath, State: state})
+	}
+
+	output, _ := yaml.Marshal(mapping)
+	return exported, os.WriteFile(filepath.Join(dir, exportMappingFile), output, 0600)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+)
+
+func getStateInfoKey(state string) string {
+	return fmt.Sprintf("%s/info", getStateKey(state))
+}
+
+/*
+Returns the chunked key metadata of a state along with the etcd revision at which it was last modified.
+If the state doesn't exist, nil is returned.
+*/
+func getStateInfo(cli *client.EtcdClient, state string) (*client.ChunkedKeyInfo, int64, error) {
+	keyInfo, keyErr := cli.GetKey(getStateInfoKey(state), client.GetKeyOptions{})
+	if keyErr != nil || !keyInfo.Found() {
+		return nil, 0, keyErr
+	}
+
+	info := client.ChunkedKeyInfo{}
+	unmarshalErr := json.Unmarshal([]byte(keyInfo.Value), &info)
+	if unmarshalErr != nil {
+		return nil, keyInfo.ModRevision, unmarshalErr
+	}
+
+	return &info, keyInfo.ModRevision, nil
+}
+
+type PutStateOptions struct {
+	//Id of the lock held by the uploader, which is kept alive during the upload if upload_keep_alive is set
+	LockId string
+	//Whether to skip the lineage and serial checks against the existing state
+	Force bool
+}
+
+/*
+Persists a new version of a state, spooling it first if its size is unknown.
+This is the write path shared by the state upload endpoint and the import command.
+Unless forced, the state is checked against the existing state with the same lineage and serial rules as terraform
+and isn't written again if it is identical, in which case false is returned.
+The write is aborted if the context is cancelled before all the chunks are written.
+*/
+func putState(ctx context.Context, cli *client.EtcdClient, config Config, notifier *Notifier, state string, body io.Reader, size int64, opts PutStateOptions) (bool, error) {
+	if size < 0 {
+		spooled, spooledSize, spoolErr := spoolBody(&abortableReader{ctx: ctx, reader: body}, config.Server.Upload)
+		if spoolErr != nil {
+			return false, spoolErr
+		}
+		defer spooled.Close()
+		body = spooled
+		size = spooledSize
+	}
+
+	if !opts.Force {
+		var unchanged bool
+		var checkErr error
+		body, unchanged, checkErr = checkStateUpdate(cli, state, body)
+		if checkErr != nil || unchanged {
+			return false, checkErr
+		}
+	}
+	body = &abortableReader{ctx: ctx, reader: body}
+
+	if config.Lock.UploadKeepAlive {
+		stopKeepAlive := keepLockAlive(cli, state, opts.LockId)
+		defer stopKeepAlive()
+	}
+
+	putErr := cli.PutChunkedKey(&client.ChunkedKeyPayload{
+		Key:   getStateKey(state),
+		Value: io.NopCloser(body),
+		Size:  size,
+	})
+	if putErr != nil {
+		return false, putErr
+	}
+
+	if config.LegacySupport.Clear {
+		clearLegacyState(state, cli, config)
+	}
+
+	notifier.Notify(Event{
+		Type:    EventStateUpdated,
+		State:   state,
+		Version: getEventVersion(cli, state),
+	})
+
+	return true, nil
+}
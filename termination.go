@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/gin-gonic/gin"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type terminatorLock struct {
+	cli   *client.EtcdClient
+	lease clientv3.LeaseID
+}
+
+/*
+Handles the remote termination of the backend, which is meant for sidecar usage.
+It keeps track of the locks acquired through this instance so that termination can wait for them to be released.
+*/
+type Terminator struct {
+	ctx         context.Context
+	token       string
+	lock        sync.Mutex
+	locks       map[string]terminatorLock
+	terminateCh chan struct{}
+	once        sync.Once
+	waitOnce    sync.Once
+}
+
+func getTerminationToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error reading the termination token file: %s", err.Error()))
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.New("The termination token file is empty")
+	}
+
+	return token, nil
+}
+
+func NewTerminator(ctx context.Context, conf ConfigTermination) (*Terminator, error) {
+	t := &Terminator{
+		ctx:         ctx,
+		locks:       map[string]terminatorLock{},
+		terminateCh: make(chan struct{}),
+	}
+
+	if conf.TokenFile != "" {
+		token, tokenErr := getTerminationToken(conf.TokenFile)
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+		t.token = token
+	}
+
+	return t, nil
+}
+
+/*
+Returns a channel that is closed when termination is triggered
+*/
+func (t *Terminator) Done() <-chan struct{} {
+	return t.terminateCh
+}
+
+func (t *Terminator) Terminate() {
+	t.once.Do(func() {
+		close(t.terminateCh)
+	})
+}
+
+func (t *Terminator) TrackLock(state string, cli *client.EtcdClient, lock *client.Lock) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.locks[state] = terminatorLock{cli: cli, lease: lock.Lease}
+}
+
+func (t *Terminator) UntrackLock(state string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.locks, state)
+}
+
+/*
+Returns the number of locks acquired through this instance that are still held,
+forgetting the locks that were released or expired
+*/
+func (t *Terminator) HeldLocks() int {
+	t.lock.Lock()
+	tracked := map[string]terminatorLock{}
+	for state, held := range t.locks {
+		tracked[state] = held
+	}
+	t.lock.Unlock()
+
+	released := []string{}
+	for state, held := range tracked {
+		lock, lockErr := readLock(held.cli, state)
+		if lockErr == ErrLockNotFound || (lockErr == nil && lock.Lease != held.lease) {
+			released = append(released, state)
+			continue
+		}
+		if lockErr != nil {
+			fmt.Printf("Could not check the lock of state %s before termination: %s\n", state, lockErr.Error())
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, state := range released {
+		//The lock may have been acquired again through this instance in the meantime
+		if t.locks[state].lease == tracked[state].lease {
+			delete(t.locks, state)
+		}
+	}
+
+	return len(t.locks)
+}
+
+/*
+Triggers termination once all the locks acquired through this instance are released or expired
+*/
+func (t *Terminator) TerminateWhenUnlocked() {
+	t.waitOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				if t.HeldLocks() == 0 {
+					fmt.Println("All the locks held by this instance are released")
+					t.Terminate()
+					return
+				}
+
+				select {
+				case <-t.ctx.Done():
+					return
+				case <-t.terminateCh:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
+
+/*
+Whether a request comes from the loopback interface. The address of the connection is used rather than
+forwarding headers, which clients can set.
+*/
+func isLoopbackRequest(c *gin.Context) bool {
+	host, _, splitErr := net.SplitHostPort(c.Request.RemoteAddr)
+	if splitErr != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+Wraps the termination handler so that it only accepts requests bearing the termination token, as a bearer token or
+basic auth password. Without a token, requests are only accepted from localhost, which includes any request forwarded
+by a proxy running on the same host.
+*/
+func (t *Terminator) Guard(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t.token == "" {
+			if isLoopbackRequest(c) {
+				handler(c)
+				return
+			}
+
+			c.JSON(http.StatusForbidden, gin.H{
+				"status": "forbidden",
+				"error":  "Termination is only allowed from localhost",
+			})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if _, password, ok := c.Request.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 {
+			handler(c)
+			return
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{
+			"status": "forbidden",
+			"error":  "Termination requires the termination token",
+		})
+	}
+}
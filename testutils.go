@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/exec"
+	"path"
 	"testing"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/testutils"
 )
 
 func PathExists(path string) (bool, error) {
@@ -76,4 +82,66 @@ func TerraformDestroy(orchPath string, t *testing.T) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+func LoadTestConfig(content string, t *testing.T) (Config, error) {
+	configPath := path.Join(t.TempDir(), "config.yml")
+	writeErr := os.WriteFile(configPath, []byte(content), 0600)
+	if writeErr != nil {
+		return Config{}, writeErr
+	}
+
+	t.Setenv("ETCD_BACKEND_CONFIG_FILE", configPath)
+	return getConfig()
+}
+
+/*
+Launches the test etcd cluster and connects to it with the root certificate.
+The returned function closes the client and tears down the cluster.
+*/
+func LaunchTestEtcd(t *testing.T) (*client.EtcdClient, func(), error) {
+	currDir, currDirErr := os.Getwd()
+	if currDirErr != nil {
+		return nil, nil, currDirErr
+	}
+
+	testDir := path.Join(currDir, "test")
+	absCertsDir := path.Join(testDir, "certificates", "certs")
+
+	tearDown, launchErr := testutils.LaunchTestEtcdCluster(testDir, testutils.EtcdTestClusterOpts{
+		CaCertPath: path.Join(absCertsDir, "etcd-ca.crt"),
+		ServerCertPath: path.Join(absCertsDir, "etcd-server.crt"),
+		ServerKeyPath: path.Join(absCertsDir, "etcd-server.key"),
+	})
+	if launchErr != nil {
+		return nil, nil, launchErr
+	}
+
+	cli, cliErr := connectEtcd(context.Background(), ConfigEtcdClient{
+		Endpoints: []string{
+			"127.0.0.1:3379",
+			"127.0.0.2:3379",
+			"127.0.0.3:3379",
+		},
+		ConnectionTimeout: 10 * time.Second,
+		RequestTimeout: 10 * time.Second,
+		RetryInterval: 1 * time.Second,
+		Retries: 6,
+		Auth: ConfigEtcdAuth{
+			CaCert: path.Join(absCertsDir, "etcd-ca.crt"),
+			ClientCert: path.Join(absCertsDir, "etcd-root.crt"),
+			ClientKey: path.Join(absCertsDir, "etcd-root.key"),
+		},
+	})
+	if cliErr != nil {
+		tearDown()
+		return nil, nil, cliErr
+	}
+
+	return cli, func() {
+		cli.Close()
+		errs := tearDown()
+		if len(errs) > 0 {
+			t.Errorf("Errors occured tearing down etcd cluster: %s", errs[0].Error())
+		}
+	}, nil
+}
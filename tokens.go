@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+/*
+Prefix of the api tokens, which tells them apart from jwts and basic auth passwords
+*/
+const apiTokenPrefix = "tbe_"
+
+var ErrTokenNotFound = errors.New("Token not found")
+var ErrInvalidToken = errors.New("Token is invalid or expired")
+
+/*
+Api token as stored in etcd. Only the sha256 hash of the secret part of the token is stored.
+*/
+type ApiToken struct {
+	Id          string       `json:"id"`
+	Name        string       `json:"name"`
+	Hash        string       `json:"hash,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	CreatedBy   string       `json:"created_by"`
+	CreatedAt   time.Time    `json:"created_at"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+}
+
+type ApiTokenOptions struct {
+	Name        string
+	Permissions []Permission
+	//Tokens don't expire if it is 0
+	ExpiresIn time.Duration
+	CreatedBy string
+}
+
+func isApiToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+func hashApiTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateRandomHex(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+/*
+Api tokens scoped to prefixes and operations, stored in the default etcd cluster.
+Tokens that expire are bound to a lease so that etcd removes them some time after they expire.
+*/
+type TokenStore struct {
+	cli       *client.EtcdClient
+	prefix    string
+	maxExpiry time.Duration
+}
+
+func NewTokenStore(config Config, cli *client.EtcdClient) *TokenStore {
+	if !config.Tokens.Enabled {
+		return nil
+	}
+
+	return &TokenStore{
+		cli:       cli,
+		prefix:    config.Tokens.Prefix,
+		maxExpiry: config.Tokens.MaxExpiry,
+	}
+}
+
+func (s *TokenStore) getKey(id string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(s.prefix, "/"), id)
+}
+
+func (s *TokenStore) Validate(opts ApiTokenOptions) error {
+	if len(opts.Permissions) == 0 {
+		return errors.New("Tokens need at least one permission")
+	}
+	for _, permission := range opts.Permissions {
+		permissionErr := validatePermission(permission)
+		if permissionErr != nil {
+			return permissionErr
+		}
+	}
+	if opts.ExpiresIn < 0 {
+		return errors.New("Token expiry cannot be negative")
+	}
+	if int64(s.maxExpiry) > 0 && (opts.ExpiresIn == 0 || opts.ExpiresIn > s.maxExpiry) {
+		return errors.New(fmt.Sprintf("Tokens need to expire in %s or less", s.maxExpiry.String()))
+	}
+
+	return nil
+}
+
+/*
+Creates a token, returning it along with its stored information.
+The token is only returned on creation as it cannot be recovered from its hash.
+*/
+func (s *TokenStore) Create(opts ApiTokenOptions) (string, ApiToken, error) {
+	var token ApiToken
+
+	validationErr := s.Validate(opts)
+	if validationErr != nil {
+		return "", token, validationErr
+	}
+
+	id, idErr := generateRandomHex(8)
+	if idErr != nil {
+		return "", token, idErr
+	}
+	secret, secretErr := generateRandomHex(32)
+	if secretErr != nil {
+		return "", token, secretErr
+	}
+
+	token = ApiToken{
+		Id:          id,
+		Name:        opts.Name,
+		Hash:        hashApiTokenSecret(secret),
+		Permissions: opts.Permissions,
+		CreatedBy:   opts.CreatedBy,
+		CreatedAt:   time.Now(),
+	}
+
+	putOpts := []clientv3.OpOption{}
+	ctx, cancel := context.WithTimeout(s.cli.Context, s.cli.RequestTimeout)
+	defer cancel()
+
+	if opts.ExpiresIn > 0 {
+		expiresAt := token.CreatedAt.Add(opts.ExpiresIn)
+		token.ExpiresAt = &expiresAt
+
+		lease, leaseErr := s.cli.Client.Grant(ctx, int64(opts.ExpiresIn/time.Second)+60)
+		if leaseErr != nil {
+			return "", token, leaseErr
+		}
+		putOpts = append(putOpts, clientv3.WithLease(lease.ID))
+	}
+
+	value, marshalErr := json.Marshal(token)
+	if marshalErr != nil {
+		return "", token, marshalErr
+	}
+
+	_, putErr := s.cli.Client.Put(ctx, s.getKey(id), string(value), putOpts...)
+	if putErr != nil {
+		return "", token, putErr
+	}
+
+	token.Hash = ""
+	return fmt.Sprintf("%s%s_%s", apiTokenPrefix, id, secret), token, nil
+}
+
+/*
+Lists the tokens, without their hashes, ordered by creation time.
+Keys nested under the prefix are not tokens, as token ids don't contain slashes.
+*/
+func (s *TokenStore) List() ([]ApiToken, error) {
+	prefix := fmt.Sprintf("%s/", strings.TrimSuffix(s.prefix, "/"))
+	values, getErr := s.cli.GetPrefix(prefix)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	tokens := []ApiToken{}
+	for key, value := range values.Keys {
+		if strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			continue
+		}
+
+		var token ApiToken
+		unmarshalErr := json.Unmarshal([]byte(value.Value), &token)
+		if unmarshalErr != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing token at %s: %s", key, unmarshalErr.Error()))
+		}
+
+		token.Hash = ""
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	return tokens, nil
+}
+
+func (s *TokenStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(s.cli.Context, s.cli.RequestTimeout)
+	defer cancel()
+
+	res, delErr := s.cli.Client.Delete(ctx, s.getKey(id))
+	if delErr != nil {
+		return delErr
+	}
+	if res.Deleted == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+/*
+Validates a token against its stored hash and expiry, returning a client with the permissions of the token
+*/
+func (s *TokenStore) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(strings.TrimPrefix(token, apiTokenPrefix), "_")
+	if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], "/") {
+		return nil, ErrInvalidToken
+	}
+
+	value, getErr := s.cli.GetKey(s.getKey(parts[0]), client.GetKeyOptions{})
+	if getErr != nil {
+		return nil, getErr
+	}
+	if !value.Found() {
+		return nil, ErrInvalidToken
+	}
+
+	var stored ApiToken
+	unmarshalErr := json.Unmarshal([]byte(value.Value), &stored)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashApiTokenSecret(parts[1]))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if stored.ExpiresAt != nil && time.Now().After(*stored.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{
+		Name:        fmt.Sprintf("token/%s", stored.Id),
+		Permissions: stored.Permissions,
+	}, nil
+}
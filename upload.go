@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrUploadTooLarge = errors.New("Uploaded state exceeds the maximum size allowed for bodies of unknown length")
+var ErrUploadAborted = errors.New("Upload aborted as the server is shutting down")
+
+/*
+Reader failing once its context is cancelled, so that an upload can be aborted between two chunks.
+As the version of a state is only committed after all its chunks are written, an aborted upload leaves
+the previous version in place.
+*/
+type abortableReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *abortableReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, ErrUploadAborted
+	}
+
+	return r.reader.Read(p)
+}
+
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	closeErr := f.File.Close()
+	removeErr := os.Remove(f.File.Name())
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+/*
+Bodies sent with chunked transfer encoding (typically re-chunked by a proxy) have no known length,
+but the chunked key storage needs the size upfront. Those bodies are spooled, either in memory or
+in a temporary file if a spool directory is configured, up to the configured maximum size.
+*/
+func spoolBody(body io.Reader, conf ConfigUpload) (io.ReadCloser, int64, error) {
+	limited := io.LimitReader(body, conf.MaxBufferedSize+1)
+
+	if conf.SpoolDirectory == "" {
+		var buf bytes.Buffer
+		size, readErr := buf.ReadFrom(limited)
+		if readErr != nil {
+			return nil, 0, errors.New(fmt.Sprintf("Error reading the uploaded state: %s", readErr.Error()))
+		}
+		if size > conf.MaxBufferedSize {
+			return nil, 0, ErrUploadTooLarge
+		}
+
+		return io.NopCloser(&buf), size, nil
+	}
+
+	f, createErr := os.CreateTemp(conf.SpoolDirectory, "upload-")
+	if createErr != nil {
+		return nil, 0, errors.New(fmt.Sprintf("Error creating the spool file: %s", createErr.Error()))
+	}
+	spooled := &spooledFile{f}
+
+	size, copyErr := io.Copy(spooled, limited)
+	if copyErr != nil {
+		spooled.Close()
+		return nil, 0, errors.New(fmt.Sprintf("Error spooling the uploaded state: %s", copyErr.Error()))
+	}
+	if size > conf.MaxBufferedSize {
+		spooled.Close()
+		return nil, 0, ErrUploadTooLarge
+	}
+
+	_, seekErr := spooled.Seek(0, io.SeekStart)
+	if seekErr != nil {
+		spooled.Close()
+		return nil, 0, errors.New(fmt.Sprintf("Error rewinding the spool file: %s", seekErr.Error()))
+	}
+
+	return spooled, size, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+/*
+Event streamed by the watch endpoint
+*/
+type WatchEvent struct {
+	Type     string `json:"type"`
+	State    string `json:"state"`
+	Revision int64  `json:"revision"`
+	Version  int64  `json:"version,omitempty"`
+	Cluster  string `json:"cluster"`
+}
+
+/*
+Converts an etcd event into a watch event, if it affects a state's metadata or lock
+*/
+func getWatchEvent(ev *clientv3.Event) (*WatchEvent, bool) {
+	key := string(ev.Kv.Key)
+
+	if state, isInfo := getStateInfoState(key); isInfo {
+		if ev.Type == mvccpb.DELETE {
+			return &WatchEvent{Type: EventStateDeleted, State: state, Revision: ev.Kv.ModRevision}, true
+		}
+
+		info := client.ChunkedKeyInfo{}
+		json.Unmarshal(ev.Kv.Value, &info)
+		return &WatchEvent{Type: EventStateUpdated, State: state, Revision: ev.Kv.ModRevision, Version: info.Version}, true
+	}
+
+	if state, isLock := getLockState(key); isLock {
+		if ev.Type == mvccpb.DELETE {
+			return &WatchEvent{Type: EventLockReleased, State: state, Revision: ev.Kv.ModRevision}, true
+		}
+
+		return &WatchEvent{Type: EventLockAcquired, State: state, Revision: ev.Kv.ModRevision}, true
+	}
+
+	return nil, false
+}
+
+/*
+Returns the revision to resume watching each cluster from, given the id of the last event a client received.
+Clusters without a revision in the id are watched from their current revision.
+*/
+func getWatchStartRevisions(lastEventId string, watched []*Cluster) (map[string]int64, error) {
+	revisions := map[string]int64{}
+	if lastEventId == "" {
+		return revisions, nil
+	}
+
+	if !strings.Contains(lastEventId, "=") {
+		if len(watched) != 1 {
+			return nil, errors.New("Last event id needs to have the name=revision format of the events of prefixes spanning several etcd clusters")
+		}
+		lastEventId = fmt.Sprintf("%s=%s", watched[0].Name, lastEventId)
+	}
+
+	names := map[string]bool{}
+	for _, cluster := range watched {
+		names[cluster.Name] = true
+	}
+
+	for _, part := range strings.Split(lastEventId, ",") {
+		nameAndRevision := strings.SplitN(part, "=", 2)
+		if len(nameAndRevision) != 2 || !names[nameAndRevision[0]] {
+			return nil, errors.New(fmt.Sprintf("Last event id refers to an etcd cluster that is not watched: %s", part))
+		}
+
+		revision, err := strconv.ParseInt(nameAndRevision[1], 10, 64)
+		if err != nil || revision < 0 {
+			return nil, errors.New("Last event id needs to contain etcd revisions in integer format")
+		}
+		revisions[nameAndRevision[0]] = revision + 1
+	}
+
+	return revisions, nil
+}
+
+/*
+Returns the id of an event given the last revision streamed for each cluster. It is the etcd revision of the
+change when a single cluster is watched and the revisions of all the clusters in the name=revision,name=revision
+format otherwise.
+*/
+func getWatchEventId(revisions map[string]int64, watched []*Cluster) string {
+	if len(watched) == 1 {
+		return strconv.FormatInt(revisions[watched[0].Name], 10)
+	}
+
+	parts := []string{}
+	for _, cluster := range watched {
+		parts = append(parts, fmt.Sprintf("%s=%d", cluster.Name, revisions[cluster.Name]))
+	}
+	return strings.Join(parts, ",")
+}
+
+type clusterWatchResponse struct {
+	cluster *Cluster
+	res     clientv3.WatchResponse
+	closed  bool
+}
+
+/*
+Streams the state and lock changes under a prefix in the watched clusters as server-sent events until the client
+disconnects or the done channel is closed
+*/
+func streamWatchEvents(c *gin.Context, clusters *ClusterSet, watched []*Cluster, prefix string, startRevisions map[string]int64, keepAlive time.Duration, done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	revisions := map[string]int64{}
+	for _, cluster := range watched {
+		startRevision, resumed := startRevisions[cluster.Name]
+		if !resumed {
+			revision, revisionErr := getEtcdRevision(cluster.Client)
+			if revisionErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status": "error",
+					"error":  fmt.Sprintf("Error getting the revision of etcd cluster %s: %s", cluster.Name, revisionErr.Error()),
+				})
+				return
+			}
+			startRevision = revision + 1
+		}
+		revisions[cluster.Name] = startRevision - 1
+	}
+
+	responses := make(chan clusterWatchResponse)
+	for _, cluster := range watched {
+		wc := cluster.Client.Client.Watch(clientv3.WithRequireLeader(ctx), prefix, clientv3.WithPrefix(), clientv3.WithRev(revisions[cluster.Name]+1))
+		go func(cluster *Cluster, wc clientv3.WatchChan) {
+			for res := range wc {
+				select {
+				case responses <- clusterWatchResponse{cluster: cluster, res: res}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case responses <- clusterWatchResponse{cluster: cluster, closed: true}:
+			case <-ctx.Done():
+			}
+		}(cluster, wc)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		case clusterRes := <-responses:
+			if clusterRes.closed {
+				return
+			}
+			cluster, res := clusterRes.cluster, clusterRes.res
+
+			if res.CompactRevision > 0 {
+				c.Render(-1, sse.Event{
+					Event: "error",
+					Data: gin.H{
+						"error": fmt.Sprintf("Revision %d of etcd cluster %s has been compacted, resume from revision %d or later", revisions[cluster.Name]+1, cluster.Name, res.CompactRevision),
+					},
+				})
+				c.Writer.Flush()
+				return
+			}
+
+			if err := res.Err(); err != nil {
+				c.Render(-1, sse.Event{
+					Event: "error",
+					Data: gin.H{
+						"error": fmt.Sprintf("Error watching etcd cluster %s: %s", cluster.Name, err.Error()),
+					},
+				})
+				c.Writer.Flush()
+				return
+			}
+
+			for _, ev := range res.Events {
+				revisions[cluster.Name] = ev.Kv.ModRevision
+
+				event, ok := getWatchEvent(ev)
+				if !ok || !clusters.Routes(event.State, cluster) {
+					continue
+				}
+				event.Cluster = cluster.Name
+
+				c.Render(-1, sse.Event{
+					Id:    getWatchEventId(revisions, watched),
+					Event: event.Type,
+					Data:  event,
+				})
+			}
+			c.Writer.Flush()
+		}
+	}
+}
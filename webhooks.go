@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ferlab-Ste-Justine/etcd-sdk/client"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	EventStateUpdated      = "state_updated"
+	EventStateDeleted      = "state_deleted"
+	EventLockAcquired      = "lock_acquired"
+	EventLockReleased      = "lock_released"
+	EventLockForceReleased = "lock_force_released"
+	EventLockHeld          = "lock_held"
+)
+
+/*
+Payload sent to webhooks
+*/
+type Event struct {
+	Id        string          `json:"id"`
+	Type      string          `json:"type"`
+	State     string          `json:"state"`
+	Timestamp time.Time       `json:"timestamp"`
+	Version   int64           `json:"version,omitempty"`
+	Lock      json.RawMessage `json:"lock,omitempty"`
+}
+
+/*
+Entry stored in the etcd outbox for each event that is pending delivery to a webhook
+*/
+type OutboxEntry struct {
+	Webhook     string
+	Attempts    uint64
+	NextAttempt time.Time
+	Event       Event
+}
+
+/*
+Records state and lock events in an outbox in etcd and delivers them to the configured webhooks.
+Delivery is at least once: receivers should use the event id to discard duplicates.
+*/
+type Notifier struct {
+	config   Config
+	cli      *client.EtcdClient
+	clusters *ClusterSet
+	http     *http.Client
+}
+
+/*
+The outbox is stored in the default cluster, while held locks are checked in all the clusters
+*/
+func NewNotifier(config Config, clusters *ClusterSet) *Notifier {
+	return &Notifier{
+		config:   config,
+		cli:      clusters.Default.Client,
+		clusters: clusters,
+		http:     &http.Client{Timeout: config.Webhooks.RequestTimeout},
+	}
+}
+
+func webhookHasEvent(webhook ConfigWebhook, eventType string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+
+	for _, evType := range webhook.Events {
+		if evType == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func webhookMatches(webhook ConfigWebhook, event Event) bool {
+	if !webhookHasEvent(webhook, event.Type) {
+		return false
+	}
+
+	return len(webhook.Prefixes) == 0 || hasAnyPrefix(event.State, webhook.Prefixes)
+}
+
+/*
+Whether a state is under one of the prefixes on a segment boundary, so that a webhook for /team-a doesn't receive
+the events of /team-ab
+*/
+func hasAnyPrefix(state string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if hasSegmentPrefix(state, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getEventLock(holder []byte) json.RawMessage {
+	if len(holder) == 0 || !json.Valid(holder) {
+		return nil
+	}
+
+	return json.RawMessage(holder)
+}
+
+func getEventVersion(cli *client.EtcdClient, state string) int64 {
+	info, _, infoErr := getStateInfo(cli, state)
+	if infoErr != nil || info == nil {
+		return 0
+	}
+
+	return info.Version
+}
+
+/*
+A lock is considered force released if the client releasing it didn't identify itself as the lock's holder,
+which is what happens with terraform's force-unlock command.
+*/
+func getReleaseEventType(requester []byte, holder *LockHolder) string {
+	if holder == nil {
+		return EventLockReleased
+	}
+
+	var requesterInfo LockHolder
+	unmarshalErr := json.Unmarshal(requester, &requesterInfo)
+	if unmarshalErr != nil || requesterInfo.ID != holder.ID {
+		return EventLockForceReleased
+	}
+
+	return EventLockReleased
+}
+
+func getEventId() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+}
+
+func (n *Notifier) getOutboxPrefix() string {
+	return fmt.Sprintf("%s/events/", n.config.Webhooks.OutboxPrefix)
+}
+
+func (n *Notifier) getHeldMarkerKey(lease int64) string {
+	return fmt.Sprintf("%s/held/%x", n.config.Webhooks.OutboxPrefix, lease)
+}
+
+/*
+Adds an event to the outbox of every webhook it matches.
+Failures are logged rather than returned as the operation that triggered the event already succeeded.
+*/
+func (n *Notifier) Notify(event Event) {
+	if n == nil || len(n.config.Webhooks.Endpoints) == 0 {
+		return
+	}
+
+	event.Id = getEventId()
+	event.Timestamp = time.Now()
+
+	for _, webhook := range n.config.Webhooks.Endpoints {
+		if !webhookMatches(webhook, event) {
+			continue
+		}
+
+		output, _ := json.Marshal(OutboxEntry{
+			Webhook:     webhook.Name,
+			NextAttempt: event.Timestamp,
+			Event:       event,
+		})
+		_, putErr := n.cli.PutKey(fmt.Sprintf("%s%s/%s", n.getOutboxPrefix(), webhook.Name, event.Id), string(output))
+		if putErr != nil {
+			fmt.Printf("Could not record %s event for state %s in webhook outbox: %s\n", event.Type, event.State, putErr.Error())
+		}
+	}
+}
+
+func (n *Notifier) getWebhook(name string) (ConfigWebhook, bool) {
+	for _, webhook := range n.config.Webhooks.Endpoints {
+		if webhook.Name == name {
+			return webhook, true
+		}
+	}
+
+	return ConfigWebhook{}, false
+}
+
+/*
+Signs the timestamp of a delivery along with its body, so that receivers can reject replayed deliveries
+*/
+func getWebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (n *Notifier) send(webhook ConfigWebhook, event Event) error {
+	body, _ := json.Marshal(event)
+
+	req, reqErr := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", event.Id)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	if webhook.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", getWebhookSignature(webhook.Secret, timestamp, body))
+	}
+
+	res, resErr := n.http.Do(req)
+	if resErr != nil {
+		return resErr
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Webhook responded with status code %d", res.StatusCode))
+	}
+
+	return nil
+}
+
+func (n *Notifier) getBackoff(attempts uint64) time.Duration {
+	backoff := n.config.Webhooks.RetryInterval
+	for idx := uint64(1); idx < attempts && backoff < n.config.Webhooks.MaxRetryInterval; idx++ {
+		backoff = backoff * 2
+	}
+
+	if backoff > n.config.Webhooks.MaxRetryInterval {
+		return n.config.Webhooks.MaxRetryInterval
+	}
+	return backoff
+}
+
+/*
+Claims a pending outbox entry by pushing back its next attempt, using the entry's revision to make sure that only
+one backend instance delivers it at a time.
+*/
+func (n *Notifier) claim(key string, modRevision int64, entry OutboxEntry) (bool, error) {
+	entry.NextAttempt = time.Now().Add(n.config.Webhooks.RequestTimeout + n.config.Webhooks.RetryInterval)
+	output, _ := json.Marshal(entry)
+
+	ctx, cancel := context.WithTimeout(n.cli.Context, n.cli.RequestTimeout)
+	defer cancel()
+
+	res, err := n.cli.Client.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(key), "=", modRevision),
+	).Then(
+		clientv3.OpPut(key, string(output)),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return res.Succeeded, nil
+}
+
+func (n *Notifier) deliver(key string, kv client.KeyInfo) {
+	var entry OutboxEntry
+	unmarshalErr := json.Unmarshal([]byte(kv.Value), &entry)
+	if unmarshalErr != nil {
+		fmt.Printf("Discarding unreadable webhook outbox entry %s: %s\n", key, unmarshalErr.Error())
+		n.cli.DeleteKey(key)
+		return
+	}
+
+	if entry.NextAttempt.After(time.Now()) {
+		return
+	}
+
+	webhook, ok := n.getWebhook(entry.Webhook)
+	if !ok {
+		fmt.Printf("Discarding webhook outbox entry %s as webhook %s is no longer configured\n", key, entry.Webhook)
+		n.cli.DeleteKey(key)
+		return
+	}
+
+	claimed, claimErr := n.claim(key, kv.ModRevision, entry)
+	if claimErr != nil {
+		fmt.Printf("Could not claim webhook outbox entry %s: %s\n", key, claimErr.Error())
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	sendErr := n.send(webhook, entry.Event)
+	if sendErr == nil {
+		deleteErr := n.cli.DeleteKey(key)
+		if deleteErr != nil {
+			fmt.Printf("Could not remove delivered webhook outbox entry %s: %s\n", key, deleteErr.Error())
+		}
+		return
+	}
+
+	entry.Attempts += 1
+	if entry.Attempts > n.config.Webhooks.Retries {
+		fmt.Printf("Giving up on delivering %s event %s to webhook %s after %d attempts: %s\n", entry.Event.Type, entry.Event.Id, webhook.Name, entry.Attempts, sendErr.Error())
+		n.cli.DeleteKey(key)
+		return
+	}
+
+	fmt.Printf("Could not deliver %s event %s to webhook %s, will retry: %s\n", entry.Event.Type, entry.Event.Id, webhook.Name, sendErr.Error())
+	entry.NextAttempt = time.Now().Add(n.getBackoff(entry.Attempts))
+	output, _ := json.Marshal(entry)
+	_, putErr := n.cli.PutKey(key, string(output))
+	if putErr != nil {
+		fmt.Printf("Could not reschedule webhook outbox entry %s: %s\n", key, putErr.Error())
+	}
+}
+
+func (n *Notifier) processOutbox() {
+	entries, entriesErr := n.cli.GetPrefix(n.getOutboxPrefix())
+	if entriesErr != nil {
+		fmt.Printf("Could not read webhook outbox: %s\n", entriesErr.Error())
+		return
+	}
+
+	keys := make([]string, 0, len(entries.Keys))
+	for key := range entries.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		n.deliver(key, entries.Keys[key])
+	}
+}
+
+func (n *Notifier) getHeldLockPrefixes() []string {
+	prefixes := []string{}
+	for _, webhook := range n.config.Webhooks.Endpoints {
+		if !webhookHasEvent(webhook, EventLockHeld) {
+			continue
+		}
+		if len(webhook.Prefixes) == 0 {
+			return []string{""}
+		}
+		prefixes = append(prefixes, webhook.Prefixes...)
+	}
+
+	return prefixes
+}
+
+/*
+Returns the longest prefix shared by a list of prefixes
+*/
+func getCommonPrefix(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return ""
+	}
+
+	common := prefixes[0]
+	for _, prefix := range prefixes[1:] {
+		for !strings.HasPrefix(prefix, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	return common
+}
+
+/*
+Emits a lock held event, once per lock, for the locks that have been held longer than the configured threshold.
+The locks under the prefixes of all the webhooks are listed with a single ranged read per cluster, on the prefix
+they share or on the namespace if it is narrower.
+A marker bound to the lock's lease, in the lock's cluster, is used to remember which locks were already reported.
+*/
+func (n *Notifier) checkHeldLocks() {
+	prefixes := n.getHeldLockPrefixes()
+	if len(prefixes) == 0 {
+		return
+	}
+
+	scope := getCommonPrefix(prefixes)
+	namespace, _ := resolveStatePrefix("")
+	if strings.HasPrefix(namespace, scope) {
+		scope = namespace
+	}
+
+	for _, cluster := range n.clusters.GetOverlapping(scope) {
+		locks, locksErr := listLocks(cluster.Client, scope)
+		if locksErr != nil {
+			fmt.Printf("Could not list locks of etcd cluster %s to check for held locks: %s\n", cluster.Name, locksErr.Error())
+			continue
+		}
+
+		for _, lock := range locks {
+			if !n.clusters.Routes(lock.State, cluster) || !hasAnyPrefix(lock.State, prefixes) {
+				continue
+			}
+			if time.Since(lock.AcquiredAt) < n.config.Webhooks.LockHeldThreshold {
+				continue
+			}
+
+			cli := cluster.Client
+			markerKey := n.getHeldMarkerKey(lock.Lease)
+			ctx, cancel := context.WithTimeout(cli.Context, cli.RequestTimeout)
+			res, txErr := cli.Client.Txn(ctx).If(
+				clientv3.Compare(clientv3.Version(markerKey), "=", 0),
+			).Then(
+				clientv3.OpPut(markerKey, lock.State, clientv3.WithLease(clientv3.LeaseID(lock.Lease))),
+			).Commit()
+			cancel()
+			if txErr != nil {
+				fmt.Printf("Could not mark lock of state %s as reported: %s\n", lock.State, txErr.Error())
+				continue
+			}
+			if !res.Succeeded {
+				continue
+			}
+
+			n.Notify(Event{
+				Type:  EventLockHeld,
+				State: lock.State,
+				Lock:  lock.Holder,
+			})
+		}
+	}
+}
+
+/*
+Delivers the events in the outbox until the context is cancelled
+*/
+func (n *Notifier) Run(ctx context.Context) {
+	if n == nil || len(n.config.Webhooks.Endpoints) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(n.config.Webhooks.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if int64(n.config.Webhooks.LockHeldThreshold) > 0 {
+				n.checkHeldLocks()
+			}
+			n.processOutbox()
+		}
+	}
+}